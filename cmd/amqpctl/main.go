@@ -0,0 +1,238 @@
+// Command amqpctl inspects and repairs the retry queues of the amqp package:
+// the waiting queues of the retry ladder, the ready queue and the parking
+// queue. It connects to the broker in RABBITMQ_URL, and reads the names of
+// the queues from the same environment variables as the package. It doesn't
+// declare any of them. depth asks the management API in
+// RABBITMQ_MANAGEMENT_URL for the waiting queues that were declared on demand.
+//
+//	amqpctl depth
+//	amqpctl peek -n 5 amqp.retry.waiting-0300
+//	amqpctl republish -routing-key order.created amqp.retry.waiting-0300
+//	amqpctl move -queue orders amqp.parked amqp.retry.ready
+//	amqpctl purge -body test-order amqp.parked
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+
+	amqputil "github.com/getconversio/go-utils/services/amqp"
+	"github.com/streadway/amqp"
+)
+
+const usage = `Usage: amqpctl <command> [flags] [queues]
+
+Commands:
+  depth                 show the number of messages in every retry queue
+  peek <queue>          show messages with their retry headers
+  move <from> <to>      move messages to another queue
+  republish <queue>     publish messages on their original exchange right away
+  purge <queue>         remove messages
+
+Run amqpctl <command> -h for the flags of a command.
+`
+
+func main() {
+	client := amqputil.NewClient(&amqputil.Options{Confirm: true, SkipRetryTopology: true})
+	management := amqputil.NewManagementClient(nil)
+	if err := run(client, management, os.Args[1:], os.Stdout); err != nil {
+		fmt.Fprintln(os.Stderr, "amqpctl:", err)
+		os.Exit(1)
+	}
+}
+
+func run(client *amqputil.Client, management *amqputil.ManagementClient, args []string, out io.Writer) error {
+	if len(args) == 0 {
+		return fmt.Errorf("no command given\n\n%s", usage)
+	}
+	defer client.Close()
+
+	command, args := args[0], args[1:]
+	flags := flag.NewFlagSet(command, flag.ContinueOnError)
+	flags.SetOutput(out)
+
+	switch command {
+	case "depth":
+		if err := flags.Parse(args); err != nil {
+			return err
+		}
+		return depth(client, management, out)
+
+	case "peek":
+		f := addFilterFlags(flags, 10)
+		maxBody := flags.Int("max-body", 200, "show at most this many bytes of the body, 0 for all")
+		if err := parse(flags, args, 1); err != nil {
+			return err
+		}
+
+		msgs, err := client.PeekMessages(flags.Arg(0), f.filter(), f.limit)
+		if err != nil {
+			return err
+		}
+		for _, msg := range msgs {
+			printMessage(out, msg, *maxBody)
+		}
+		fmt.Fprintf(out, "%d messages\n", len(msgs))
+		return nil
+
+	case "move":
+		f := addFilterFlags(flags, 0)
+		if err := parse(flags, args, 2); err != nil {
+			return err
+		}
+
+		n, err := client.MoveMessages(flags.Arg(0), flags.Arg(1), f.filter(), f.limit)
+		fmt.Fprintf(out, "Moved %d messages\n", n)
+		return err
+
+	case "republish":
+		f := addFilterFlags(flags, 0)
+		if err := parse(flags, args, 1); err != nil {
+			return err
+		}
+
+		n, err := client.RepublishMessages(flags.Arg(0), f.filter(), f.limit)
+		fmt.Fprintf(out, "Republished %d messages\n", n)
+		return err
+
+	case "purge":
+		f := addFilterFlags(flags, 0)
+		all := flags.Bool("all", false, "remove all messages when no filter is given")
+		if err := parse(flags, args, 1); err != nil {
+			return err
+		}
+		if f.filter() == nil && !*all {
+			return fmt.Errorf("purge needs a filter, or -all to remove every message")
+		}
+
+		n, err := client.PurgeMessages(flags.Arg(0), f.filter(), f.limit)
+		fmt.Fprintf(out, "Removed %d messages\n", n)
+		return err
+
+	default:
+		return fmt.Errorf("unknown command %q\n\n%s", command, usage)
+	}
+}
+
+// parse parses the flags and checks the number of queues.
+func parse(flags *flag.FlagSet, args []string, queues int) error {
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if flags.NArg() != queues {
+		want := "one queue"
+		if queues == 2 {
+			want = "two queues"
+		}
+		return fmt.Errorf("%s takes %s, got %d\n\n%s", flags.Name(), want, flags.NArg(), usage)
+	}
+	return nil
+}
+
+func depth(client *amqputil.Client, management *amqputil.ManagementClient, out io.Writer) error {
+	queueNames, err := client.FindRetryQueueNames(management)
+	if err != nil {
+		fmt.Fprintf(out, "Can't list the waiting queues, showing the configured ones: %s\n\n", err)
+		queueNames = client.RetryQueueNames()
+	}
+
+	stats, err := client.QueueStats(queueNames...)
+	if err != nil {
+		return err
+	}
+
+	w := tabwriter.NewWriter(out, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "QUEUE\tMESSAGES\tCONSUMERS")
+	for _, stat := range stats {
+		if stat.Err != nil {
+			fmt.Fprintf(w, "%s\t%s\t\n", stat.Name, stat.Err)
+			continue
+		}
+		fmt.Fprintf(w, "%s\t%d\t%d\n", stat.Name, stat.Messages, stat.Consumers)
+	}
+	return w.Flush()
+}
+
+// filterFlags select messages by where they came from and what they contain.
+type filterFlags struct {
+	limit      int
+	exchange   string
+	routingKey string
+	queue      string
+	messageID  string
+	body       string
+}
+
+// addFilterFlags registers the filter flags, with -n defaulting to limit.
+func addFilterFlags(flags *flag.FlagSet, limit int) *filterFlags {
+	f := new(filterFlags)
+	flags.IntVar(&f.limit, "n", limit, "act on at most this many messages, 0 for all")
+	flags.StringVar(&f.exchange, "exchange", "", "only messages originally published on this exchange")
+	flags.StringVar(&f.routingKey, "routing-key", "", "only messages originally published with this routing key")
+	flags.StringVar(&f.queue, "queue", "", "only messages that failed in this queue")
+	flags.StringVar(&f.messageID, "message-id", "", "only the message with this ID")
+	flags.StringVar(&f.body, "body", "", "only messages whose body contains this text")
+	return f
+}
+
+// filter returns the filter for the flags, or nil if none were given.
+func (f *filterFlags) filter() amqputil.MessageFilter {
+	if f.exchange == "" && f.routingKey == "" && f.queue == "" && f.messageID == "" && f.body == "" {
+		return nil
+	}
+
+	return func(d amqp.Delivery) bool {
+		exchange, routingKey := origin(d)
+		return (f.exchange == "" || f.exchange == exchange) &&
+			(f.routingKey == "" || f.routingKey == routingKey) &&
+			(f.queue == "" || f.queue == header(d, "_queueName")) &&
+			(f.messageID == "" || f.messageID == d.MessageId) &&
+			(f.body == "" || bytes.Contains(d.Body, []byte(f.body)))
+	}
+}
+
+// origin returns the exchange and routing key that the message was originally
+// published with.
+func origin(d amqp.Delivery) (string, string) {
+	if _, ok := d.Headers["_exchangeName"]; ok {
+		return header(d, "_exchangeName"), header(d, "_routingKey")
+	}
+	return d.Exchange, d.RoutingKey
+}
+
+func header(d amqp.Delivery, key string) string {
+	if v, ok := d.Headers[key]; ok {
+		return fmt.Sprint(v)
+	}
+	return ""
+}
+
+func printMessage(out io.Writer, d amqp.Delivery, maxBody int) {
+	exchange, routingKey := origin(d)
+	fmt.Fprintf(out, "exchange=%q routing-key=%q", exchange, routingKey)
+	if d.MessageId != "" {
+		fmt.Fprintf(out, " message-id=%s", d.MessageId)
+	}
+	fmt.Fprintln(out)
+
+	keys := make([]string, 0, len(d.Headers))
+	for key := range d.Headers {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		fmt.Fprintf(out, "  %s: %v\n", key, d.Headers[key])
+	}
+
+	body := string(d.Body)
+	if maxBody > 0 && len(body) > maxBody {
+		body = body[:maxBody] + "..."
+	}
+	fmt.Fprintf(out, "  body (%s): %s\n\n", strings.TrimSpace(d.ContentType+" "+d.ContentEncoding), body)
+}
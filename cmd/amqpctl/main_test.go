@@ -0,0 +1,193 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"testing"
+	"time"
+
+	amqputil "github.com/getconversio/go-utils/services/amqp"
+	"github.com/getconversio/go-utils/services/amqp/amqptest"
+	"github.com/streadway/amqp"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type testMsg struct {
+	I int
+}
+
+func (m *testMsg) NewEmpty() interface{} {
+	return new(testMsg)
+}
+
+// setup returns a broker with two messages of test.one and one of test.two
+// in the waiting queue of one hour, which is not one of the default TTLs, and
+// a management API that knows about it.
+func setup(t *testing.T) (*amqptest.Broker, *amqputil.ManagementClient, func()) {
+	broker := amqptest.NewBroker()
+	c := broker.NewClient(nil)
+	defer c.Close()
+
+	require.NoError(t, c.PublishDelayed("test", "test.one", testMsg{1}, time.Hour))
+	require.NoError(t, c.PublishDelayed("test", "test.one", testMsg{2}, time.Hour))
+	require.NoError(t, c.PublishDelayed("test", "test.two", testMsg{3}, time.Hour))
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`[
+			{"name": "amqp.retry.waiting-3600", "vhost": "/"},
+			{"name": "amqp.retry.waiting-0001", "vhost": "/"},
+			{"name": "orders", "vhost": "/"}
+		]`))
+	}))
+	management := amqputil.NewManagementClient(&amqputil.ManagementOptions{URL: server.URL})
+	return broker, management, server.Close
+}
+
+// ctl runs amqpctl with a client like the one of main.
+func ctl(broker *amqptest.Broker, management *amqputil.ManagementClient, args ...string) (string, error) {
+	var out bytes.Buffer
+	client := broker.NewClient(&amqputil.Options{Confirm: true, SkipRetryTopology: true})
+	err := run(client, management, args, &out)
+	return out.String(), err
+}
+
+func TestDepth(t *testing.T) {
+	broker, management, done := setup(t)
+	defer done()
+
+	out, err := ctl(broker, management, "depth")
+	require.NoError(t, err)
+	assert.Regexp(t, regexp.MustCompile(`(?m)^amqp\.retry\.ready +0 +0$`), out)
+	assert.Regexp(t, regexp.MustCompile(`(?m)^amqp\.retry\.waiting-0600 +0 +0$`), out)
+	assert.Regexp(t, regexp.MustCompile(`(?m)^amqp\.retry\.waiting-3600 +3 +0$`), out)
+	assert.Regexp(t, regexp.MustCompile(`(?m)^amqp\.parked +0 +0$`), out)
+	assert.NotContains(t, out, "orders")
+
+	// Without the management API, only the configured queues are shown.
+	done()
+	out, err = ctl(broker, management, "depth")
+	require.NoError(t, err)
+	assert.Contains(t, out, "Can't list the waiting queues")
+	assert.Regexp(t, regexp.MustCompile(`(?m)^amqp\.retry\.waiting-0600 +0 +0$`), out)
+	assert.NotContains(t, out, "waiting-3600")
+}
+
+func TestDepthDoesNotDeclare(t *testing.T) {
+	broker := amqptest.NewBroker()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`[]`))
+	}))
+	defer server.Close()
+
+	out, err := ctl(broker, amqputil.NewManagementClient(&amqputil.ManagementOptions{URL: server.URL}), "depth")
+	require.NoError(t, err)
+	assert.Regexp(t, regexp.MustCompile(`(?m)^amqp\.retry\.ready +.*NOT_FOUND`), out)
+
+	// The queues are still missing.
+	c := broker.NewClient(&amqputil.Options{SkipRetryTopology: true})
+	defer c.Close()
+	stats, err := c.QueueStats("amqp.retry.ready")
+	require.NoError(t, err)
+	assert.True(t, amqputil.IsNotFound(stats[0].Err))
+}
+
+func TestPeek(t *testing.T) {
+	broker, management, done := setup(t)
+	defer done()
+
+	c := broker.NewClient(nil)
+	defer c.Close()
+	for i := 4; i <= 12; i++ {
+		require.NoError(t, c.PublishDelayed("test", "test.three", testMsg{i}, time.Hour))
+	}
+
+	// Ten messages by default.
+	out, err := ctl(broker, management, "peek", "amqp.retry.waiting-3600")
+	require.NoError(t, err)
+	assert.Contains(t, out, `exchange="test" routing-key="test.one"`)
+	assert.Contains(t, out, `body (application/json): {"I":1}`)
+	assert.Contains(t, out, "\n10 messages\n")
+
+	out, err = ctl(broker, management, "peek", "-n", "0", "-routing-key", "test.three", "amqp.retry.waiting-3600")
+	require.NoError(t, err)
+	assert.NotContains(t, out, "test.one")
+	assert.Contains(t, out, "\n9 messages\n")
+
+	assert.Equal(t, 12, broker.QueueLength("amqp.retry.waiting-3600"))
+
+	_, err = ctl(broker, management, "peek")
+	assert.Error(t, err)
+}
+
+func TestMove(t *testing.T) {
+	broker, management, done := setup(t)
+	defer done()
+
+	out, err := ctl(broker, management, "move", "-routing-key", "test.one", "amqp.retry.waiting-3600", "amqp.parked")
+	require.NoError(t, err)
+	assert.Equal(t, "Moved 2 messages\n", out)
+	assert.Equal(t, 1, broker.QueueLength("amqp.retry.waiting-3600"))
+	assert.Equal(t, 2, broker.QueueLength("amqp.parked"))
+
+	_, err = ctl(broker, management, "move", "amqp.retry.waiting-3600", "amqp.parkd")
+	assert.Error(t, err)
+	assert.Equal(t, 1, broker.QueueLength("amqp.retry.waiting-3600"))
+}
+
+func TestRepublish(t *testing.T) {
+	broker, management, done := setup(t)
+	defer done()
+
+	c := broker.NewClient(nil)
+	defer c.Close()
+	received := make(chan int, 10)
+	_, _, err := c.HandleFunc("test.queue", "test", "test.#", new(testMsg), func(msg interface{}, headers amqp.Table) error {
+		received <- msg.(*testMsg).I
+		return nil
+	})
+	require.NoError(t, err)
+
+	out, err := ctl(broker, management, "republish", "-body", `"I":3`, "amqp.retry.waiting-3600")
+	require.NoError(t, err)
+	assert.Equal(t, "Republished 1 messages\n", out)
+
+	select {
+	case i := <-received:
+		assert.Equal(t, 3, i)
+	case <-time.After(time.Second):
+		t.Fatal("the message was not republished")
+	}
+	assert.Equal(t, 2, broker.QueueLength("amqp.retry.waiting-3600"))
+}
+
+func TestPurge(t *testing.T) {
+	broker, management, done := setup(t)
+	defer done()
+
+	_, err := ctl(broker, management, "purge", "amqp.retry.waiting-3600")
+	assert.EqualError(t, err, "purge needs a filter, or -all to remove every message")
+	assert.Equal(t, 3, broker.QueueLength("amqp.retry.waiting-3600"))
+
+	out, err := ctl(broker, management, "purge", "-n", "1", "-routing-key", "test.one", "amqp.retry.waiting-3600")
+	require.NoError(t, err)
+	assert.Equal(t, "Removed 1 messages\n", out)
+
+	out, err = ctl(broker, management, "purge", "-all", "amqp.retry.waiting-3600")
+	require.NoError(t, err)
+	assert.Equal(t, "Removed 2 messages\n", out)
+	assert.Equal(t, 0, broker.QueueLength("amqp.retry.waiting-3600"))
+}
+
+func TestUnknownCommand(t *testing.T) {
+	broker, management, done := setup(t)
+	defer done()
+
+	_, err := ctl(broker, management)
+	assert.Error(t, err)
+
+	_, err = ctl(broker, management, "drop")
+	assert.Contains(t, err.Error(), `unknown command "drop"`)
+}
@@ -1,376 +1,252 @@
 package amqp
 
 import (
-	"encoding/json"
-	"fmt"
-	"os"
-	"strconv"
+	"context"
+	"net/http"
 	"sync"
-	"sync/atomic"
+	"time"
 
-	"github.com/getconversio/go-utils/util"
-	log "github.com/sirupsen/logrus"
 	"github.com/streadway/amqp"
 )
 
+// The client used by the package level functions, guarded by defaultMu.
 var (
-	conn               *amqp.Connection
-	ch                 *amqp.Channel
-	consumerSeq        uint64
-	channelOnce        sync.Once
-	retryConsumerOnce  sync.Once
-	queueTtls          = []int{1, 5, 10, 30, 60, 300, 600}
-	readyQueueName     = util.Getenv("RABBITMQ_READY_QUEUE", "amqp.retry.ready")
-	retryExchange      = util.Getenv("RABBITMQ_RETRY_EXCHANGE", "amqp.retry")
-	retryRoutingKey    = util.Getenv("RABBITMQ_RETRY_ROUTING", "retry")
-	retryQueueTemplate = util.Getenv("RABBITMQ_RETRY_QUEUE", "amqp.retry.waiting") + "-%04d"
+	defaultMu     sync.Mutex
+	defaultClient *Client
 )
 
 type EmptyCreator interface {
 	NewEmpty() interface{}
 }
 
-func onCancel() {
-	if os.Getenv("RABBITMQ_CLOSE_ON_CANCEL") == "yes" {
-		conn.Close()
+// std returns the client used by the package level functions. It is
+// configured from the environment the first time it is used.
+func std() *Client {
+	defaultMu.Lock()
+	defer defaultMu.Unlock()
+
+	if defaultClient == nil {
+		defaultClient = NewClient(nil)
 	}
+	return defaultClient
 }
 
-func onClose() {
-	if os.Getenv("RABBITMQ_EXIT_ON_CLOSE") == "yes" {
-		log.Panic("AMQP connection closed, don't know what to")
-	}
+// SetDefault makes the package level functions use the given client instead
+// of the one configured from the environment, e.g. a client connected to the
+// in-memory broker of the amqptest package.
+//
+// It is safe to call while other goroutines use the package level functions,
+// calls that already started finish on the previous client. With a nil
+// client, the next call configures one from the environment again.
+func SetDefault(c *Client) {
+	defaultMu.Lock()
+	defer defaultMu.Unlock()
+	defaultClient = c
 }
 
-func newChannel() (*amqp.Connection, *amqp.Channel) {
-	u := os.Getenv("RABBITMQ_URL")
+// EnsureExchange calls Client.EnsureExchange on the default client.
+func EnsureExchange(exchangeName string) error {
+	return std().EnsureExchange(exchangeName)
+}
 
-	// If the url is empty, try a provider specific url.
-	if u == "" {
-		u = os.Getenv("CLOUDAMQP_URL")
-	}
+// MustEnsureExchange calls Client.MustEnsureExchange on the default client.
+func MustEnsureExchange(exchangeName string) {
+	std().MustEnsureExchange(exchangeName)
+}
 
-	conn, err := amqp.Dial(u)
-	util.PanicOnError("Failed to connect to RabbitMQ", err)
-
-	ch, err := conn.Channel()
-	util.PanicOnError("Failed to open RabbitMQ channel", err)
-
-	// XXX: Changing the global parameter to true will fail on Codeship because
-	// it uses an older version of RabbitMQ that does not support it. So it's
-	// set to false by default for now.
-	err = ch.Qos(20, 0, false)
-	util.PanicOnError("Failed to set Qos on RabbitMQ channel", err)
-
-	return conn, ch
-}
-
-func ensureChannel() {
-	channelOnce.Do(func() {
-		conn, ch = newChannel()
-
-		go func() {
-			closeChannel := conn.NotifyClose(make(chan *amqp.Error))
-			for e := range closeChannel {
-				log.Infof("AMQP received close message: %v", e)
-			}
-			onClose()
-		}()
-
-		_, err := ch.QueueDeclare(
-			readyQueueName, // name
-			true,           // durable
-			false,          // delete when unused
-			false,          // exclusive
-			false,          // no-wait
-			nil,            // arguments
-		)
-		util.PanicOnError("Failed to declare RabbitMQ queue", err)
-
-		err = ch.ExchangeDeclare(
-			retryExchange, // name
-			"topic",       // type
-			true,          // durable
-			false,         // auto-deleted
-			false,         // internal
-			false,         // no-wait
-			nil,           // arguments
-		)
-		util.PanicOnError("Failed to declare RabbitMQ exchange", err)
-
-		err = ch.QueueBind(
-			readyQueueName,  // queue name
-			retryRoutingKey, // routing key
-			retryExchange,   // exchange name
-			false,           // no-wait
-			nil,             // arguments
-		)
-		util.PanicOnError("Failed to bind RabbitMQ queue", err)
-
-		for _, ttl := range queueTtls {
-			args := make(amqp.Table)
-			args["x-dead-letter-exchange"] = retryExchange
-			args["x-dead-letter-routing-key"] = retryRoutingKey
-			args["x-message-ttl"] = int32(ttl * 1000)
-
-			_, err = ch.QueueDeclare(
-				fmt.Sprintf(retryQueueTemplate, ttl), // name
-				true,  // durable
-				false, // delete when unused
-				false, // exclusive
-				false, // no-wait
-				args,  // arguments
-			)
-			util.PanicOnError("Failed to declare RabbitMQ queue", err)
-		}
-	})
+// EnsureQueue calls Client.EnsureQueue on the default client.
+func EnsureQueue(queueName string) error {
+	return std().EnsureQueue(queueName)
 }
 
-// Ensures that the exchange with the given name exists.
-// It is not necessary to call this function when using HandleFunc
-func EnsureExchange(exchangeName string) {
-	ensureChannel()
+// MustEnsureQueue calls Client.MustEnsureQueue on the default client.
+func MustEnsureQueue(queueName string) {
+	std().MustEnsureQueue(queueName)
+}
 
-	err := ch.ExchangeDeclare(
-		exchangeName,
-		"topic", // type
-		true,    // durable
-		false,   // auto-deleted
-		false,   // internal
-		false,   // no-wait
-		nil,     // arguments
-	)
-	util.PanicOnError("Failed to declare RabbitMQ exchange", err)
+// PurgeQueue calls Client.PurgeQueue on the default client.
+func PurgeQueue(queueName string) error {
+	return std().PurgeQueue(queueName)
 }
 
-// Ensures that the queue with the given name exists.
-// It is not necessary to call this function when using HandleFunc
-func EnsureQueue(queueName string) {
-	ensureChannel()
+// MustPurgeQueue calls Client.MustPurgeQueue on the default client.
+func MustPurgeQueue(queueName string) {
+	std().MustPurgeQueue(queueName)
+}
 
-	_, err := ch.QueueDeclare(
-		queueName, // name
-		true,      // durable
-		false,     // delete when unused
-		false,     // exclusive
-		false,     // no-wait
-		nil,       // arguments
-	)
-	util.PanicOnError("Failed to declare RabbitMQ queue", err)
+// EnsureRetryConsumer calls Client.EnsureRetryConsumer on the default client.
+func EnsureRetryConsumer() error {
+	return std().EnsureRetryConsumer()
 }
 
-func PurgeQueue(queueName string) {
-	_, err := ch.QueuePurge(queueName, false)
-	util.PanicOnError("Failed to purge RabbitMQ queue", err)
+// MustEnsureRetryConsumer calls Client.MustEnsureRetryConsumer on the default
+// client.
+func MustEnsureRetryConsumer() {
+	std().MustEnsureRetryConsumer()
 }
 
-// A raw message struct. Used by the retry handler.
-// Note: while encoding/json has a RawMessage type that works essentially the
-// same way, it did not work well for this use case.
-type retryCarrier struct {
-	Raw []byte
+// Publish calls Client.Publish on the default client.
+func Publish(exchangeName, routingKey string, msg interface{}) error {
+	return std().Publish(exchangeName, routingKey, msg)
 }
 
-func (t *retryCarrier) NewEmpty() interface{} {
-	return new(retryCarrier)
+// PublishCodec calls Client.PublishCodec on the default client.
+func PublishCodec(exchangeName, routingKey string, msg interface{}, codec Codec) error {
+	return std().PublishCodec(exchangeName, routingKey, msg, codec)
 }
 
-func (t *retryCarrier) UnmarshalJSON(data []byte) error {
-	t.Raw = data
-	return nil
+// HandleFunc calls Client.HandleFunc on the default client.
+func HandleFunc(queueName, exchangeName, routingKey string, msgCreator EmptyCreator, handler func(interface{}, amqp.Table) error, options ...ConsumerOption) (string, Channel, error) {
+	return std().HandleFunc(queueName, exchangeName, routingKey, msgCreator, handler, options...)
 }
 
-func (t *retryCarrier) MarshalJSON() ([]byte, error) {
-	return t.Raw, nil
+// MustHandleFunc calls Client.MustHandleFunc on the default client.
+func MustHandleFunc(queueName, exchangeName, routingKey string, msgCreator EmptyCreator, handler func(interface{}, amqp.Table) error, options ...ConsumerOption) (string, Channel) {
+	return std().MustHandleFunc(queueName, exchangeName, routingKey, msgCreator, handler, options...)
 }
 
-func EnsureRetryConsumer() {
-	retryConsumerOnce.Do(func() {
-		ensureChannel()
+// ReplayParked calls Client.ReplayParked on the default client.
+func ReplayParked(routingKey string) (int, error) {
+	return std().ReplayParked(routingKey)
+}
 
-		HandleFunc(readyQueueName, retryExchange, retryRoutingKey, new(retryCarrier), func(msg interface{}, headers amqp.Table) error {
-			retryNumber, _ := strconv.Atoi(headers["_retryNumber"].(string))
-			if retryNumber >= len(queueTtls) {
-				log.Error("Permanent task failure")
-				return nil
-			}
+// RetryQueueNames calls Client.RetryQueueNames on the default client.
+func RetryQueueNames() []string {
+	return std().RetryQueueNames()
+}
 
-			exchangeName := headers["_exchangeName"].(string)
-			routingKey := headers["_routingKey"].(string)
+// FindRetryQueueNames calls Client.FindRetryQueueNames on the default client.
+func FindRetryQueueNames(management *ManagementClient) ([]string, error) {
+	return std().FindRetryQueueNames(management)
+}
 
-			msgBytes, err := json.Marshal(msg)
-			util.PanicOnError("Failed to marshall JSON data for RabbitMQ message", err)
+// PeekMessages calls Client.PeekMessages on the default client.
+func PeekMessages(queueName string, filter MessageFilter, limit int) ([]amqp.Delivery, error) {
+	return std().PeekMessages(queueName, filter, limit)
+}
 
-			return ch.Publish(
-				exchangeName,
-				routingKey,
-				false, // Mandatory
-				false, // Immediate
-				amqp.Publishing{
-					ContentType: "application/json",
-					Body:        msgBytes,
-					Headers:     headers,
-				})
-		})
-	})
+// MoveMessages calls Client.MoveMessages on the default client.
+func MoveMessages(from, to string, filter MessageFilter, limit int) (int, error) {
+	return std().MoveMessages(from, to, filter, limit)
 }
 
-// Publish publishes a new message on the given exchange and using the given
-// routing key.
-//
-// Notice that unlike all other Ensure* functions, Publish only makes sure there
-// is an open connection and channel. It does not make sure the exchange is
-// present.
-func Publish(exchangeName, routingKey string, msg interface{}) error {
-	ensureChannel()
+// RepublishMessages calls Client.RepublishMessages on the default client.
+func RepublishMessages(queueName string, filter MessageFilter, limit int) (int, error) {
+	return std().RepublishMessages(queueName, filter, limit)
+}
 
-	msgBytes, err := json.Marshal(msg)
-	util.PanicOnError("Failed to marshall JSON data for RabbitMQ message", err)
+// PurgeMessages calls Client.PurgeMessages on the default client.
+func PurgeMessages(queueName string, filter MessageFilter, limit int) (int, error) {
+	return std().PurgeMessages(queueName, filter, limit)
+}
 
-	return ch.Publish(
-		exchangeName,
-		routingKey,
-		false, // Mandatory
-		false, // Immediate
-		amqp.Publishing{
-			ContentType: "application/json",
-			Body:        msgBytes,
-		})
+// ReplayInvalid calls Client.ReplayInvalid on the default client.
+func ReplayInvalid(queueName string) (int, error) {
+	return std().ReplayInvalid(queueName)
 }
 
-func publishRetry(message amqp.Delivery) error {
-	retryNumber := 0
+// HandleContext calls Client.HandleContext on the default client.
+func HandleContext(queueName, exchangeName, routingKey string, msgCreator EmptyCreator, handler Handler, options ...ConsumerOption) (string, Channel, error) {
+	return std().HandleContext(queueName, exchangeName, routingKey, msgCreator, handler, options...)
+}
 
-	if len(message.Headers) == 0 {
-		message.Headers = make(amqp.Table)
-	}
+// MustHandleContext calls Client.MustHandleContext on the default client.
+func MustHandleContext(queueName, exchangeName, routingKey string, msgCreator EmptyCreator, handler Handler, options ...ConsumerOption) (string, Channel) {
+	return std().MustHandleContext(queueName, exchangeName, routingKey, msgCreator, handler, options...)
+}
 
-	message.Headers["_exchangeName"] = message.Exchange
-	message.Headers["_routingKey"] = message.RoutingKey
+// Stop calls Client.Stop on the default client.
+func Stop(ctag string) error {
+	return std().Stop(ctag)
+}
 
-	if r, ok := message.Headers["_retryNumber"]; ok {
-		retryNumber, _ = strconv.Atoi(r.(string))
-	}
+// Shutdown calls Client.Shutdown on the default client.
+func Shutdown(ctx context.Context) error {
+	return std().Shutdown(ctx)
+}
 
-	if retryNumber >= len(queueTtls) {
-		return nil
-	}
+// GracefulShutdown calls Client.GracefulShutdown on the default client.
+func GracefulShutdown(timeout time.Duration) chan bool {
+	return std().GracefulShutdown(timeout)
+}
 
-	// TODO test this
-	message.Headers["_retryNumber"] = strconv.Itoa(retryNumber + 1)
+// QueueTotalMessages calls Client.QueueTotalMessages on the default client.
+func QueueTotalMessages(queueNames []string) (int, error) {
+	return std().QueueTotalMessages(queueNames)
+}
 
-	return ch.Publish(
-		"",
-		fmt.Sprintf(retryQueueTemplate, queueTtls[retryNumber]),
-		false, // Mandatory
-		false, // Immediate
-		amqp.Publishing{
-			ContentType: "application/json",
-			Body:        message.Body,
-			Headers:     message.Headers,
-		})
+// QueueStats calls Client.QueueStats on the default client.
+func QueueStats(queueNames ...string) ([]QueueStat, error) {
+	return std().QueueStats(queueNames...)
 }
 
-// HandleFunc sets up a handler/consumer function for the given queue, exchange
-// and routing key. It ensures that there is an open connection and channel.
-//
-// It is assumed that message communication happens via JSON-formatted messages.
-//
-// The msgCreator interface is needed in order for the returned handler to be
-// able to cast the returned message into the right type.
-//
-// Returns the ctag for the consumer and the channel that the consumer was
-// opened on.
-func HandleFunc(queueName, exchangeName, routingKey string, msgCreator EmptyCreator, handler func(interface{}, amqp.Table) error) (string, *amqp.Channel) {
-	ensureChannel()
-	EnsureExchange(exchangeName)
-	EnsureQueue(queueName)
-
-	err := ch.QueueBind(queueName, routingKey, exchangeName, false, nil)
-	util.PanicOnError("Failed to bind RabbitMQ queue", err)
-
-	// Inspired by the amqp code
-	ctag := fmt.Sprintf("ctag-%d", atomic.AddUint64(&consumerSeq, 1))
-
-	// Consume from a queue and create a go-routine that listens for messages
-	// forever.
-	msgs, err := ch.Consume(
-		queueName, // queue
-		ctag,      // consumer tag
-		false,     // auto-ack
-		false,     // exclusive
-		false,     // no-local
-		false,     // no-wait
-		nil,       // args
-	)
-	util.PanicOnError("Failed to register a RabbitMQ consumer", err)
-
-	logger := log.WithFields(log.Fields{
-		"ctag":     ctag,
-		"queue":    queueName,
-		"exchange": exchangeName,
-		"routing":  routingKey,
-	})
+// ApplyTopology calls Client.ApplyTopology on the default client.
+func ApplyTopology(t *Topology) error {
+	return std().ApplyTopology(t)
+}
 
-	shouldRetry := true
-	// If we're setting up the ready queue, it should never retry from failures on that queue...
-	if queueName == readyQueueName {
-		shouldRetry = false
-	}
+// DiffTopology calls Client.DiffTopology on the default client.
+func DiffTopology(t *Topology) ([]TopologyDifference, error) {
+	return std().DiffTopology(t)
+}
 
-	go func() {
-		for msg := range msgs {
-			// Create a new empty handlerMsg
-			handlerMsg := msgCreator.NewEmpty()
-
-			// Assume JSON and unmarshal the body of the message into the given handler message.
-			err = json.Unmarshal(msg.Body, handlerMsg)
-
-			// An error when unmarshalling the JSON is not something we can
-			// retry. Log an error and ack the message.
-			if err != nil {
-				logger.WithField("body", fmt.Sprintf("%s", msg.Body)).Errorf("Could not unmarshal AMQP message: %s", err)
-				msg.Ack(false)
-				continue
-			}
-
-			// Run the handler
-			err = handler(handlerMsg, msg.Headers)
-			if err != nil {
-				logger.Errorf("Error while processing message: %s", err)
-
-				if shouldRetry {
-					err = publishRetry(msg)
-
-					if err != nil {
-						logger.Errorf("Error while trying to publish to retry queue: %s", err)
-					}
-				}
-			}
-
-			// Ack the message
-			err = msg.Ack(false)
-			if err != nil {
-				logger.Errorf("Could not ack message: %s", err)
-			}
-		}
-		logger.Info("AMQP consumer was cancelled")
-		onCancel()
-	}()
-
-	logger.Debug("Handler waiting for messages")
-	return ctag, ch
-}
-
-// QueueTotalMessages returns the number of messages across the given queue
-// names.
-func QueueTotalMessages(queueNames []string) int {
-	ensureChannel()
-
-	total := 0
-	for _, queueName := range queueNames {
-		queue, _ := ch.QueueInspect(queueName)
-		total += queue.Messages
-	}
-	return total
+// Call calls Client.Call on the default client.
+func Call(ctx context.Context, exchangeName, routingKey string, req, resp interface{}) error {
+	return std().Call(ctx, exchangeName, routingKey, req, resp)
+}
+
+// HandleRPC calls Client.HandleRPC on the default client.
+func HandleRPC(queueName, exchangeName, routingKey string, msgCreator EmptyCreator, handler RPCHandler, options ...ConsumerOption) (string, Channel, error) {
+	return std().HandleRPC(queueName, exchangeName, routingKey, msgCreator, handler, options...)
+}
+
+// MustHandleRPC calls Client.MustHandleRPC on the default client.
+func MustHandleRPC(queueName, exchangeName, routingKey string, msgCreator EmptyCreator, handler RPCHandler, options ...ConsumerOption) (string, Channel) {
+	return std().MustHandleRPC(queueName, exchangeName, routingKey, msgCreator, handler, options...)
+}
+
+// HandleBatch calls Client.HandleBatch on the default client.
+func HandleBatch(queueName, exchangeName, routingKey string, msgCreator EmptyCreator, size int, maxDelay time.Duration, handler BatchHandler, options ...ConsumerOption) (string, Channel, error) {
+	return std().HandleBatch(queueName, exchangeName, routingKey, msgCreator, size, maxDelay, handler, options...)
+}
+
+// MustHandleBatch calls Client.MustHandleBatch on the default client.
+func MustHandleBatch(queueName, exchangeName, routingKey string, msgCreator EmptyCreator, size int, maxDelay time.Duration, handler BatchHandler, options ...ConsumerOption) (string, Channel) {
+	return std().MustHandleBatch(queueName, exchangeName, routingKey, msgCreator, size, maxDelay, handler, options...)
+}
+
+// Use calls Client.Use on the default client.
+func Use(middleware ...Middleware) {
+	std().Use(middleware...)
+}
+
+// PublishDelayed calls Client.PublishDelayed on the default client.
+func PublishDelayed(exchangeName, routingKey string, msg interface{}, delay time.Duration) error {
+	return std().PublishDelayed(exchangeName, routingKey, msg, delay)
+}
+
+// ReportQueueDepths calls Client.ReportQueueDepths on the default client.
+func ReportQueueDepths() error {
+	return std().ReportQueueDepths()
+}
+
+// PublishContext calls Client.PublishContext on the default client.
+func PublishContext(ctx context.Context, exchangeName, routingKey string, msg interface{}) error {
+	return std().PublishContext(ctx, exchangeName, routingKey, msg)
+}
+
+// LivenessHandler is like Client.LivenessHandler for the default client at
+// the time of the request.
+func LivenessHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		std().LivenessHandler().ServeHTTP(w, r)
+	})
+}
+
+// ReadinessHandler is like Client.ReadinessHandler for the default client at
+// the time of the request.
+func ReadinessHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		std().ReadinessHandler().ServeHTTP(w, r)
+	})
 }
@@ -0,0 +1,39 @@
+package amqp_test
+
+import (
+	"sync"
+	"testing"
+
+	"github.com/getconversio/go-utils/services/amqp"
+	"github.com/getconversio/go-utils/services/amqp/amqptest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBrokerSetDefault(t *testing.T) {
+	first, second := amqptest.NewBroker(), amqptest.NewBroker()
+	c1, c2 := first.NewClient(nil), second.NewClient(nil)
+	defer c1.Close()
+	defer c2.Close()
+	require.NoError(t, c1.EnsureExchange("test"))
+	require.NoError(t, c2.EnsureExchange("test"))
+
+	amqp.SetDefault(c1)
+	defer amqp.SetDefault(nil)
+
+	// The package level functions may be in use while the default changes.
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			assert.NoError(t, amqp.Publish("test", "test.routing", testMsg{i}))
+		}(i)
+	}
+	amqp.SetDefault(c2)
+	wg.Wait()
+
+	require.NoError(t, amqp.Publish("test", "test.routing", testMsg{10}))
+	second.ExpectPublished(t, "test", "test.routing")
+	assert.Len(t, append(first.Published(), second.Published()...), 11)
+}
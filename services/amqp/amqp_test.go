@@ -15,7 +15,7 @@ import (
 )
 
 var (
-	notify     chan amqp.Confirmation
+	ch         Channel
 	acks       int
 	nacks      int
 	total      int
@@ -49,47 +49,60 @@ func resetQueues(t *testing.T) {
 	require.NoError(t, err)
 	_, err = ch.QueuePurge("amqp.retry.ready", false)
 	require.NoError(t, err)
+	_, err = ch.QueuePurge("amqp.parked", false)
+	require.NoError(t, err)
+}
+
+// confirms counts the acks and nacks of the messages that the default client
+// publishes, on whichever channel of its pool they go out.
+type confirms struct{}
+
+func (confirms) Consumed(queue, exchange, routingKey, result string, took time.Duration) {}
+
+func (confirms) Published(exchange, routingKey string, err error, took time.Duration) {
+	notifyLock.Lock()
+	if err == nil {
+		acks++
+	} else {
+		nacks++
+	}
+	notifyLock.Unlock()
 }
 
+func (confirms) QueueDepth(queue string, messages int) {}
+
 func setup() {
-	ensureChannel()
+	// Keep track of acks and nacks. Only do this once though.
+	notifyOnce.Do(func() {
+		c := NewClient(nil)
+		c.opts.Metrics = confirms{}
+		SetDefault(c)
+	})
+
+	// The tests publish raw messages and inspect queues on a channel of their
+	// own, the broker closes it when a queue does not exist.
+	ch, _ = std().openChannel()
 	ch.QueueDelete("test.mctest", false, false, false)
 	ch.ExchangeDelete("test", false, false)
 	resetAcksNack()
-
-	// Start a notification listener so we can keep track of acks and nacks.
-	// Only do this once though.
-	notifyOnce.Do(func() {
-		notify = ch.NotifyPublish(make(chan amqp.Confirmation))
-		go func() {
-			for n := range notify {
-				notifyLock.Lock()
-				if n.Ack {
-					acks++
-				} else {
-					nacks++
-				}
-				notifyLock.Unlock()
-			}
-		}()
-		ch.Confirm(false)
-	})
 	intChannel = make(chan int)
 }
 
 func teardown() {
 	ch.QueueDelete("test.mctest", false, false, false)
 	ch.ExchangeDelete("test", false, false)
+	ch.Close()
 	close(intChannel)
 }
 
-func testHandle(f func(interface{}, amqp.Table) error) (string, *amqp.Channel) {
-	return HandleFunc(
+func testHandle(f func(interface{}, amqp.Table) error, options ...ConsumerOption) (string, Channel) {
+	return MustHandleFunc(
 		"test.mctest",  // Queue name
 		"test",         // Exchange name
 		"test.routing", // Routing key
 		new(msgType),
-		f)
+		f,
+		options...)
 }
 
 func TestHandleFunc(t *testing.T) {
@@ -104,9 +117,11 @@ func TestHandleFunc(t *testing.T) {
 		nacksWanted        int
 		retryQueueLength   int
 		retriesWantedIn300 int
+		parkedWanted       int
+		invalidWanted      int
 	}{
 		{
-			// Wrong JSON is acked
+			// Wrong JSON is acked and moved to the invalid queue
 			func(msg interface{}, headers amqp.Table) error { return nil },
 			[]byte("not JSON"),
 			amqp.Table{},
@@ -114,16 +129,20 @@ func TestHandleFunc(t *testing.T) {
 			0,
 			0,
 			0,
+			0,
+			1,
 		},
 		{
 			// Error in handler function is acked.
 			func(msg interface{}, headers amqp.Table) error { return errors.New("not good") },
 			[]byte("{}"),
 			amqp.Table{},
-			2,
+			1,
 			0,
 			1,
 			0,
+			0,
+			0,
 		},
 		{
 			// Test _retryNumber
@@ -132,13 +151,15 @@ func TestHandleFunc(t *testing.T) {
 			amqp.Table{
 				"_retryNumber": "5",
 			},
-			2,
+			1,
 			0,
 			0,
 			1,
+			0,
+			0,
 		},
 		{
-			// Test _retryNumber limit
+			// Test _retryNumber limit, the message is parked
 			func(msg interface{}, headers amqp.Table) error { return errors.New("not good") },
 			[]byte("{}"),
 			amqp.Table{
@@ -148,6 +169,8 @@ func TestHandleFunc(t *testing.T) {
 			0,
 			0,
 			0,
+			1,
+			0,
 		},
 	}
 
@@ -156,7 +179,8 @@ func TestHandleFunc(t *testing.T) {
 		resetQueues(t)
 		ctag, _ := testHandle(c.fun)
 
-		// Force an error
+		// Force an error. The message is published on the test's channel, so
+		// only what the client publishes in turn is confirmed.
 		err := ch.Publish(
 			"test",
 			"test.routing",
@@ -199,7 +223,19 @@ func TestHandleFunc(t *testing.T) {
 
 		assert.Equal(t, c.retriesWantedIn300, queue.Messages)
 
-		ch.Cancel(ctag, false)
+		queue, err = ch.QueueInspect("amqp.parked")
+		require.NoError(t, err)
+		assert.Equal(t, c.parkedWanted, queue.Messages)
+
+		// The invalid queue is only declared once a message is moved there.
+		if c.invalidWanted > 0 {
+			queue, err = ch.QueueInspect("test.mctest.invalid")
+			require.NoError(t, err)
+			assert.Equal(t, c.invalidWanted, queue.Messages)
+			ch.QueueDelete("test.mctest.invalid", false, false, false)
+		}
+
+		Stop(ctag)
 		resetQueues(t)
 	}
 }
@@ -223,7 +259,7 @@ func TestEnsureRetryConsumer(t *testing.T) {
 
 	err := ch.Publish(
 		"",
-		readyQueueName,
+		std().opts.ReadyQueue,
 		false, // Mandatory
 		false, // Immediate
 		amqp.Publishing{
@@ -295,7 +331,7 @@ func TestCloseOnCancel(t *testing.T) {
 		err = os.Setenv("RABBITMQ_EXIT_ON_CLOSE", "yes")
 		require.NoError(t, err)
 
-		ctag, _ := testHandle(func(msg interface{}, headers amqp.Table) error { return nil })
+		ctag, ch := testHandle(func(msg interface{}, headers amqp.Table) error { return nil })
 		ch.Cancel(ctag, false) // This should exit the process
 
 		// Allow up to five seconds time for the handler to cancel and close
@@ -383,10 +419,12 @@ func TestQueueTotalMessages(t *testing.T) {
 	}, 2000)
 
 	// Should purge the queue synchronously
-	num := QueueTotalMessages([]string{"test.mctest"})
+	num, err := QueueTotalMessages([]string{"test.mctest"})
+	require.NoError(t, err)
 	assert.Equal(t, 1, num)
 
-	num = QueueTotalMessages([]string{"test.mctest", "test.mctest2"})
+	num, err = QueueTotalMessages([]string{"test.mctest", "test.mctest2"})
+	require.NoError(t, err)
 	assert.Equal(t, 2, num)
 }
 
@@ -0,0 +1,567 @@
+// Package amqptest provides an in-memory broker for testing code that uses the
+// amqp package, without a running RabbitMQ.
+//
+// The broker routes messages through direct, fanout and topic exchanges,
+// delivers them to consumers with acks and prefetch, and dead-letters expired
+// messages, so the client's retry ladder and parking queue work as they do
+// against RabbitMQ:
+//
+//	broker := amqptest.NewBroker()
+//	amqp.SetDefault(broker.NewClient(nil))
+//
+//	amqp.Publish("myexchange", "myrouting", mystruct{})
+//	broker.ExpectPublished(t, "myexchange", "myrouting")
+package amqptest
+
+import (
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	amqputil "github.com/getconversio/go-utils/services/amqp"
+	"github.com/streadway/amqp"
+)
+
+// Message is a message that was published on the broker.
+type Message struct {
+	Exchange   string
+	RoutingKey string
+	amqp.Publishing
+}
+
+// TestingT is the part of *testing.T that the assertions use.
+type TestingT interface {
+	Errorf(format string, args ...interface{})
+}
+
+// Broker is an in-memory AMQP broker. The zero value is not usable, create one
+// with NewBroker.
+type Broker struct {
+	// How long ExpectPublished waits for a message. Defaults to one second.
+	Timeout time.Duration
+
+	mu        sync.Mutex
+	exchanges map[string]*exchange
+	queues    map[string]*queue
+	conns     map[*connection]bool
+	seq       int
+
+	published []Message
+	// Closed and replaced whenever a message is published.
+	publishedSignal chan struct{}
+}
+
+type exchange struct {
+	name     string
+	kind     string
+	durable  bool
+	args     amqp.Table
+	bindings []binding
+}
+
+type binding struct {
+	queue string
+	key   string
+	args  amqp.Table
+}
+
+type queue struct {
+	name       string
+	durable    bool
+	autoDelete bool
+	args       amqp.Table
+	owner      *connection
+
+	messages  []*message
+	consumers []*consumer
+	next      int
+}
+
+type message struct {
+	exchange    string
+	routingKey  string
+	publishing  amqp.Publishing
+	redelivered bool
+	expiry      *time.Timer
+}
+
+// NewBroker creates an empty broker. Like RabbitMQ, it has the default
+// exchange and the amq.direct, amq.fanout, amq.topic and amq.headers
+// exchanges.
+func NewBroker() *Broker {
+	b := &Broker{
+		Timeout:         time.Second,
+		exchanges:       make(map[string]*exchange),
+		queues:          make(map[string]*queue),
+		conns:           make(map[*connection]bool),
+		publishedSignal: make(chan struct{}),
+	}
+	for _, kind := range []string{"direct", "fanout", "topic", "headers"} {
+		b.exchanges["amq."+kind] = &exchange{name: "amq." + kind, kind: kind, durable: true}
+	}
+	return b
+}
+
+// Dial connects to the broker. The URL is ignored. Use it as Options.Dial.
+func (b *Broker) Dial(url string) (amqputil.Connection, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	conn := &connection{broker: b, channels: make(map[*channel]bool)}
+	b.conns[conn] = true
+	return conn, nil
+}
+
+// NewClient creates a client that is connected to the broker. Unlike
+// amqp.NewClient, nil options are not read from the environment, but publisher
+// confirms are enabled like they are by default.
+func (b *Broker) NewClient(options *amqputil.Options) *amqputil.Client {
+	opts := amqputil.Options{Confirm: true}
+	if options != nil {
+		opts = *options
+	}
+	if opts.URL == "" {
+		opts.URL = "amqp://amqptest"
+	}
+	opts.Dial = b.Dial
+	return amqputil.NewClient(&opts)
+}
+
+// Disconnect closes all connections as if the broker went away. Clients
+// connect again right away, since the broker is still there.
+func (b *Broker) Disconnect() {
+	b.mu.Lock()
+	conns := make([]*connection, 0, len(b.conns))
+	for conn := range b.conns {
+		conns = append(conns, conn)
+	}
+	b.mu.Unlock()
+
+	for _, conn := range conns {
+		conn.shutdown(newError(amqp.ConnectionForced, "CONNECTION_FORCED - broker forced connection closure"))
+	}
+}
+
+// Block tells all connections that the broker blocked them, like RabbitMQ does
+// when it is low on memory or disk space. Unlike RabbitMQ, it does not hold up
+// publishing.
+func (b *Broker) Block(reason string) {
+	b.notifyBlocked(amqp.Blocking{Active: true, Reason: reason})
+}
+
+// Unblock tells all connections that the broker unblocked them.
+func (b *Broker) Unblock() {
+	b.notifyBlocked(amqp.Blocking{})
+}
+
+func (b *Broker) notifyBlocked(block amqp.Blocking) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	for conn := range b.conns {
+		for _, receiver := range conn.blocks {
+			receiver <- block
+		}
+	}
+}
+
+// Published returns all messages that were published on the broker, in the
+// order they were published. Messages that the broker dead-lettered are not
+// included.
+func (b *Broker) Published() []Message {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return append([]Message(nil), b.published...)
+}
+
+// PublishedTo returns the messages that were published on the given exchange
+// with the given routing key.
+func (b *Broker) PublishedTo(exchangeName, routingKey string) []Message {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.publishedTo(exchangeName, routingKey)
+}
+
+func (b *Broker) publishedTo(exchangeName, routingKey string) []Message {
+	var msgs []Message
+	for _, msg := range b.published {
+		if msg.Exchange == exchangeName && msg.RoutingKey == routingKey {
+			msgs = append(msgs, msg)
+		}
+	}
+	return msgs
+}
+
+// ExpectPublished fails the test unless a message is published on the given
+// exchange with the given routing key within Timeout. It returns the first
+// such message.
+func (b *Broker) ExpectPublished(t TestingT, exchangeName, routingKey string) Message {
+	timer := time.NewTimer(b.Timeout)
+	defer timer.Stop()
+
+	for {
+		b.mu.Lock()
+		msgs := b.publishedTo(exchangeName, routingKey)
+		signal := b.publishedSignal
+		b.mu.Unlock()
+
+		if len(msgs) > 0 {
+			return msgs[0]
+		}
+
+		select {
+		case <-signal:
+		case <-timer.C:
+			t.Errorf("No message was published to exchange %q with routing key %q", exchangeName, routingKey)
+			return Message{}
+		}
+	}
+}
+
+// Reset forgets the published messages.
+func (b *Broker) Reset() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.published = nil
+}
+
+// QueueLength returns the number of messages in the queue that are ready to be
+// delivered. It is zero if the queue does not exist.
+func (b *Broker) QueueLength(queueName string) int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if q := b.queues[queueName]; q != nil {
+		return len(q.messages)
+	}
+	return 0
+}
+
+// Expire dead-letters every message that is waiting for a TTL, as if the TTL
+// had passed. It returns the number of expired messages. It makes tests of the
+// retry ladder fast.
+func (b *Broker) Expire() int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	type expired struct {
+		q *queue
+		m *message
+	}
+	var all []expired
+	for _, q := range b.queues {
+		for _, m := range q.messages {
+			if m.expiry != nil {
+				all = append(all, expired{q, m})
+			}
+		}
+	}
+
+	for _, e := range all {
+		b.expire(e.q, e.m)
+	}
+	return len(all)
+}
+
+func newError(code int, format string, args ...interface{}) *amqp.Error {
+	return &amqp.Error{Code: code, Reason: fmt.Sprintf(format, args...), Server: true}
+}
+
+// route finds the queues that a message published on the exchange with the
+// routing key and headers goes to.
+func (b *Broker) route(exchangeName, routingKey string, headers amqp.Table) ([]*queue, *amqp.Error) {
+	if exchangeName == "" {
+		if q := b.queues[routingKey]; q != nil {
+			return []*queue{q}, nil
+		}
+		return nil, nil
+	}
+
+	ex := b.exchanges[exchangeName]
+	if ex == nil {
+		return nil, newError(amqp.NotFound, "NOT_FOUND - no exchange '%s' in vhost '/'", exchangeName)
+	}
+
+	var queues []*queue
+	seen := make(map[string]bool)
+	for _, bind := range ex.bindings {
+		var match bool
+		switch ex.kind {
+		case "direct":
+			match = bind.key == routingKey
+		case "fanout":
+			match = true
+		case "topic":
+			match = topicMatch(bind.key, routingKey)
+		case "headers":
+			match = headersMatch(bind.args, headers)
+		}
+
+		if match && !seen[bind.queue] {
+			seen[bind.queue] = true
+			if q := b.queues[bind.queue]; q != nil {
+				queues = append(queues, q)
+			}
+		}
+	}
+	return queues, nil
+}
+
+// topicMatch reports whether a topic exchange routes the key to a binding
+// with the pattern. A * matches one word, a # zero or more words.
+func topicMatch(pattern, key string) bool {
+	return matchWords(strings.Split(pattern, "."), strings.Split(key, "."))
+}
+
+// headersMatch reports whether a headers exchange routes a message with the
+// headers to a binding with the arguments. x-match decides whether all or any
+// of the arguments must be in the headers.
+func headersMatch(args, headers amqp.Table) bool {
+	matched, expected := 0, 0
+	for k, v := range args {
+		if strings.HasPrefix(k, "x-") {
+			continue
+		}
+		expected++
+		if h, ok := headers[k]; ok && equivalent(amqp.Table{k: h}, amqp.Table{k: v}) {
+			matched++
+		}
+	}
+
+	if args["x-match"] == "any" {
+		return matched > 0
+	}
+	return matched == expected
+}
+
+func matchWords(pattern, key []string) bool {
+	if len(pattern) == 0 {
+		return len(key) == 0
+	}
+
+	switch pattern[0] {
+	case "#":
+		for i := 0; i <= len(key); i++ {
+			if matchWords(pattern[1:], key[i:]) {
+				return true
+			}
+		}
+		return false
+	case "*":
+		return len(key) > 0 && matchWords(pattern[1:], key[1:])
+	}
+	return len(key) > 0 && pattern[0] == key[0] && matchWords(pattern[1:], key[1:])
+}
+
+// enqueue puts a copy of the message in each of the queues.
+func (b *Broker) enqueue(queues []*queue, exchangeName, routingKey string, publishing amqp.Publishing) {
+	for _, q := range queues {
+		m := &message{
+			exchange:   exchangeName,
+			routingKey: routingKey,
+			publishing: copyPublishing(publishing),
+		}
+
+		if ttl, ok := q.ttl(m); ok {
+			m.expiry = time.AfterFunc(ttl, func(q *queue, m *message) func() {
+				return func() {
+					b.mu.Lock()
+					defer b.mu.Unlock()
+					b.expire(q, m)
+				}
+			}(q, m))
+		}
+
+		q.messages = append(q.messages, m)
+		b.dispatch(q)
+	}
+}
+
+// expire removes the message from the queue, if it is still there, and
+// dead-letters it.
+func (b *Broker) expire(q *queue, m *message) {
+	for i, queued := range q.messages {
+		if queued == m {
+			q.messages = append(q.messages[:i], q.messages[i+1:]...)
+			b.deadLetter(q, m)
+			return
+		}
+	}
+}
+
+// deadLetter publishes the message on the dead letter exchange of the queue,
+// or drops it if the queue has none.
+func (b *Broker) deadLetter(q *queue, m *message) {
+	if m.expiry != nil {
+		m.expiry.Stop()
+		m.expiry = nil
+	}
+
+	exchangeName, ok := q.args["x-dead-letter-exchange"].(string)
+	if !ok {
+		return
+	}
+	routingKey, ok := q.args["x-dead-letter-routing-key"].(string)
+	if !ok {
+		routingKey = m.routingKey
+	}
+
+	queues, err := b.route(exchangeName, routingKey, m.publishing.Headers)
+	if err != nil {
+		return
+	}
+
+	publishing := m.publishing
+	publishing.Expiration = ""
+	b.enqueue(queues, exchangeName, routingKey, publishing)
+}
+
+// dispatch delivers the messages in the queue to its consumers, as long as
+// their prefetch allows it.
+func (b *Broker) dispatch(q *queue) {
+	for len(q.messages) > 0 {
+		cons := q.nextConsumer()
+		if cons == nil {
+			return
+		}
+
+		m := q.messages[0]
+		q.messages = q.messages[1:]
+		if m.expiry != nil {
+			m.expiry.Stop()
+			m.expiry = nil
+		}
+
+		cons.push(cons.ch.deliver(q, m, cons, 0))
+	}
+}
+
+// requeue puts unacked messages back at the front of their queue.
+func (b *Broker) requeue(q *queue, msgs []*message) {
+	for _, m := range msgs {
+		m.redelivered = true
+	}
+	q.messages = append(append([]*message(nil), msgs...), q.messages...)
+	b.dispatch(q)
+}
+
+// deleteQueue removes the queue and its bindings. It returns the consumers
+// that must be cancelled.
+func (b *Broker) deleteQueue(q *queue) []*consumer {
+	delete(b.queues, q.name)
+	for _, ex := range b.exchanges {
+		bindings := ex.bindings[:0]
+		for _, bind := range ex.bindings {
+			if bind.queue != q.name {
+				bindings = append(bindings, bind)
+			}
+		}
+		ex.bindings = bindings
+	}
+	for _, m := range q.messages {
+		if m.expiry != nil {
+			m.expiry.Stop()
+		}
+	}
+
+	consumers := q.consumers
+	for _, cons := range consumers {
+		delete(cons.ch.consumers, cons.tag)
+	}
+	q.consumers = nil
+	return consumers
+}
+
+// ttl returns how long the message may stay in the queue.
+func (q *queue) ttl(m *message) (time.Duration, bool) {
+	ttl, ok := tableInt(q.args, "x-message-ttl")
+	if ms, err := strconv.ParseInt(m.publishing.Expiration, 10, 64); err == nil && (!ok || ms < ttl) {
+		ttl, ok = ms, true
+	}
+	return time.Duration(ttl) * time.Millisecond, ok
+}
+
+// nextConsumer picks the next consumer, round robin, that can take another
+// message.
+func (q *queue) nextConsumer() *consumer {
+	for i := 0; i < len(q.consumers); i++ {
+		cons := q.consumers[(q.next+i)%len(q.consumers)]
+		if cons.prefetch == 0 || cons.unacked < cons.prefetch {
+			q.next = (q.next + i + 1) % len(q.consumers)
+			return cons
+		}
+	}
+	return nil
+}
+
+func (q *queue) removeConsumer(cons *consumer) {
+	for i, c := range q.consumers {
+		if c == cons {
+			q.consumers = append(q.consumers[:i], q.consumers[i+1:]...)
+			return
+		}
+	}
+}
+
+func (q *queue) info() amqp.Queue {
+	return amqp.Queue{Name: q.name, Messages: len(q.messages), Consumers: len(q.consumers)}
+}
+
+func tableInt(table amqp.Table, key string) (int64, bool) {
+	switch v := table[key].(type) {
+	case int:
+		return int64(v), true
+	case int8:
+		return int64(v), true
+	case int16:
+		return int64(v), true
+	case int32:
+		return int64(v), true
+	case int64:
+		return v, true
+	case uint8:
+		return int64(v), true
+	case uint16:
+		return int64(v), true
+	case uint32:
+		return int64(v), true
+	}
+	return 0, false
+}
+
+// equivalent compares declaration arguments like the broker does, ignoring
+// the size of integers.
+func equivalent(a, b amqp.Table) bool {
+	normalize := func(table amqp.Table) map[string]interface{} {
+		m := make(map[string]interface{}, len(table))
+		for k, v := range table {
+			if i, ok := tableInt(table, k); ok {
+				m[k] = i
+			} else {
+				m[k] = v
+			}
+		}
+		return m
+	}
+	return reflect.DeepEqual(normalize(a), normalize(b))
+}
+
+func copyTable(table amqp.Table) amqp.Table {
+	if table == nil {
+		return nil
+	}
+	c := make(amqp.Table, len(table))
+	for k, v := range table {
+		c[k] = v
+	}
+	return c
+}
+
+func copyPublishing(p amqp.Publishing) amqp.Publishing {
+	p.Headers = copyTable(p.Headers)
+	p.Body = append([]byte(nil), p.Body...)
+	return p
+}
@@ -0,0 +1,243 @@
+package amqptest
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/streadway/amqp"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTopicMatch(t *testing.T) {
+	tests := []struct {
+		pattern string
+		key     string
+		match   bool
+	}{
+		{"a.b", "a.b", true},
+		{"a.b", "a.c", false},
+		{"a.*", "a.b", true},
+		{"a.*", "a.b.c", false},
+		{"a.#", "a", true},
+		{"a.#", "a.b.c", true},
+		{"#", "a.b", true},
+		{"#.c", "a.b.c", true},
+		{"*.b.#", "a.b", true},
+		{"*.b.#", "b", false},
+	}
+
+	for _, test := range tests {
+		assert.Equal(t, test.match, topicMatch(test.pattern, test.key), fmt.Sprintf("%s %s", test.pattern, test.key))
+	}
+}
+
+func openChannel(t *testing.T, b *Broker) *channel {
+	conn, err := b.Dial("")
+	require.NoError(t, err)
+	ch, err := conn.Channel()
+	require.NoError(t, err)
+	return ch.(*channel)
+}
+
+func TestRouting(t *testing.T) {
+	b := NewBroker()
+	ch := openChannel(t, b)
+
+	require.NoError(t, ch.ExchangeDeclare("test", "topic", true, false, false, false, nil))
+	_, err := ch.QueueDeclare("test.a", true, false, false, false, nil)
+	require.NoError(t, err)
+	_, err = ch.QueueDeclare("test.b", true, false, false, false, nil)
+	require.NoError(t, err)
+	require.NoError(t, ch.QueueBind("test.a", "a.#", "test", false, nil))
+	require.NoError(t, ch.QueueBind("test.b", "*.b", "test", false, nil))
+
+	require.NoError(t, ch.Publish("test", "a.b", false, false, amqp.Publishing{Body: []byte("1")}))
+	require.NoError(t, ch.Publish("test", "a.c", false, false, amqp.Publishing{Body: []byte("2")}))
+	require.NoError(t, ch.Publish("test", "c.b", false, false, amqp.Publishing{Body: []byte("3")}))
+	require.NoError(t, ch.Publish("", "test.a", false, false, amqp.Publishing{Body: []byte("4")}))
+
+	assert.Equal(t, 3, b.QueueLength("test.a"))
+	assert.Equal(t, 2, b.QueueLength("test.b"))
+	assert.Len(t, b.Published(), 4)
+	assert.Len(t, b.PublishedTo("test", "a.b"), 1)
+
+	// Publishing on a missing exchange closes the channel.
+	closes := ch.NotifyClose(make(chan *amqp.Error, 1))
+	require.NoError(t, ch.Publish("missing", "a", false, false, amqp.Publishing{}))
+	err = <-closes
+	require.NotNil(t, err)
+	assert.Equal(t, amqp.NotFound, err.(*amqp.Error).Code)
+	assert.Equal(t, amqp.ErrClosed, ch.Publish("test", "a.b", false, false, amqp.Publishing{}))
+}
+
+func TestHeadersRouting(t *testing.T) {
+	b := NewBroker()
+	ch := openChannel(t, b)
+
+	require.NoError(t, ch.ExchangeDeclare("test", "headers", true, false, false, false, nil))
+	_, err := ch.QueueDeclare("test.all", true, false, false, false, nil)
+	require.NoError(t, err)
+	_, err = ch.QueueDeclare("test.any", true, false, false, false, nil)
+	require.NoError(t, err)
+	require.NoError(t, ch.QueueBind("test.all", "", "test", false, amqp.Table{"a": "1", "b": int32(2)}))
+	require.NoError(t, ch.QueueBind("test.any", "", "test", false, amqp.Table{"x-match": "any", "a": "1", "b": int32(2)}))
+
+	require.NoError(t, ch.Publish("test", "", false, false, amqp.Publishing{Headers: amqp.Table{"a": "1", "b": int64(2)}}))
+	require.NoError(t, ch.Publish("test", "", false, false, amqp.Publishing{Headers: amqp.Table{"a": "1"}}))
+	require.NoError(t, ch.Publish("test", "", false, false, amqp.Publishing{Headers: amqp.Table{"a": "2"}}))
+
+	assert.Equal(t, 1, b.QueueLength("test.all"))
+	assert.Equal(t, 2, b.QueueLength("test.any"))
+}
+
+func TestConsume(t *testing.T) {
+	b := NewBroker()
+	ch := openChannel(t, b)
+
+	_, err := ch.QueueDeclare("test", true, false, false, false, nil)
+	require.NoError(t, err)
+	for i := 0; i < 3; i++ {
+		require.NoError(t, ch.Publish("", "test", false, false, amqp.Publishing{Body: []byte{byte(i)}}))
+	}
+
+	require.NoError(t, ch.Qos(2, 0, false))
+	msgs, err := ch.Consume("test", "ctag", false, false, false, false, nil)
+	require.NoError(t, err)
+
+	// Only two messages are delivered until one is acked.
+	first, second := <-msgs, <-msgs
+	assert.Equal(t, []byte{0}, first.Body)
+	assert.Equal(t, []byte{1}, second.Body)
+	assert.Equal(t, 1, b.QueueLength("test"))
+
+	require.NoError(t, first.Ack(false))
+	third := <-msgs
+	assert.Equal(t, []byte{2}, third.Body)
+
+	// Requeued messages are delivered again.
+	require.NoError(t, second.Nack(false, true))
+	again := <-msgs
+	assert.Equal(t, []byte{1}, again.Body)
+	assert.True(t, again.Redelivered)
+
+	// Unacked messages go back to the queue when the consumer's channel
+	// closes, and the deliveries are closed.
+	require.NoError(t, ch.Close())
+	_, ok := <-msgs
+	assert.False(t, ok)
+	assert.Equal(t, 2, b.QueueLength("test"))
+}
+
+func TestCancel(t *testing.T) {
+	b := NewBroker()
+	ch := openChannel(t, b)
+
+	_, err := ch.QueueDeclare("test", true, false, false, false, nil)
+	require.NoError(t, err)
+	require.NoError(t, ch.Publish("", "test", false, false, amqp.Publishing{}))
+
+	msgs, err := ch.Consume("test", "ctag", false, false, false, false, nil)
+	require.NoError(t, err)
+	require.NoError(t, ch.Cancel("ctag", false))
+
+	// Deliveries that were already sent are still consumed.
+	d, ok := <-msgs
+	require.True(t, ok)
+	require.NoError(t, d.Ack(false))
+	_, ok = <-msgs
+	assert.False(t, ok)
+}
+
+func TestDeadLetter(t *testing.T) {
+	b := NewBroker()
+	ch := openChannel(t, b)
+
+	_, err := ch.QueueDeclare("ready", true, false, false, false, nil)
+	require.NoError(t, err)
+	_, err = ch.QueueDeclare("waiting", true, false, false, false, amqp.Table{
+		"x-dead-letter-exchange":    "",
+		"x-dead-letter-routing-key": "ready",
+		"x-message-ttl":             int32(10),
+	})
+	require.NoError(t, err)
+
+	// Declaring it again with different arguments fails.
+	_, err = openChannel(t, b).QueueDeclare("waiting", true, false, false, false, nil)
+	assert.Error(t, err)
+
+	// Expire does not wait for the TTL.
+	require.NoError(t, ch.Publish("", "waiting", false, false, amqp.Publishing{Body: []byte("1")}))
+	assert.Equal(t, 1, b.Expire())
+	assert.Equal(t, 0, b.QueueLength("waiting"))
+
+	require.NoError(t, ch.Publish("", "waiting", false, false, amqp.Publishing{Body: []byte("2")}))
+	assert.Equal(t, 1, b.QueueLength("waiting"))
+	time.Sleep(50 * time.Millisecond)
+	assert.Equal(t, 0, b.QueueLength("waiting"))
+
+	d, ok, err := ch.Get("ready", false)
+	require.NoError(t, err)
+	require.True(t, ok)
+	assert.Equal(t, []byte("1"), d.Body)
+	assert.Equal(t, "ready", d.RoutingKey)
+	assert.Equal(t, uint32(1), d.MessageCount)
+	require.NoError(t, d.Ack(false))
+
+	// Acking twice is an error that closes the channel.
+	assert.Error(t, d.Ack(false))
+	assert.Equal(t, amqp.ErrClosed, d.Ack(false))
+}
+
+type recorder struct {
+	errors []string
+}
+
+func (r *recorder) Errorf(format string, args ...interface{}) {
+	r.errors = append(r.errors, fmt.Sprintf(format, args...))
+}
+
+func TestExpectPublished(t *testing.T) {
+	b := NewBroker()
+	b.Timeout = 50 * time.Millisecond
+	ch := openChannel(t, b)
+
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		ch.Publish("", "test", false, false, amqp.Publishing{Body: []byte("1")})
+	}()
+
+	r := new(recorder)
+	msg := b.ExpectPublished(r, "", "test")
+	assert.Empty(t, r.errors)
+	assert.Equal(t, []byte("1"), msg.Body)
+
+	b.ExpectPublished(r, "", "other")
+	assert.Len(t, r.errors, 1)
+
+	b.Reset()
+	assert.Empty(t, b.Published())
+}
+
+func TestDisconnect(t *testing.T) {
+	b := NewBroker()
+	conn, err := b.Dial("")
+	require.NoError(t, err)
+	closes := conn.NotifyClose(make(chan *amqp.Error, 1))
+
+	ch, err := conn.Channel()
+	require.NoError(t, err)
+	_, err = ch.QueueDeclare("", false, false, true, false, nil)
+	require.NoError(t, err)
+
+	b.Disconnect()
+	err = <-closes
+	require.NotNil(t, err)
+	assert.Equal(t, amqp.ConnectionForced, err.(*amqp.Error).Code)
+
+	// The exclusive queue is gone with the connection.
+	b.mu.Lock()
+	assert.Empty(t, b.queues)
+	b.mu.Unlock()
+}
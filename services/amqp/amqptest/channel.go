@@ -0,0 +1,791 @@
+package amqptest
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+
+	amqputil "github.com/getconversio/go-utils/services/amqp"
+	"github.com/streadway/amqp"
+)
+
+type connection struct {
+	broker *Broker
+
+	// Guarded by the broker's mutex.
+	closed   bool
+	channels map[*channel]bool
+	closes   []chan *amqp.Error
+	blocks   []chan amqp.Blocking
+}
+
+func (conn *connection) Channel() (amqputil.Channel, error) {
+	b := conn.broker
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if conn.closed {
+		return nil, amqp.ErrClosed
+	}
+
+	ch := &channel{
+		broker:    b,
+		conn:      conn,
+		unacked:   make(map[uint64]*unacked),
+		consumers: make(map[string]*consumer),
+	}
+	conn.channels[ch] = true
+	return ch, nil
+}
+
+func (conn *connection) NotifyClose(receiver chan *amqp.Error) chan *amqp.Error {
+	conn.broker.mu.Lock()
+	defer conn.broker.mu.Unlock()
+
+	if conn.closed {
+		close(receiver)
+	} else {
+		conn.closes = append(conn.closes, receiver)
+	}
+	return receiver
+}
+
+func (conn *connection) NotifyBlocked(receiver chan amqp.Blocking) chan amqp.Blocking {
+	conn.broker.mu.Lock()
+	defer conn.broker.mu.Unlock()
+
+	if conn.closed {
+		close(receiver)
+	} else {
+		conn.blocks = append(conn.blocks, receiver)
+	}
+	return receiver
+}
+
+func (conn *connection) Close() error {
+	if !conn.shutdown(nil) {
+		return amqp.ErrClosed
+	}
+	return nil
+}
+
+// shutdown closes the connection and its channels. A nil error means that it
+// was closed on purpose. It returns false if it was already closed.
+func (conn *connection) shutdown(err *amqp.Error) bool {
+	b := conn.broker
+	b.mu.Lock()
+	if conn.closed {
+		b.mu.Unlock()
+		return false
+	}
+	conn.closed = true
+	delete(b.conns, conn)
+
+	channels := make([]*channel, 0, len(conn.channels))
+	for ch := range conn.channels {
+		channels = append(channels, ch)
+	}
+	closes := conn.closes
+	conn.closes = nil
+	for _, receiver := range conn.blocks {
+		close(receiver)
+	}
+	conn.blocks = nil
+	b.mu.Unlock()
+
+	for _, receiver := range closes {
+		if err != nil {
+			receiver <- err
+		}
+		close(receiver)
+	}
+	for _, ch := range channels {
+		ch.shutdown(err)
+	}
+
+	// Exclusive queues go away with their connection.
+	b.mu.Lock()
+	var cancelled []*consumer
+	for _, q := range b.queues {
+		if q.owner == conn {
+			cancelled = append(cancelled, b.deleteQueue(q)...)
+		}
+	}
+	b.mu.Unlock()
+
+	for _, cons := range cancelled {
+		cons.cancel()
+	}
+	return true
+}
+
+type unacked struct {
+	q    *queue
+	m    *message
+	cons *consumer
+}
+
+type channel struct {
+	broker *Broker
+	conn   *connection
+
+	// Held while publishing, so confirmations are sent in order.
+	publishMu sync.Mutex
+
+	// Guarded by the broker's mutex.
+	closed      bool
+	prefetch    int
+	confirm     bool
+	publishSeq  uint64
+	deliveryTag uint64
+	unacked     map[uint64]*unacked
+	consumers   map[string]*consumer
+	closes      []chan *amqp.Error
+	confirms    []chan amqp.Confirmation
+}
+
+// call runs f with the broker locked. Like on RabbitMQ, an error closes the
+// channel.
+func (ch *channel) call(f func() *amqp.Error) error {
+	ch.broker.mu.Lock()
+	if ch.closed {
+		ch.broker.mu.Unlock()
+		return amqp.ErrClosed
+	}
+	err := f()
+	ch.broker.mu.Unlock()
+
+	if err != nil {
+		ch.shutdown(err)
+		return err
+	}
+	return nil
+}
+
+// queue returns the queue with the given name, or a NOT_FOUND error.
+func (ch *channel) queue(name string) (*queue, *amqp.Error) {
+	q := ch.broker.queues[name]
+	if q == nil {
+		return nil, newError(amqp.NotFound, "NOT_FOUND - no queue '%s' in vhost '/'", name)
+	}
+	return q, nil
+}
+
+// deliver builds a delivery of the message and tracks it until it is acked.
+func (ch *channel) deliver(q *queue, m *message, cons *consumer, messageCount int) amqp.Delivery {
+	ch.deliveryTag++
+	p := m.publishing
+
+	autoAck := true
+	ctag := ""
+	if cons != nil {
+		autoAck = cons.autoAck
+		ctag = cons.tag
+	}
+	if cons == nil || !autoAck {
+		ch.unacked[ch.deliveryTag] = &unacked{q: q, m: m, cons: cons}
+		if cons != nil {
+			cons.unacked++
+		}
+	}
+
+	return amqp.Delivery{
+		Acknowledger:    ch,
+		Headers:         copyTable(p.Headers),
+		ContentType:     p.ContentType,
+		ContentEncoding: p.ContentEncoding,
+		DeliveryMode:    p.DeliveryMode,
+		Priority:        p.Priority,
+		CorrelationId:   p.CorrelationId,
+		ReplyTo:         p.ReplyTo,
+		Expiration:      p.Expiration,
+		MessageId:       p.MessageId,
+		Timestamp:       p.Timestamp,
+		Type:            p.Type,
+		UserId:          p.UserId,
+		AppId:           p.AppId,
+		ConsumerTag:     ctag,
+		MessageCount:    uint32(messageCount),
+		DeliveryTag:     ch.deliveryTag,
+		Redelivered:     m.redelivered,
+		Exchange:        m.exchange,
+		RoutingKey:      m.routingKey,
+		Body:            append([]byte(nil), p.Body...),
+	}
+}
+
+func (ch *channel) Qos(prefetchCount, prefetchSize int, global bool) error {
+	return ch.call(func() *amqp.Error {
+		ch.prefetch = prefetchCount
+		return nil
+	})
+}
+
+func (ch *channel) Confirm(noWait bool) error {
+	return ch.call(func() *amqp.Error {
+		ch.confirm = true
+		return nil
+	})
+}
+
+func (ch *channel) NotifyPublish(confirm chan amqp.Confirmation) chan amqp.Confirmation {
+	ch.broker.mu.Lock()
+	defer ch.broker.mu.Unlock()
+
+	if ch.closed {
+		close(confirm)
+	} else {
+		ch.confirms = append(ch.confirms, confirm)
+	}
+	return confirm
+}
+
+func (ch *channel) NotifyClose(receiver chan *amqp.Error) chan *amqp.Error {
+	ch.broker.mu.Lock()
+	defer ch.broker.mu.Unlock()
+
+	if ch.closed {
+		close(receiver)
+	} else {
+		ch.closes = append(ch.closes, receiver)
+	}
+	return receiver
+}
+
+func (ch *channel) ExchangeDeclare(name, kind string, durable, autoDelete, internal, noWait bool, args amqp.Table) error {
+	return ch.call(func() *amqp.Error {
+		if name == "" || (len(name) > 4 && name[:4] == "amq.") {
+			return newError(amqp.AccessRefused, "ACCESS_REFUSED - exchange name '%s' contains reserved prefix 'amq.*'", name)
+		}
+
+		switch kind {
+		case "direct", "fanout", "topic", "headers":
+		default:
+			return newError(amqp.NotImplemented, "NOT_IMPLEMENTED - amqptest does not support exchange type '%s'", kind)
+		}
+
+		if ex := ch.broker.exchanges[name]; ex != nil {
+			if ex.kind != kind || ex.durable != durable || !equivalent(ex.args, args) {
+				return newError(amqp.PreconditionFailed, "PRECONDITION_FAILED - inequivalent arg for exchange '%s' in vhost '/'", name)
+			}
+			return nil
+		}
+
+		ch.broker.exchanges[name] = &exchange{name: name, kind: kind, durable: durable, args: copyTable(args)}
+		return nil
+	})
+}
+
+func (ch *channel) ExchangeDeclarePassive(name, kind string, durable, autoDelete, internal, noWait bool, args amqp.Table) error {
+	return ch.call(func() *amqp.Error {
+		if ch.broker.exchanges[name] == nil {
+			return newError(amqp.NotFound, "NOT_FOUND - no exchange '%s' in vhost '/'", name)
+		}
+		return nil
+	})
+}
+
+func (ch *channel) ExchangeDelete(name string, ifUnused, noWait bool) error {
+	return ch.call(func() *amqp.Error {
+		delete(ch.broker.exchanges, name)
+		return nil
+	})
+}
+
+func (ch *channel) QueueDeclare(name string, durable, autoDelete, exclusive, noWait bool, args amqp.Table) (amqp.Queue, error) {
+	var info amqp.Queue
+	err := ch.call(func() *amqp.Error {
+		b := ch.broker
+		if name == "" {
+			b.seq++
+			name = fmt.Sprintf("amq.gen-%d", b.seq)
+		}
+
+		if q := b.queues[name]; q != nil {
+			if q.owner != nil && q.owner != ch.conn {
+				return newError(amqp.ResourceLocked, "RESOURCE_LOCKED - cannot obtain exclusive access to locked queue '%s' in vhost '/'", name)
+			}
+			if q.durable != durable || !equivalent(q.args, args) {
+				return newError(amqp.PreconditionFailed, "PRECONDITION_FAILED - inequivalent arg for queue '%s' in vhost '/'", name)
+			}
+			info = q.info()
+			return nil
+		}
+
+		q := &queue{name: name, durable: durable, autoDelete: autoDelete, args: copyTable(args)}
+		if exclusive {
+			q.owner = ch.conn
+		}
+		b.queues[name] = q
+		info = q.info()
+		return nil
+	})
+	return info, err
+}
+
+func (ch *channel) QueueDeclarePassive(name string, durable, autoDelete, exclusive, noWait bool, args amqp.Table) (amqp.Queue, error) {
+	return ch.QueueInspect(name)
+}
+
+func (ch *channel) QueueInspect(name string) (amqp.Queue, error) {
+	var info amqp.Queue
+	err := ch.call(func() *amqp.Error {
+		q, err := ch.queue(name)
+		if err != nil {
+			return err
+		}
+		info = q.info()
+		return nil
+	})
+	return info, err
+}
+
+func (ch *channel) QueueBind(name, key, exchangeName string, noWait bool, args amqp.Table) error {
+	return ch.call(func() *amqp.Error {
+		if _, err := ch.queue(name); err != nil {
+			return err
+		}
+
+		ex := ch.broker.exchanges[exchangeName]
+		if exchangeName == "" {
+			return newError(amqp.AccessRefused, "ACCESS_REFUSED - operation not permitted on the default exchange")
+		}
+		if ex == nil {
+			return newError(amqp.NotFound, "NOT_FOUND - no exchange '%s' in vhost '/'", exchangeName)
+		}
+
+		for _, bind := range ex.bindings {
+			if bind.queue == name && bind.key == key && equivalent(bind.args, args) {
+				return nil
+			}
+		}
+		ex.bindings = append(ex.bindings, binding{queue: name, key: key, args: copyTable(args)})
+		return nil
+	})
+}
+
+func (ch *channel) QueuePurge(name string, noWait bool) (int, error) {
+	var count int
+	err := ch.call(func() *amqp.Error {
+		q, err := ch.queue(name)
+		if err != nil {
+			return err
+		}
+
+		count = len(q.messages)
+		for _, m := range q.messages {
+			if m.expiry != nil {
+				m.expiry.Stop()
+			}
+		}
+		q.messages = nil
+		return nil
+	})
+	return count, err
+}
+
+func (ch *channel) QueueDelete(name string, ifUnused, ifEmpty, noWait bool) (int, error) {
+	var count int
+	var cancelled []*consumer
+	err := ch.call(func() *amqp.Error {
+		q := ch.broker.queues[name]
+		if q == nil {
+			return nil
+		}
+		if ifUnused && len(q.consumers) > 0 {
+			return newError(amqp.PreconditionFailed, "PRECONDITION_FAILED - queue '%s' in vhost '/' in use", name)
+		}
+		if ifEmpty && len(q.messages) > 0 {
+			return newError(amqp.PreconditionFailed, "PRECONDITION_FAILED - queue '%s' in vhost '/' not empty", name)
+		}
+
+		count = len(q.messages)
+		cancelled = ch.broker.deleteQueue(q)
+		return nil
+	})
+
+	for _, cons := range cancelled {
+		cons.cancel()
+	}
+	return count, err
+}
+
+func (ch *channel) Publish(exchangeName, key string, mandatory, immediate bool, msg amqp.Publishing) error {
+	ch.publishMu.Lock()
+	defer ch.publishMu.Unlock()
+
+	b := ch.broker
+	b.mu.Lock()
+	if ch.closed {
+		b.mu.Unlock()
+		return amqp.ErrClosed
+	}
+
+	b.published = append(b.published, Message{
+		Exchange:   exchangeName,
+		RoutingKey: key,
+		Publishing: copyPublishing(msg),
+	})
+	close(b.publishedSignal)
+	b.publishedSignal = make(chan struct{})
+
+	queues, err := b.route(exchangeName, key, msg.Headers)
+	if err != nil {
+		b.mu.Unlock()
+
+		// Publishing is asynchronous, the error only closes the channel.
+		go ch.shutdown(err)
+		return nil
+	}
+	b.enqueue(queues, exchangeName, key, msg)
+
+	var tag uint64
+	var confirms []chan amqp.Confirmation
+	if ch.confirm {
+		ch.publishSeq++
+		tag = ch.publishSeq
+		confirms = ch.confirms
+	}
+	b.mu.Unlock()
+
+	for _, confirm := range confirms {
+		confirm <- amqp.Confirmation{DeliveryTag: tag, Ack: true}
+	}
+	return nil
+}
+
+func (ch *channel) Consume(queueName, ctag string, autoAck, exclusive, noLocal, noWait bool, args amqp.Table) (<-chan amqp.Delivery, error) {
+	var cons *consumer
+	err := ch.call(func() *amqp.Error {
+		b := ch.broker
+		q, err := ch.queue(queueName)
+		if err != nil {
+			return err
+		}
+
+		if ctag == "" {
+			b.seq++
+			ctag = fmt.Sprintf("amq.ctag-%d", b.seq)
+		}
+		if ch.consumers[ctag] != nil {
+			return newError(amqp.NotAllowed, "NOT_ALLOWED - attempt to reuse consumer tag '%s'", ctag)
+		}
+
+		cons = newConsumer(ch, q, ctag, autoAck)
+		ch.consumers[ctag] = cons
+		q.consumers = append(q.consumers, cons)
+		b.dispatch(q)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return cons.out, nil
+}
+
+func (ch *channel) Cancel(ctag string, noWait bool) error {
+	var cons *consumer
+	err := ch.call(func() *amqp.Error {
+		cons = ch.consumers[ctag]
+		if cons != nil {
+			ch.removeConsumer(cons)
+		}
+		return nil
+	})
+
+	if cons != nil {
+		cons.cancel()
+	}
+	return err
+}
+
+// removeConsumer stops delivering to the consumer. The messages it has not
+// acked yet stay unacked.
+func (ch *channel) removeConsumer(cons *consumer) {
+	delete(ch.consumers, cons.tag)
+	cons.q.removeConsumer(cons)
+
+	if cons.q.autoDelete && len(cons.q.consumers) == 0 && ch.broker.queues[cons.q.name] == cons.q {
+		ch.broker.deleteQueue(cons.q)
+	}
+}
+
+func (ch *channel) Get(queueName string, autoAck bool) (amqp.Delivery, bool, error) {
+	var d amqp.Delivery
+	var ok bool
+	err := ch.call(func() *amqp.Error {
+		q, err := ch.queue(queueName)
+		if err != nil {
+			return err
+		}
+		if len(q.messages) == 0 {
+			return nil
+		}
+
+		m := q.messages[0]
+		q.messages = q.messages[1:]
+		if m.expiry != nil {
+			m.expiry.Stop()
+			m.expiry = nil
+		}
+
+		d = ch.deliver(q, m, nil, len(q.messages))
+		if autoAck {
+			delete(ch.unacked, d.DeliveryTag)
+		}
+		ok = true
+		return nil
+	})
+	return d, ok, err
+}
+
+func (ch *channel) Close() error {
+	if !ch.shutdown(nil) {
+		return amqp.ErrClosed
+	}
+	return nil
+}
+
+// shutdown closes the channel and requeues the messages it has not acked. A
+// nil error means that it was closed on purpose. It returns false if it was
+// already closed.
+func (ch *channel) shutdown(err *amqp.Error) bool {
+	b := ch.broker
+	b.mu.Lock()
+	if ch.closed {
+		b.mu.Unlock()
+		return false
+	}
+	ch.closed = true
+	delete(ch.conn.channels, ch)
+
+	consumers := make([]*consumer, 0, len(ch.consumers))
+	for _, cons := range ch.consumers {
+		consumers = append(consumers, cons)
+		ch.removeConsumer(cons)
+	}
+	ch.requeue(ch.unackedUpTo(^uint64(0)))
+
+	closes, confirms := ch.closes, ch.confirms
+	ch.closes, ch.confirms = nil, nil
+	b.mu.Unlock()
+
+	// Like amqp, report the error before closing the deliveries.
+	for _, receiver := range closes {
+		if err != nil {
+			receiver <- err
+		}
+		close(receiver)
+	}
+	for _, cons := range consumers {
+		cons.abort()
+	}
+
+	// Publish may still be sending a confirmation.
+	ch.publishMu.Lock()
+	for _, confirm := range confirms {
+		close(confirm)
+	}
+	ch.publishMu.Unlock()
+	return true
+}
+
+// unackedUpTo removes and returns the unacked deliveries up to the tag, in
+// order.
+func (ch *channel) unackedUpTo(tag uint64) []*unacked {
+	var tags []uint64
+	for t := range ch.unacked {
+		if t <= tag {
+			tags = append(tags, t)
+		}
+	}
+	sort.Slice(tags, func(i, j int) bool { return tags[i] < tags[j] })
+
+	pending := make([]*unacked, 0, len(tags))
+	for _, t := range tags {
+		pending = append(pending, ch.unacked[t])
+		delete(ch.unacked, t)
+	}
+	return pending
+}
+
+// settle removes the deliveries from the unacked ones. Without multiple, the
+// tag must be unacked.
+func (ch *channel) settle(tag uint64, multiple bool) ([]*unacked, *amqp.Error) {
+	if multiple {
+		return ch.unackedUpTo(tag), nil
+	}
+
+	u := ch.unacked[tag]
+	if u == nil {
+		return nil, newError(amqp.PreconditionFailed, "PRECONDITION_FAILED - unknown delivery tag %d", tag)
+	}
+	delete(ch.unacked, tag)
+	return []*unacked{u}, nil
+}
+
+// release lets the consumers of the deliveries take more messages.
+func (ch *channel) release(pending []*unacked) {
+	for _, u := range pending {
+		if u.cons != nil {
+			u.cons.unacked--
+		}
+	}
+	for _, u := range pending {
+		if ch.broker.queues[u.q.name] == u.q {
+			ch.broker.dispatch(u.q)
+		}
+	}
+}
+
+func (ch *channel) requeue(pending []*unacked) {
+	byQueue := make(map[*queue][]*message)
+	var queues []*queue
+	for _, u := range pending {
+		if u.cons != nil {
+			u.cons.unacked--
+		}
+		if _, ok := byQueue[u.q]; !ok {
+			queues = append(queues, u.q)
+		}
+		byQueue[u.q] = append(byQueue[u.q], u.m)
+	}
+
+	for _, q := range queues {
+		if ch.broker.queues[q.name] == q {
+			ch.broker.requeue(q, byQueue[q])
+		}
+	}
+}
+
+func (ch *channel) Ack(tag uint64, multiple bool) error {
+	return ch.call(func() *amqp.Error {
+		pending, err := ch.settle(tag, multiple)
+		if err != nil {
+			return err
+		}
+		ch.release(pending)
+		return nil
+	})
+}
+
+func (ch *channel) Nack(tag uint64, multiple bool, requeue bool) error {
+	return ch.call(func() *amqp.Error {
+		pending, err := ch.settle(tag, multiple)
+		if err != nil {
+			return err
+		}
+
+		if requeue {
+			ch.requeue(pending)
+			return nil
+		}
+
+		for _, u := range pending {
+			ch.broker.deadLetter(u.q, u.m)
+		}
+		ch.release(pending)
+		return nil
+	})
+}
+
+func (ch *channel) Reject(tag uint64, requeue bool) error {
+	return ch.Nack(tag, false, requeue)
+}
+
+// A consumer buffers its deliveries, so the broker never waits for the code
+// that consumes them.
+type consumer struct {
+	ch      *channel
+	q       *queue
+	tag     string
+	autoAck bool
+
+	// Guarded by the broker's mutex.
+	prefetch int
+	unacked  int
+
+	mu        sync.Mutex
+	cond      *sync.Cond
+	buf       []amqp.Delivery
+	cancelled bool
+	aborted   chan struct{}
+	out       chan amqp.Delivery
+}
+
+func newConsumer(ch *channel, q *queue, tag string, autoAck bool) *consumer {
+	cons := &consumer{
+		ch:       ch,
+		q:        q,
+		tag:      tag,
+		autoAck:  autoAck,
+		prefetch: ch.prefetch,
+		aborted:  make(chan struct{}),
+		out:      make(chan amqp.Delivery),
+	}
+	if autoAck {
+		cons.prefetch = 0
+	}
+	cons.cond = sync.NewCond(&cons.mu)
+
+	go cons.run()
+	return cons
+}
+
+func (cons *consumer) run() {
+	defer close(cons.out)
+
+	for {
+		cons.mu.Lock()
+		for len(cons.buf) == 0 && !cons.cancelled && !cons.isAborted() {
+			cons.cond.Wait()
+		}
+		if len(cons.buf) == 0 || cons.isAborted() {
+			cons.mu.Unlock()
+			return
+		}
+		d := cons.buf[0]
+		cons.buf = cons.buf[1:]
+		cons.mu.Unlock()
+
+		select {
+		case cons.out <- d:
+		case <-cons.aborted:
+			return
+		}
+	}
+}
+
+func (cons *consumer) isAborted() bool {
+	select {
+	case <-cons.aborted:
+		return true
+	default:
+		return false
+	}
+}
+
+func (cons *consumer) push(d amqp.Delivery) {
+	cons.mu.Lock()
+	defer cons.mu.Unlock()
+	cons.buf = append(cons.buf, d)
+	cons.cond.Signal()
+}
+
+// cancel closes the deliveries once the buffered ones are consumed.
+func (cons *consumer) cancel() {
+	cons.mu.Lock()
+	defer cons.mu.Unlock()
+	cons.cancelled = true
+	cons.cond.Signal()
+}
+
+// abort closes the deliveries right away, since the channel is gone.
+func (cons *consumer) abort() {
+	cons.mu.Lock()
+	defer cons.mu.Unlock()
+	if !cons.isAborted() {
+		close(cons.aborted)
+	}
+	cons.cond.Signal()
+}
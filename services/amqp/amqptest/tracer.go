@@ -0,0 +1,98 @@
+package amqptest
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"strings"
+	"sync"
+
+	amqputil "github.com/getconversio/go-utils/services/amqp"
+)
+
+// RecordedSpan is a span that a SpanRecorder recorded when it ended. The IDs
+// are hex encoded like in a W3C traceparent.
+type RecordedSpan struct {
+	Name       string
+	Kind       amqputil.SpanKind
+	TraceID    string
+	SpanID     string
+	ParentID   string
+	Attributes map[string]string
+	Err        error
+}
+
+// SpanRecorder is an amqp.Tracer that keeps the spans in memory, to assert on
+// them in tests. Use it as Options.Tracer. Its spans are W3C trace contexts,
+// so amqp.TraceContextPropagator passes them on from publishers to handlers.
+type SpanRecorder struct {
+	mu    sync.Mutex
+	spans []RecordedSpan
+}
+
+// NewSpanRecorder creates a recorder without spans.
+func NewSpanRecorder() *SpanRecorder {
+	return new(SpanRecorder)
+}
+
+// Start implements amqp.Tracer. The span is a child of the trace context in
+// ctx, if any.
+func (r *SpanRecorder) Start(ctx context.Context, name string, kind amqputil.SpanKind, attributes map[string]string) (context.Context, amqputil.Span) {
+	span := &recordingSpan{recorder: r, span: RecordedSpan{
+		Name:       name,
+		Kind:       kind,
+		TraceID:    randomID(16),
+		SpanID:     randomID(8),
+		Attributes: attributes,
+	}}
+
+	parent, _ := amqputil.TraceContextFrom(ctx)
+	if fields := strings.Split(parent.TraceParent, "-"); len(fields) == 4 {
+		span.span.TraceID = fields[1]
+		span.span.ParentID = fields[2]
+	}
+
+	return amqputil.WithTraceContext(ctx, amqputil.TraceContext{
+		TraceParent: fmt.Sprintf("00-%s-%s-01", span.span.TraceID, span.span.SpanID),
+		TraceState:  parent.TraceState,
+	}), span
+}
+
+// Spans returns the spans that ended, in the order they ended.
+func (r *SpanRecorder) Spans() []RecordedSpan {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]RecordedSpan(nil), r.spans...)
+}
+
+// Reset forgets the spans.
+func (r *SpanRecorder) Reset() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.spans = nil
+}
+
+type recordingSpan struct {
+	recorder *SpanRecorder
+	span     RecordedSpan
+	ended    bool
+}
+
+func (s *recordingSpan) End(err error) {
+	s.recorder.mu.Lock()
+	defer s.recorder.mu.Unlock()
+
+	if s.ended {
+		return
+	}
+	s.ended = true
+	s.span.Err = err
+	s.recorder.spans = append(s.recorder.spans, s.span)
+}
+
+func randomID(n int) string {
+	b := make([]byte, n)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
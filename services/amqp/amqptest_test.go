@@ -0,0 +1,45 @@
+package amqp_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/getconversio/go-utils/services/amqp"
+	"github.com/getconversio/go-utils/services/amqp/amqptest"
+)
+
+// Helpers of the tests against the in-memory broker of amqptest. The tests
+// themselves are next to the feature they cover, in the files ending in
+// _amqptest_test.go.
+
+type testMsg struct {
+	I int `json:"i"`
+}
+
+func (m *testMsg) NewEmpty() interface{} {
+	return new(testMsg)
+}
+
+// receive waits for a message from the handler. It expires the waiting
+// messages on the broker in the meantime, so retries don't take long.
+func receive(t *testing.T, broker *amqptest.Broker, received chan int) int {
+	timeout := time.After(2 * time.Second)
+	for {
+		select {
+		case i := <-received:
+			return i
+		case <-time.After(10 * time.Millisecond):
+			broker.Expire()
+		case <-timeout:
+			t.Fatal("waited too long for the handler")
+			return 0
+		}
+	}
+}
+
+// newBroker returns an in-memory broker and a client connected to it with
+// the given options. The caller closes the client.
+func newBroker(options *amqp.Options) (*amqptest.Broker, *amqp.Client) {
+	broker := amqptest.NewBroker()
+	return broker, broker.NewClient(options)
+}
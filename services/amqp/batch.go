@@ -0,0 +1,255 @@
+package amqp
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"runtime/debug"
+	"strings"
+	"time"
+
+	"github.com/getconversio/go-utils/util"
+	"github.com/streadway/amqp"
+)
+
+// BatchHandler handles a batch of decoded messages along with their
+// deliveries. If it returns an error, all messages of the batch are retried,
+// unless it is a *BatchError that says which of them failed. Use
+// BatchMessageContext to get the context of a single message.
+type BatchHandler func(ctx context.Context, msgs []interface{}, ds []amqp.Delivery) error
+
+type batchContextsKey struct{}
+
+// BatchMessageContext returns the context of the i'th message of the batch
+// being handled, with the values that its publisher passed on, like the trace
+// context. See Options.Propagator. Outside of a batch handler, it returns ctx.
+func BatchMessageContext(ctx context.Context, i int) context.Context {
+	contexts, _ := ctx.Value(batchContextsKey{}).([]context.Context)
+	if i < 0 || i >= len(contexts) {
+		return ctx
+	}
+	return contexts[i]
+}
+
+// BatchError is returned by a BatchHandler when only some messages of the
+// batch failed. Failed maps their index in the batch to the reason, which can
+// be Permanent, RetryAfter or Requeue like the error of a Handler. The other
+// messages are acked.
+type BatchError struct {
+	Failed map[int]error
+}
+
+func (e *BatchError) Error() string {
+	reasons := make([]string, 0, len(e.Failed))
+	for i, err := range e.Failed {
+		reasons = append(reasons, fmt.Sprintf("%d: %s", i, err))
+	}
+	return fmt.Sprintf("amqp: %d messages of the batch failed (%s)", len(e.Failed), strings.Join(reasons, ", "))
+}
+
+// HandleBatch is like HandleContext, but the handler gets up to size messages
+// at a time. A batch is handed over when it is full, or maxDelay after its
+// first message arrived.
+//
+// When the handler succeeds, the whole batch is acked at once. Messages that
+// failed are handed to the retry ladder one by one, like with HandleFunc, and
+// messages that can't be decoded are moved to the invalid queue without
+// reaching the handler. With WithDeduplication, duplicates are acked without
+// reaching the handler either.
+//
+// Batches are handled one at a time, WithConcurrency has no effect. The
+// prefetch count defaults to at least the batch size.
+//
+// Middlewares wrap handlers of single messages, so they don't apply to batch
+// handlers, and HandleBatch fails if it is given WithMiddleware. A panic in
+// the batch handler is always recovered and fails the whole batch, like the
+// Recover middleware does for other handlers.
+func (c *Client) HandleBatch(queueName, exchangeName, routingKey string, msgCreator EmptyCreator, size int, maxDelay time.Duration, handler BatchHandler, options ...ConsumerOption) (string, Channel, error) {
+	if size <= 0 {
+		return "", nil, newError(ErrConsume, "Invalid RabbitMQ batch consumer", fmt.Errorf("batch size must be positive, got %d", size))
+	}
+
+	options = append([]ConsumerOption{func(cons *consumer) {
+		cons.batchSize = size
+		cons.batchDelay = maxDelay
+	}}, options...)
+
+	cons := c.newConsumer(queueName, exchangeName, routingKey, options)
+	if len(cons.middleware) > 0 {
+		cons.cancel()
+		return "", nil, newError(ErrConsume, "Invalid RabbitMQ batch consumer", errors.New("middlewares don't apply to batch handlers"))
+	}
+	cons.decode = func(d amqp.Delivery) (interface{}, error) {
+		handlerMsg := msgCreator.NewEmpty()
+		err := decodeDelivery(d, handlerMsg)
+		return handlerMsg, err
+	}
+	cons.handleBatch = handler
+	return c.startConsumer(cons)
+}
+
+// MustHandleBatch is like HandleBatch, but panics on errors.
+func (c *Client) MustHandleBatch(queueName, exchangeName, routingKey string, msgCreator EmptyCreator, size int, maxDelay time.Duration, handler BatchHandler, options ...ConsumerOption) (string, Channel) {
+	ctag, ch, err := c.HandleBatch(queueName, exchangeName, routingKey, msgCreator, size, maxDelay, handler, options...)
+	util.PanicOnError("Failed to register a RabbitMQ consumer", err)
+	return ctag, ch
+}
+
+// dispatchBatches collects the deliveries into batches until the deliveries
+// are closed. The last batch is handled even if it is not full.
+func (c *Client) dispatchBatches(cons *consumer, msgs <-chan amqp.Delivery) {
+	var batch []amqp.Delivery
+	var timer *time.Timer
+	var expired <-chan time.Time
+
+	flush := func() {
+		if timer != nil {
+			timer.Stop()
+			timer, expired = nil, nil
+		}
+		if len(batch) > 0 {
+			c.deliverBatch(cons, batch)
+			batch = nil
+		}
+	}
+
+	for {
+		select {
+		case msg, ok := <-msgs:
+			if !ok {
+				flush()
+				return
+			}
+
+			batch = append(batch, msg)
+			if len(batch) >= cons.batchSize {
+				flush()
+			} else if timer == nil {
+				timer = time.NewTimer(cons.batchDelay)
+				expired = timer.C
+			}
+		case <-expired:
+			timer, expired = nil, nil
+			flush()
+		}
+	}
+}
+
+// deliverBatch decodes and handles a batch, hands the failed messages over to
+// the retry ladder and acks the batch.
+func (c *Client) deliverBatch(cons *consumer, batch []amqp.Delivery) {
+	start := time.Now()
+	msgs := make([]interface{}, 0, len(batch))
+	decoded := make([]amqp.Delivery, 0, len(batch))
+	contexts := make([]context.Context, 0, len(batch))
+	spans := make([]Span, 0, len(batch))
+
+	// Messages that could not be handed over, and what happened to the failed
+	// ones, by delivery tag.
+	unsettled := make(map[uint64]error)
+	results := make(map[uint64]string)
+
+	for _, d := range batch {
+		if isDuplicate(cons, d) {
+			cons.logger.WithField("messageId", d.MessageId).Info("Skipping duplicate message")
+			results[d.DeliveryTag] = ResultDuplicate
+			continue
+		}
+
+		msg, err := cons.decode(d)
+		if err != nil {
+			if err = c.invalid(cons, d, err); err != nil {
+				unsettled[d.DeliveryTag] = err
+			}
+			results[d.DeliveryTag] = ResultInvalid
+			continue
+		}
+		msgs = append(msgs, msg)
+		decoded = append(decoded, d)
+		ctx, span := c.handlerContext(cons, d)
+		contexts = append(contexts, ctx)
+		spans = append(spans, span)
+	}
+
+	if len(msgs) > 0 {
+		ctx := context.WithValue(cons.ctx, batchContextsKey{}, contexts)
+		failures := batchFailures(handleBatch(cons, ctx, msgs, decoded), len(decoded))
+
+		for i, d := range decoded {
+			reason, failed := failures[i]
+			spans[i].End(reason)
+			if !failed {
+				handled(cons, d)
+				continue
+			}
+
+			cons.logger.Errorf("Error while processing message: %s", reason)
+			result, err := c.retryOrPark(cons, d, reason)
+			if err != nil {
+				unsettled[d.DeliveryTag] = err
+			}
+			results[d.DeliveryTag] = result
+		}
+	}
+
+	c.settleBatch(cons, batch, unsettled)
+
+	for _, d := range batch {
+		result, ok := results[d.DeliveryTag]
+		if !ok {
+			result = ResultHandled
+		}
+		c.consumed(cons, d, result, unsettled[d.DeliveryTag], start)
+	}
+}
+
+// handleBatch runs the batch handler and turns a panic into an error for the
+// whole batch.
+func handleBatch(cons *consumer, ctx context.Context, msgs []interface{}, ds []amqp.Delivery) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			cons.logger.WithField("stack", string(debug.Stack())).Errorf("AMQP batch handler panicked: %v", r)
+			err = fmt.Errorf("amqp: batch handler panicked: %v", r)
+		}
+	}()
+	return cons.handleBatch(ctx, msgs, ds)
+}
+
+// batchFailures returns the reason that each failed message of a batch of n
+// failed for, by index.
+func batchFailures(err error, n int) map[int]error {
+	if err == nil {
+		return nil
+	}
+
+	failures := make(map[int]error)
+	if batchErr, ok := err.(*BatchError); ok {
+		for i, reason := range batchErr.Failed {
+			if i >= 0 && i < n {
+				failures[i] = reason
+			}
+		}
+		return failures
+	}
+
+	for i := 0; i < n; i++ {
+		failures[i] = err
+	}
+	return failures
+}
+
+// settleBatch acks the whole batch at once, unless some of its messages could
+// not be handed over. Those are requeued, like settle does, and the rest are
+// acked one by one.
+func (c *Client) settleBatch(cons *consumer, batch []amqp.Delivery, unsettled map[uint64]error) {
+	if len(unsettled) == 0 {
+		if err := batch[len(batch)-1].Ack(true); err != nil {
+			cons.logger.Errorf("Could not ack batch: %s", err)
+		}
+		return
+	}
+
+	for _, d := range batch {
+		c.settle(cons, d, unsettled[d.DeliveryTag])
+	}
+}
@@ -0,0 +1,141 @@
+package amqp_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/getconversio/go-utils/services/amqp"
+	"github.com/getconversio/go-utils/util"
+	streadway "github.com/streadway/amqp"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBrokerHandleBatch(t *testing.T) {
+	broker, c := newBroker(nil)
+	defer c.Close()
+
+	batches := make(chan []int, 10)
+	ctag, _, err := c.HandleBatch("test.batch", "test", "test.batch", new(testMsg), 3, 50*time.Millisecond, func(ctx context.Context, msgs []interface{}, ds []streadway.Delivery) error {
+		var batch []int
+		failed := make(map[int]error)
+		for i, msg := range msgs {
+			batch = append(batch, msg.(*testMsg).I)
+			if msg.(*testMsg).I < 0 && ds[i].Headers["_retryNumber"] == nil {
+				failed[i] = errors.New("negative")
+			}
+		}
+		batches <- batch
+		if len(failed) > 0 {
+			return &amqp.BatchError{Failed: failed}
+		}
+		return nil
+	})
+	require.NoError(t, err)
+
+	// Like receive, but for batches.
+	next := func() []int {
+		timeout := time.After(2 * time.Second)
+		for {
+			select {
+			case batch := <-batches:
+				return batch
+			case <-time.After(10 * time.Millisecond):
+				broker.Expire()
+			case <-timeout:
+				t.Fatal("waited too long for a batch")
+				return nil
+			}
+		}
+	}
+
+	// A full batch is handed over right away, the rest after the delay.
+	for i := 1; i <= 4; i++ {
+		require.NoError(t, c.Publish("test", "test.batch", testMsg{i}))
+	}
+	assert.Equal(t, []int{1, 2, 3}, next())
+	assert.Equal(t, []int{4}, next())
+
+	// Only the failed message is retried.
+	require.NoError(t, c.Publish("test", "test.batch", testMsg{5}))
+	require.NoError(t, c.Publish("test", "test.batch", testMsg{-6}))
+	require.NoError(t, c.Publish("test", "test.batch", testMsg{7}))
+	assert.Equal(t, []int{5, -6, 7}, next())
+
+	require.NoError(t, c.EnsureRetryConsumer())
+	assert.Equal(t, []int{-6}, next())
+	assert.Equal(t, 0, broker.QueueLength("amqp.parked"))
+
+	// Everything was acked, so nothing is requeued when the consumer's channel
+	// is closed.
+	require.NoError(t, c.Stop(ctag))
+	assert.Equal(t, 0, broker.QueueLength("test.batch"))
+}
+
+func TestBrokerHandleBatchOptions(t *testing.T) {
+	broker, c := newBroker(nil)
+	defer c.Close()
+	require.NoError(t, c.EnsureRetryConsumer())
+
+	noop := func(ctx context.Context, msgs []interface{}, ds []streadway.Delivery) error {
+		return nil
+	}
+	_, _, err := c.HandleBatch("test.batch", "test", "test.batch", new(testMsg), 0, time.Second, noop)
+	assert.True(t, amqp.IsKind(err, amqp.ErrConsume))
+	_, _, err = c.HandleBatch("test.batch", "test", "test.batch", new(testMsg), 2, time.Second, noop,
+		amqp.WithMiddleware(amqp.Recover()))
+	assert.True(t, amqp.IsKind(err, amqp.ErrConsume))
+
+	store, err := amqp.NewLRUDedupStore(100)
+	require.NoError(t, err)
+
+	panicked := false
+	requests := make(chan string, 10)
+	_, _, err = c.HandleBatch("test.batch", "test", "test.batch", new(testMsg), 2, 50*time.Millisecond, func(ctx context.Context, msgs []interface{}, ds []streadway.Delivery) error {
+		if !panicked {
+			panicked = true
+			panic("boom")
+		}
+		for i := range msgs {
+			requests <- amqp.RequestID(amqp.BatchMessageContext(ctx, i))
+		}
+		return nil
+	}, amqp.WithDeduplication(store, time.Hour))
+	require.NoError(t, err)
+
+	publish := func(id, requestID string, i int) {
+		ctx := amqp.WithMessageID(amqp.WithRequestID(context.Background(), requestID), id)
+		require.NoError(t, c.PublishContext(ctx, "test", "test.batch", testMsg{i}))
+	}
+	next := func() string {
+		timeout := time.After(2 * time.Second)
+		for {
+			select {
+			case id := <-requests:
+				return id
+			case <-time.After(10 * time.Millisecond):
+				broker.Expire()
+			case <-timeout:
+				t.Fatal("waited too long for a batch")
+				return ""
+			}
+		}
+	}
+
+	// The panic fails the batch, which is retried. Every message has the
+	// context it was published with.
+	publish("1", "a", 1)
+	publish("2", "b", 2)
+	assert.ElementsMatch(t, []string{"a", "b"}, []string{next(), next()})
+
+	// Duplicates don't reach the handler.
+	publish("1", "a", 1)
+	publish("3", "c", 3)
+	assert.Equal(t, "c", next())
+	util.ValidateWithTimeout(t, func() bool {
+		return broker.QueueLength("test.batch") == 0
+	}, 1000)
+	assert.Empty(t, requests)
+}
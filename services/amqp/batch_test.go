@@ -0,0 +1,20 @@
+package amqp
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBatchFailures(t *testing.T) {
+	assert.Nil(t, batchFailures(nil, 3))
+
+	err := errors.New("not good")
+	assert.Equal(t, map[int]error{0: err, 1: err, 2: err}, batchFailures(err, 3))
+
+	// Indexes outside the batch are ignored.
+	batchErr := &BatchError{Failed: map[int]error{1: err, 5: err}}
+	assert.Equal(t, map[int]error{1: err}, batchFailures(batchErr, 3))
+	assert.Contains(t, batchErr.Error(), "1: not good")
+}
@@ -0,0 +1,233 @@
+package amqp
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"sync"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/golang/snappy"
+	"github.com/streadway/amqp"
+	"github.com/vmihailenco/msgpack"
+)
+
+// A Codec encodes and decodes message bodies. Published messages carry the
+// content type and encoding of their codec, and consumers decode every
+// delivery with the registered codec that matches them. That way producers can
+// switch codecs without their consumers having to change at the same time.
+type Codec interface {
+	// ContentType and ContentEncoding are set on published messages, e.g.
+	// application/json and gzip.
+	ContentType() string
+	ContentEncoding() string
+
+	Marshal(v interface{}) ([]byte, error)
+	Unmarshal(data []byte, v interface{}) error
+}
+
+var (
+	// JSON encodes messages with encoding/json. Deliveries without a content
+	// type are assumed to be JSON.
+	JSON Codec = jsonCodec{}
+
+	// Protobuf encodes messages that implement proto.Message.
+	Protobuf Codec = protobufCodec{}
+
+	// MsgPack encodes messages with MessagePack.
+	MsgPack Codec = msgpackCodec{}
+
+	// GzipJSON and SnappyJSON are JSON compressed with gzip and snappy.
+	GzipJSON   = Gzip(JSON)
+	SnappyJSON = Snappy(JSON)
+)
+
+type codecKey struct {
+	contentType     string
+	contentEncoding string
+}
+
+var (
+	codecsMu sync.RWMutex
+	codecs   = make(map[codecKey]Codec)
+)
+
+func init() {
+	for _, codec := range []Codec{JSON, Protobuf, MsgPack, GzipJSON, SnappyJSON, Gzip(Protobuf), Snappy(Protobuf), Gzip(MsgPack), Snappy(MsgPack)} {
+		RegisterCodec(codec)
+	}
+}
+
+// RegisterCodec makes consumers decode deliveries with the codec's content
+// type and encoding using the codec. It replaces any codec registered for the
+// same content type and encoding.
+func RegisterCodec(codec Codec) {
+	codecsMu.Lock()
+	defer codecsMu.Unlock()
+	codecs[codecKey{codec.ContentType(), codec.ContentEncoding()}] = codec
+}
+
+// codecFor returns the registered codec for the content type and encoding of
+// a delivery.
+func codecFor(contentType, contentEncoding string) (Codec, error) {
+	if contentType == "" {
+		contentType = JSON.ContentType()
+	}
+
+	codecsMu.RLock()
+	defer codecsMu.RUnlock()
+
+	codec, ok := codecs[codecKey{contentType, contentEncoding}]
+	if !ok {
+		return nil, fmt.Errorf("amqp: no codec for content type %q and encoding %q", contentType, contentEncoding)
+	}
+	return codec, nil
+}
+
+// decodeDelivery decodes the body of the delivery into v.
+func decodeDelivery(d amqp.Delivery, v interface{}) error {
+	codec, err := codecFor(d.ContentType, d.ContentEncoding)
+	if err != nil {
+		return err
+	}
+	return codec.Unmarshal(d.Body, v)
+}
+
+// encodePublishing encodes msg into a message with the codec's properties and
+// a new message ID.
+func encodePublishing(codec Codec, msg interface{}) (amqp.Publishing, error) {
+	body, err := codec.Marshal(msg)
+	if err != nil {
+		return amqp.Publishing{}, err
+	}
+
+	id, err := newMessageID()
+	if err != nil {
+		return amqp.Publishing{}, err
+	}
+
+	return amqp.Publishing{
+		ContentType:     codec.ContentType(),
+		ContentEncoding: codec.ContentEncoding(),
+		MessageId:       id,
+		Body:            body,
+	}, nil
+}
+
+type jsonCodec struct{}
+
+func (jsonCodec) ContentType() string     { return "application/json" }
+func (jsonCodec) ContentEncoding() string { return "" }
+
+func (jsonCodec) Marshal(v interface{}) ([]byte, error) {
+	return json.Marshal(v)
+}
+
+func (jsonCodec) Unmarshal(data []byte, v interface{}) error {
+	return json.Unmarshal(data, v)
+}
+
+type protobufCodec struct{}
+
+func (protobufCodec) ContentType() string     { return "application/x-protobuf" }
+func (protobufCodec) ContentEncoding() string { return "" }
+
+func (protobufCodec) Marshal(v interface{}) ([]byte, error) {
+	msg, ok := v.(proto.Message)
+	if !ok {
+		return nil, fmt.Errorf("amqp: %T is not a proto.Message", v)
+	}
+	return proto.Marshal(msg)
+}
+
+func (protobufCodec) Unmarshal(data []byte, v interface{}) error {
+	msg, ok := v.(proto.Message)
+	if !ok {
+		return fmt.Errorf("amqp: %T is not a proto.Message", v)
+	}
+	return proto.Unmarshal(data, msg)
+}
+
+type msgpackCodec struct{}
+
+func (msgpackCodec) ContentType() string     { return "application/msgpack" }
+func (msgpackCodec) ContentEncoding() string { return "" }
+
+func (msgpackCodec) Marshal(v interface{}) ([]byte, error) {
+	return msgpack.Marshal(v)
+}
+
+func (msgpackCodec) Unmarshal(data []byte, v interface{}) error {
+	return msgpack.Unmarshal(data, v)
+}
+
+// Gzip compresses the messages encoded by codec with gzip.
+func Gzip(codec Codec) Codec {
+	return gzipCodec{codec}
+}
+
+type gzipCodec struct {
+	Codec
+}
+
+func (gzipCodec) ContentEncoding() string { return "gzip" }
+
+func (c gzipCodec) Marshal(v interface{}) ([]byte, error) {
+	data, err := c.Codec.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+
+	var buf bytes.Buffer
+	w := gzip.NewWriter(&buf)
+	if _, err = w.Write(data); err != nil {
+		return nil, err
+	}
+	if err = w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (c gzipCodec) Unmarshal(data []byte, v interface{}) error {
+	r, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	data, err = ioutil.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	return c.Codec.Unmarshal(data, v)
+}
+
+// Snappy compresses the messages encoded by codec with snappy.
+func Snappy(codec Codec) Codec {
+	return snappyCodec{codec}
+}
+
+type snappyCodec struct {
+	Codec
+}
+
+func (snappyCodec) ContentEncoding() string { return "snappy" }
+
+func (c snappyCodec) Marshal(v interface{}) ([]byte, error) {
+	data, err := c.Codec.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	return snappy.Encode(nil, data), nil
+}
+
+func (c snappyCodec) Unmarshal(data []byte, v interface{}) error {
+	data, err := snappy.Decode(nil, data)
+	if err != nil {
+		return err
+	}
+	return c.Codec.Unmarshal(data, v)
+}
@@ -0,0 +1,74 @@
+package amqp
+
+import (
+	"testing"
+
+	"github.com/golang/protobuf/ptypes/wrappers"
+	"github.com/streadway/amqp"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCodecs(t *testing.T) {
+	for _, codec := range []Codec{JSON, MsgPack, GzipJSON, SnappyJSON} {
+		publishing, err := encodePublishing(codec, msgType{7})
+		require.NoError(t, err)
+		assert.Equal(t, codec.ContentType(), publishing.ContentType)
+		assert.Equal(t, codec.ContentEncoding(), publishing.ContentEncoding)
+		assert.Len(t, publishing.MessageId, 32)
+
+		msg := new(msgType)
+		err = decodeDelivery(amqp.Delivery{
+			ContentType:     publishing.ContentType,
+			ContentEncoding: publishing.ContentEncoding,
+			Body:            publishing.Body,
+		}, msg)
+		require.NoError(t, err, codec.ContentType()+" "+codec.ContentEncoding())
+		assert.Equal(t, 7, msg.I)
+	}
+}
+
+func TestProtobufCodec(t *testing.T) {
+	codec := Gzip(Protobuf)
+	publishing, err := encodePublishing(codec, &wrappers.StringValue{Value: "hello"})
+	require.NoError(t, err)
+
+	msg := new(wrappers.StringValue)
+	err = decodeDelivery(amqp.Delivery{
+		ContentType:     "application/x-protobuf",
+		ContentEncoding: "gzip",
+		Body:            publishing.Body,
+	}, msg)
+	require.NoError(t, err)
+	assert.Equal(t, "hello", msg.Value)
+
+	_, err = encodePublishing(Protobuf, msgType{1})
+	assert.Error(t, err)
+}
+
+func TestDecodeDelivery(t *testing.T) {
+	// Deliveries without a content type are JSON.
+	msg := new(msgType)
+	require.NoError(t, decodeDelivery(amqp.Delivery{Body: []byte(`{"i":8}`)}, msg))
+	assert.Equal(t, 8, msg.I)
+
+	err := decodeDelivery(amqp.Delivery{ContentType: "text/plain", Body: []byte(`8`)}, msg)
+	assert.Error(t, err)
+}
+
+func TestPublishCodec(t *testing.T) {
+	setup()
+	defer teardown()
+
+	ctag, _ := MustHandleFunc("test.mctest", "test", "test.routing", new(msgType), func(msg interface{}, headers amqp.Table) error {
+		intChannel <- msg.(*msgType).I
+		return nil
+	})
+	defer Stop(ctag)
+
+	require.NoError(t, PublishCodec("test", "test.routing", msgType{46}, SnappyJSON))
+	assert.Equal(t, 46, <-intChannel)
+
+	require.NoError(t, PublishCodec("test", "test.routing", msgType{47}, MsgPack))
+	assert.Equal(t, 47, <-intChannel)
+}
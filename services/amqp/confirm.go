@@ -0,0 +1,155 @@
+package amqp
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/streadway/amqp"
+)
+
+var (
+	// ErrNack is returned when the broker could not take responsibility for
+	// a published message.
+	ErrNack = errors.New("amqp: message was nacked by the broker")
+
+	// ErrConfirmTimeout is returned when the broker did not confirm a message
+	// in time. The message may or may not have been persisted.
+	ErrConfirmTimeout = errors.New("amqp: timed out waiting for publisher confirm")
+
+	// ErrUnconfirmed is returned when the channel closed before the broker
+	// confirmed a message.
+	ErrUnconfirmed = errors.New("amqp: channel closed before the message was confirmed")
+)
+
+// PublishFuture is the result of an asynchronous publish. It is resolved when
+// the broker acks or nacks the message, or right away if the client does not
+// use publisher confirms.
+type PublishFuture struct {
+	done chan struct{}
+	err  error
+}
+
+func newPublishFuture() *PublishFuture {
+	return &PublishFuture{done: make(chan struct{})}
+}
+
+func (f *PublishFuture) resolve(err error) {
+	f.err = err
+	close(f.done)
+}
+
+// Done is closed when the future is resolved.
+func (f *PublishFuture) Done() <-chan struct{} {
+	return f.done
+}
+
+// Err returns the result of the publish. It must only be called after Done
+// is closed.
+func (f *PublishFuture) Err() error {
+	return f.err
+}
+
+// Wait waits up to timeout for the future to be resolved and returns the
+// result. A zero timeout waits forever.
+func (f *PublishFuture) Wait(timeout time.Duration) error {
+	if timeout <= 0 {
+		<-f.done
+		return f.err
+	}
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	select {
+	case <-f.done:
+		return f.err
+	case <-timer.C:
+		return ErrConfirmTimeout
+	}
+}
+
+// A confirmer puts a channel in confirm mode and resolves a future for every
+// message published through it.
+type confirmer struct {
+	ch Channel
+
+	// Held while publishing, so delivery tags are handed out in the same order
+	// as the broker sees the messages.
+	publishMu sync.Mutex
+	tag       uint64
+
+	// Guards pending, which is also used by the listener. The listener must
+	// never wait for publishMu, since amqp holds its own lock while it
+	// delivers confirmations.
+	pendingMu sync.Mutex
+	pending   map[uint64]*PublishFuture
+}
+
+func newConfirmer(ch Channel) (*confirmer, error) {
+	c := &confirmer{ch: ch, pending: make(map[uint64]*PublishFuture)}
+
+	confirms := ch.NotifyPublish(make(chan amqp.Confirmation, 128))
+	if err := ch.Confirm(false); err != nil {
+		return nil, err
+	}
+
+	go c.listen(confirms)
+	return c, nil
+}
+
+func (c *confirmer) listen(confirms chan amqp.Confirmation) {
+	for confirm := range confirms {
+		c.pendingMu.Lock()
+		f := c.pending[confirm.DeliveryTag]
+		delete(c.pending, confirm.DeliveryTag)
+		c.pendingMu.Unlock()
+
+		if f == nil {
+			continue
+		}
+		if confirm.Ack {
+			f.resolve(nil)
+		} else {
+			f.resolve(ErrNack)
+		}
+	}
+
+	// The channel is closed, nothing else will be confirmed.
+	c.pendingMu.Lock()
+	for tag, f := range c.pending {
+		delete(c.pending, tag)
+		f.resolve(ErrUnconfirmed)
+	}
+	c.pendingMu.Unlock()
+}
+
+func (c *confirmer) publish(exchangeName, routingKey string, msg amqp.Publishing) (*PublishFuture, error) {
+	c.publishMu.Lock()
+	defer c.publishMu.Unlock()
+
+	f := newPublishFuture()
+	tag := c.tag + 1
+
+	// Register the future first, the confirmation may arrive before Publish
+	// returns.
+	c.pendingMu.Lock()
+	c.pending[tag] = f
+	c.pendingMu.Unlock()
+
+	err := c.ch.Publish(
+		exchangeName,
+		routingKey,
+		false, // Mandatory
+		false, // Immediate
+		msg)
+	if err != nil {
+		c.pendingMu.Lock()
+		delete(c.pending, tag)
+		c.pendingMu.Unlock()
+		return nil, err
+	}
+
+	c.tag = tag
+	return f, nil
+}
@@ -0,0 +1,31 @@
+package amqp_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/getconversio/go-utils/services/amqp"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBrokerPublishAsync(t *testing.T) {
+	broker, c := newBroker(&amqp.Options{Confirm: true})
+	defer c.Close()
+
+	require.NoError(t, c.EnsureExchange("test"))
+
+	futures := []*amqp.PublishFuture{}
+	for i := 0; i < 100; i++ {
+		futures = append(futures, c.PublishAsync("test", "test.nobody", testMsg{i}))
+	}
+	for _, f := range futures {
+		require.NoError(t, f.Wait(2*time.Second))
+	}
+	assert.Len(t, broker.PublishedTo("test", "test.nobody"), 100)
+
+	// The channel dies when publishing to an exchange that does not exist,
+	// so the message is never confirmed.
+	err := c.Publish("test.doesnotexist", "test", testMsg{1})
+	assert.Equal(t, amqp.ErrUnconfirmed, err)
+}
@@ -0,0 +1,19 @@
+package amqp
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPublishFuture(t *testing.T) {
+	f := newPublishFuture()
+	assert.Equal(t, ErrConfirmTimeout, f.Wait(time.Millisecond))
+
+	go f.resolve(errors.New("nope"))
+	<-f.Done()
+	assert.EqualError(t, f.Err(), "nope")
+	assert.EqualError(t, f.Wait(0), "nope")
+}
@@ -0,0 +1,319 @@
+package amqp
+
+import (
+	"errors"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/streadway/amqp"
+)
+
+var (
+	// ErrDisconnected is returned when the client is not connected and
+	// either FailFast is set or PublishTimeout expired while waiting.
+	ErrDisconnected = errors.New("amqp: not connected")
+
+	// ErrClosed is returned when the client was closed.
+	ErrClosed = errors.New("amqp: client closed")
+)
+
+// A session is a connection and what the client declared on it. When the
+// connection goes away, the session is dead and the client opens a new one.
+// Declarations are made on short-lived channels, messages are published on a
+// pool of channels of their own and every consumer consumes on its own
+// channel, so an error on one of those does not take the others down.
+type session struct {
+	conn Connection
+
+	// Pool of publishing channels, see publisher.
+	publishers chan *publisher
+
+	// TTLs of the waiting queues and names of the invalid queues declared on
+	// this session.
+	waiting map[int]bool
+	invalid map[string]bool
+
+	// Closed when the connection is closed. err is the reason, nil if it was
+	// closed on purpose.
+	closed chan struct{}
+	err    *amqp.Error
+}
+
+func (s *session) watch() {
+	closes := s.conn.NotifyClose(make(chan *amqp.Error, 1))
+
+	go func() {
+		s.err = <-closes
+		close(s.closed)
+	}()
+}
+
+// isOpen reports whether the connection is still open.
+func (s *session) isOpen() bool {
+	select {
+	case <-s.closed:
+		return false
+	default:
+		return true
+	}
+}
+
+// connect dials the broker and declares the retry topology, unless the client
+// skips that.
+func (c *Client) connect() (*session, error) {
+	conn, err := c.opts.Dial(c.opts.URL)
+	if err != nil {
+		return nil, newError(ErrConnection, "Failed to connect to RabbitMQ", err)
+	}
+
+	s := &session{
+		conn:       conn,
+		publishers: newPublisherPool(c.opts.PublisherChannels),
+		closed:     make(chan struct{}),
+		waiting:    make(map[int]bool),
+		invalid:    make(map[string]bool),
+	}
+
+	if !c.opts.SkipRetryTopology {
+		if err = c.declareRetryTopology(s); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+
+	s.watch()
+	c.watchBlocked(conn)
+	return s, nil
+}
+
+// openChannel opens a channel on the session's connection. Declarations use a
+// short-lived channel of their own, since the broker closes the channel when
+// it refuses one, e.g. because the exchange exists with another type.
+func (s *session) openChannel() (Channel, error) {
+	ch, err := s.conn.Channel()
+	if err != nil {
+		return nil, newError(ErrConnection, "Failed to open RabbitMQ channel", err)
+	}
+	return ch, nil
+}
+
+// openChannel opens a channel on the current session, for work that could
+// disturb the consumers or close the channel.
+func (c *Client) openChannel() (Channel, error) {
+	sess, err := c.session(false, 0)
+	if err != nil {
+		return nil, err
+	}
+	return sess.openChannel()
+}
+
+func (c *Client) declareRetryTopology(sess *session) error {
+	ch, err := sess.openChannel()
+	if err != nil {
+		return err
+	}
+	defer ch.Close()
+
+	_, err = ch.QueueDeclare(
+		c.opts.ReadyQueue, // name
+		true,              // durable
+		false,             // delete when unused
+		false,             // exclusive
+		false,             // no-wait
+		nil,               // arguments
+	)
+	if err != nil {
+		return newError(ErrDeclare, "Failed to declare RabbitMQ queue", err)
+	}
+
+	_, err = ch.QueueDeclare(
+		c.opts.ParkingQueue, // name
+		true,                // durable
+		false,               // delete when unused
+		false,               // exclusive
+		false,               // no-wait
+		nil,                 // arguments
+	)
+	if err != nil {
+		return newError(ErrDeclare, "Failed to declare RabbitMQ queue", err)
+	}
+
+	err = ch.ExchangeDeclare(
+		c.opts.RetryExchange, // name
+		"topic",              // type
+		true,                 // durable
+		false,                // auto-deleted
+		false,                // internal
+		false,                // no-wait
+		nil,                  // arguments
+	)
+	if err != nil {
+		return newError(ErrDeclare, "Failed to declare RabbitMQ exchange", err)
+	}
+
+	err = ch.QueueBind(
+		c.opts.ReadyQueue,      // queue name
+		c.opts.RetryRoutingKey, // routing key
+		c.opts.RetryExchange,   // exchange name
+		false,                  // no-wait
+		nil,                    // arguments
+	)
+	if err != nil {
+		return newError(ErrDeclare, "Failed to bind RabbitMQ queue", err)
+	}
+
+	c.setupMu.Lock()
+	defer c.setupMu.Unlock()
+
+	for _, ttl := range c.opts.RetryTTLs {
+		if err = c.declareWaitingQueue(ch, sess, ttl); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// ensureChannel opens the first session. Later sessions are opened by the
+// supervisor when the previous one dies. If the first one can't be opened, the
+// next call tries again.
+func (c *Client) ensureChannel() error {
+	c.connectMu.Lock()
+	defer c.connectMu.Unlock()
+
+	if c.connected {
+		return nil
+	}
+
+	sess, err := c.connect()
+	if err != nil {
+		c.recordError(err)
+		return err
+	}
+
+	c.mu.Lock()
+	if c.closed {
+		c.mu.Unlock()
+		sess.conn.Close()
+		return ErrClosed
+	}
+	c.sess = sess
+	close(c.ready)
+	c.mu.Unlock()
+
+	c.connected = true
+	go c.supervise(sess)
+	return nil
+}
+
+// supervise waits for the session to die and reconnects with an exponential
+// backoff, unless the client was closed on purpose.
+func (c *Client) supervise(sess *session) {
+	for {
+		<-sess.closed
+		log.Infof("AMQP received close message: %v", sess.err)
+		if sess.err != nil {
+			c.recordError(sess.err)
+		}
+
+		c.mu.Lock()
+		c.sess = nil
+		c.ready = make(chan struct{})
+		if sess.err == nil {
+			c.closed = true
+		}
+		closed := c.closed
+		c.mu.Unlock()
+
+		c.onClose()
+		if closed {
+			return
+		}
+
+		delay := c.opts.ReconnectDelay
+		for {
+			var err error
+			sess, err = c.connect()
+			if err == nil {
+				break
+			}
+
+			log.Errorf("AMQP reconnect failed, trying again in %s: %s", delay, err)
+			c.recordError(err)
+			time.Sleep(delay)
+
+			if delay *= 2; delay > c.opts.MaxReconnectDelay {
+				delay = c.opts.MaxReconnectDelay
+			}
+
+			if c.isClosed() {
+				return
+			}
+		}
+
+		c.mu.Lock()
+		if c.closed {
+			c.mu.Unlock()
+			sess.conn.Close()
+			return
+		}
+		c.sess = sess
+		close(c.ready)
+		c.mu.Unlock()
+
+		log.Info("AMQP reconnected")
+	}
+}
+
+func (c *Client) isClosed() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.closed
+}
+
+// session returns the current session. If the client is reconnecting, it
+// returns ErrDisconnected when failFast is true, or waits up to timeout for
+// the new session. A zero timeout waits forever.
+func (c *Client) session(failFast bool, timeout time.Duration) (*session, error) {
+	var expired <-chan time.Time
+	if timeout > 0 {
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
+		expired = timer.C
+	}
+	return c.waitSession(failFast, expired, nil)
+}
+
+// waitSession is like session, but it can be interrupted. It returns
+// ErrDisconnected when expired fires, and ErrClosed when cancel is closed.
+func (c *Client) waitSession(failFast bool, expired <-chan time.Time, cancel <-chan struct{}) (*session, error) {
+	if c.isClosed() {
+		return nil, ErrClosed
+	}
+	if err := c.ensureChannel(); err != nil {
+		return nil, err
+	}
+
+	for {
+		c.mu.Lock()
+		sess, ready, closed := c.sess, c.ready, c.closed
+		c.mu.Unlock()
+
+		switch {
+		case closed:
+			return nil, ErrClosed
+		case sess != nil:
+			return sess, nil
+		case failFast:
+			return nil, ErrDisconnected
+		}
+
+		select {
+		case <-ready:
+		case <-expired:
+			return nil, ErrDisconnected
+		case <-cancel:
+			return nil, ErrClosed
+		}
+	}
+}
@@ -0,0 +1,103 @@
+package amqp_test
+
+import (
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/getconversio/go-utils/services/amqp"
+	"github.com/getconversio/go-utils/services/amqp/amqptest"
+	"github.com/getconversio/go-utils/util"
+	streadway "github.com/streadway/amqp"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBrokerReconnect(t *testing.T) {
+	broker, c := newBroker(&amqp.Options{ReconnectDelay: 10 * time.Millisecond})
+	defer c.Close()
+
+	received := make(chan int)
+	c.HandleFunc("test.queue", "test", "test.routing", new(testMsg), func(msg interface{}, headers streadway.Table) error {
+		received <- msg.(*testMsg).I
+		return nil
+	})
+
+	require.NoError(t, c.Publish("test", "test.routing", testMsg{5}))
+	assert.Equal(t, 5, receive(t, broker, received))
+
+	// Publish waits for the new connection, and the consumer is registered
+	// again after the broker drops the connection.
+	broker.Disconnect()
+	require.NoError(t, c.Publish("test", "test.routing", testMsg{6}))
+	assert.Equal(t, 6, receive(t, broker, received))
+}
+
+func TestBrokerFailFast(t *testing.T) {
+	broker := amqptest.NewBroker()
+	var down int32
+	c := amqp.NewClient(&amqp.Options{
+		URL:            "amqp://amqptest",
+		FailFast:       true,
+		ReconnectDelay: 10 * time.Millisecond,
+		Dial: func(url string) (amqp.Connection, error) {
+			if atomic.LoadInt32(&down) == 1 {
+				return nil, errors.New("broker is down")
+			}
+			return broker.Dial(url)
+		},
+	})
+	defer c.Close()
+	require.NoError(t, c.EnsureExchange("test"))
+
+	// While the client is reconnecting, Publish gives up right away.
+	atomic.StoreInt32(&down, 1)
+	broker.Disconnect()
+	util.ValidateWithTimeout(t, func() bool {
+		return c.Publish("test", "test.routing", testMsg{1}) == amqp.ErrDisconnected
+	}, 1000)
+
+	atomic.StoreInt32(&down, 0)
+	util.ValidateWithTimeout(t, func() bool {
+		return c.Publish("test", "test.routing", testMsg{2}) == nil
+	}, 1000)
+
+	c.Close()
+	assert.Equal(t, amqp.ErrClosed, c.Publish("test", "test.routing", testMsg{3}))
+}
+
+func TestBrokerDeclareError(t *testing.T) {
+	broker, c := newBroker(nil)
+	defer c.Close()
+
+	topology, err := amqp.ParseTopology([]byte(`
+exchanges:
+  - name: orders
+    type: direct
+queues:
+  - name: orders.created
+    max_length: 10
+`))
+	require.NoError(t, err)
+	require.NoError(t, c.ApplyTopology(topology))
+
+	received := make(chan int)
+	_, ch, err := c.HandleFunc("test.queue", "test", "test.#", new(testMsg), func(msg interface{}, headers streadway.Table) error {
+		received <- msg.(*testMsg).I
+		return nil
+	})
+	require.NoError(t, err)
+
+	// The broker refuses to declare them again with other settings, which
+	// only closes the channel of the declaration, not the connection with
+	// the consumer on it.
+	assert.True(t, amqp.IsKind(c.EnsureExchange("orders"), amqp.ErrDeclare))
+	assert.True(t, amqp.IsKind(c.EnsureQueue("orders.created"), amqp.ErrDeclare))
+
+	_, err = ch.QueueInspect("test.queue")
+	require.NoError(t, err)
+	require.NoError(t, c.Publish("test", "test.routing", testMsg{1}))
+	assert.Equal(t, 1, receive(t, broker, received))
+	assert.True(t, c.Health().Connected)
+}
@@ -0,0 +1,491 @@
+package amqp
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/getconversio/go-utils/util"
+	log "github.com/sirupsen/logrus"
+	"github.com/streadway/amqp"
+)
+
+var errConsumerStopped = errors.New("amqp: consumer stopped")
+
+// Handler handles a decoded message. The context is cancelled when the client
+// shuts down and gives up waiting for the handler to finish.
+type Handler func(ctx context.Context, msg interface{}, d amqp.Delivery) error
+
+// A consumer registered through HandleFunc. It holds everything needed to
+// register it again on a new channel after a reconnect.
+type consumer struct {
+	ctag         string
+	queueName    string
+	exchangeName string
+	routingKey   string
+	retryPolicy  *RetryPolicy
+	logger       *log.Entry
+
+	// Number of workers handling deliveries and the prefetch count of the
+	// consumer. orderingKey, if set, picks the worker for a delivery.
+	concurrency int
+	prefetch    int
+	orderingKey func(d amqp.Delivery) string
+
+	// decode turns the body into the message that is passed to handle.
+	// handle is wrapped in the middlewares when the consumer starts.
+	decode     func(d amqp.Delivery) (interface{}, error)
+	handle     Handler
+	middleware []Middleware
+
+	// Set for batch consumers, see HandleBatch.
+	batchSize   int
+	batchDelay  time.Duration
+	handleBatch BatchHandler
+
+	// Queue that messages that can't be decoded are moved to, if not the
+	// default. See WithInvalidQueue.
+	invalidQueue string
+
+	// Skip messages that were handled within the window, see
+	// WithDeduplication.
+	dedup       DedupStore
+	dedupWindow time.Duration
+
+	// Topology that the consumer's options came from, see
+	// Topology.ConsumerOptions. The exchanges, queues and bindings in it are
+	// not declared again.
+	topology *Topology
+
+	// Passed to the handler. It is cancelled when the consumer is done.
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	// The channel the consumer currently consumes on, and whether it still
+	// does. stopped is closed when the consumer is stopped, done when it has
+	// handled its last message.
+	mu       sync.Mutex
+	ch       Channel
+	active   bool
+	stopping bool
+	stopped  chan struct{}
+	done     chan struct{}
+
+	// Set for the retry consumer, which moves messages back to their original
+	// exchange instead of calling a handler.
+	relay bool
+}
+
+// A ConsumerOption changes how a consumer set up by HandleFunc behaves.
+type ConsumerOption func(*consumer)
+
+// HandleFunc sets up a handler/consumer function for the given queue, exchange
+// and routing key. It ensures that there is an open connection and channel.
+//
+// Messages are decoded with the codec registered for their content type and
+// encoding, JSON if they have no content type. See RegisterCodec.
+//
+// The msgCreator interface is needed in order for the returned handler to be
+// able to cast the returned message into the right type.
+//
+// When the handler returns an error, the message is retried according to the
+// retry policy, which defaults to the client's retry ladder. Use
+// WithRetryPolicy or WithoutRetries to change it. Messages that have no retries
+// left are moved to the parking queue. The handler
+// can decide otherwise for a message by returning Permanent, RetryAfter or
+// Requeue.
+//
+// Messages are handled one at a time, unless WithConcurrency says otherwise.
+//
+// If the connection is lost, the consumer is registered again with the same
+// queue, exchange and routing key once the client has reconnected.
+//
+// Returns the ctag for the consumer and the channel that the consumer was
+// opened on. Notice that the channel is replaced after a reconnect.
+func (c *Client) HandleFunc(queueName, exchangeName, routingKey string, msgCreator EmptyCreator, handler func(interface{}, amqp.Table) error, options ...ConsumerOption) (string, Channel, error) {
+	cons := c.newConsumer(queueName, exchangeName, routingKey, options)
+	cons.decode = func(d amqp.Delivery) (interface{}, error) {
+		// Create a new empty handlerMsg
+		handlerMsg := msgCreator.NewEmpty()
+
+		// Decode the body of the message into the given handler message.
+		err := decodeDelivery(d, handlerMsg)
+		return handlerMsg, err
+	}
+	cons.handle = func(ctx context.Context, msg interface{}, d amqp.Delivery) error {
+		return handler(msg, d.Headers)
+	}
+	return c.startConsumer(cons)
+}
+
+// MustHandleFunc is like HandleFunc, but panics on errors.
+func (c *Client) MustHandleFunc(queueName, exchangeName, routingKey string, msgCreator EmptyCreator, handler func(interface{}, amqp.Table) error, options ...ConsumerOption) (string, Channel) {
+	ctag, ch, err := c.HandleFunc(queueName, exchangeName, routingKey, msgCreator, handler, options...)
+	util.PanicOnError("Failed to register a RabbitMQ consumer", err)
+	return ctag, ch
+}
+
+// HandleContext is like HandleFunc, but the handler also gets a context and
+// the full delivery. The context is cancelled if the handler is still busy
+// when Shutdown gives up.
+func (c *Client) HandleContext(queueName, exchangeName, routingKey string, msgCreator EmptyCreator, handler Handler, options ...ConsumerOption) (string, Channel, error) {
+	cons := c.newConsumer(queueName, exchangeName, routingKey, options)
+	cons.decode = func(d amqp.Delivery) (interface{}, error) {
+		handlerMsg := msgCreator.NewEmpty()
+		err := decodeDelivery(d, handlerMsg)
+		return handlerMsg, err
+	}
+	cons.handle = handler
+	return c.startConsumer(cons)
+}
+
+// MustHandleContext is like HandleContext, but panics on errors.
+func (c *Client) MustHandleContext(queueName, exchangeName, routingKey string, msgCreator EmptyCreator, handler Handler, options ...ConsumerOption) (string, Channel) {
+	ctag, ch, err := c.HandleContext(queueName, exchangeName, routingKey, msgCreator, handler, options...)
+	util.PanicOnError("Failed to register a RabbitMQ consumer", err)
+	return ctag, ch
+}
+
+func (c *Client) newConsumer(queueName, exchangeName, routingKey string, options []ConsumerOption) *consumer {
+	// Inspired by the amqp code
+	ctag := fmt.Sprintf("ctag-%d", atomic.AddUint64(&c.consumerSeq, 1))
+
+	cons := &consumer{
+		ctag:         ctag,
+		queueName:    queueName,
+		exchangeName: exchangeName,
+		routingKey:   routingKey,
+		stopped:      make(chan struct{}),
+		done:         make(chan struct{}),
+		logger: log.WithFields(log.Fields{
+			"ctag":     ctag,
+			"queue":    queueName,
+			"exchange": exchangeName,
+			"routing":  routingKey,
+		}),
+	}
+
+	for _, option := range options {
+		option(cons)
+	}
+
+	if cons.concurrency < 1 {
+		cons.concurrency = 1
+	}
+	if cons.prefetch == 0 {
+		cons.prefetch = c.opts.Prefetch
+		if cons.prefetch < cons.concurrency {
+			cons.prefetch = cons.concurrency
+		}
+		if cons.prefetch < cons.batchSize {
+			cons.prefetch = cons.batchSize
+		}
+	}
+
+	if cons.retryPolicy == nil {
+		cons.retryPolicy = new(RetryPolicy)
+	}
+	*cons.retryPolicy = cons.retryPolicy.withDefaults(c.opts.RetryTTLs)
+
+	cons.ctx, cons.cancel = context.WithCancel(context.WithValue(c.ctx, queueNameKey{}, queueName))
+	return cons
+}
+
+// startConsumer starts consuming and handling messages in the background.
+func (c *Client) startConsumer(cons *consumer) (string, Channel, error) {
+	c.wrapHandler(cons)
+
+	sess, err := c.session(false, 0)
+	if err != nil {
+		return "", nil, err
+	}
+
+	ch, err := c.consumerChannel(sess)
+	if err != nil {
+		return "", nil, err
+	}
+
+	msgs, closes, err := c.consume(ch, cons)
+	if err != nil {
+		return "", nil, err
+	}
+
+	c.mu.Lock()
+	c.consumers[cons.ctag] = cons
+	c.mu.Unlock()
+
+	go c.run(cons, msgs, closes)
+
+	cons.logger.Debug("Handler waiting for messages")
+	return cons.ctag, ch, nil
+}
+
+// consumerChannel opens a channel for a consumer in the session. Every
+// consumer has its own, so a channel error, like acking a delivery twice, only
+// affects that consumer.
+func (c *Client) consumerChannel(sess *session) (Channel, error) {
+	ch, err := sess.conn.Channel()
+	if err != nil {
+		return nil, newError(ErrConnection, "Failed to open RabbitMQ channel", err)
+	}
+	return ch, nil
+}
+
+// consume declares the exchange and queue of the consumer, binds them and
+// starts consuming on the given channel. The returned error channel receives
+// an error if the channel dies. The channel is closed when consuming fails.
+func (c *Client) consume(ch Channel, cons *consumer) (msgs <-chan amqp.Delivery, closes chan *amqp.Error, err error) {
+	defer func() {
+		if err != nil {
+			ch.Close()
+		}
+	}()
+
+	c.setupMu.Lock()
+	defer c.setupMu.Unlock()
+
+	// What the topology declared may be of another type or have arguments,
+	// so only make sure that it exists.
+	if cons.topology.hasExchange(cons.exchangeName) {
+		err = ch.ExchangeDeclarePassive(cons.exchangeName, "", false, false, false, false, nil)
+	} else {
+		err = ch.ExchangeDeclare(
+			cons.exchangeName,
+			"topic", // type
+			true,    // durable
+			false,   // auto-deleted
+			false,   // internal
+			false,   // no-wait
+			nil,     // arguments
+		)
+	}
+	if err != nil {
+		return nil, nil, newError(ErrDeclare, "Failed to declare RabbitMQ exchange", err)
+	}
+
+	if cons.topology.hasQueue(cons.queueName) {
+		_, err = ch.QueueDeclarePassive(cons.queueName, false, false, false, false, nil)
+	} else {
+		_, err = ch.QueueDeclare(
+			cons.queueName, // name
+			true,           // durable
+			false,          // delete when unused
+			false,          // exclusive
+			false,          // no-wait
+			nil,            // arguments
+		)
+	}
+	if err != nil {
+		return nil, nil, newError(ErrDeclare, "Failed to declare RabbitMQ queue", err)
+	}
+
+	if !cons.topology.hasBinding(cons.exchangeName, cons.queueName, cons.routingKey) {
+		err = ch.QueueBind(cons.queueName, cons.routingKey, cons.exchangeName, false, nil)
+		if err != nil {
+			return nil, nil, newError(ErrDeclare, "Failed to bind RabbitMQ queue", err)
+		}
+	}
+
+	// Buffered, so the channel can report its death before it closes the
+	// deliveries without waiting for the consumer.
+	closes = ch.NotifyClose(make(chan *amqp.Error, 1))
+
+	// Stop must either see the new channel or stop the consumer before it
+	// starts consuming.
+	cons.mu.Lock()
+	defer cons.mu.Unlock()
+
+	if cons.stopping {
+		return nil, nil, errConsumerStopped
+	}
+
+	// XXX: Changing the global parameter to true will fail on Codeship because
+	// it uses an older version of RabbitMQ that does not support it. So it's
+	// set to false by default for now.
+	if err = ch.Qos(cons.prefetch, 0, false); err != nil {
+		return nil, nil, newError(ErrConsume, "Failed to set Qos on RabbitMQ channel", err)
+	}
+
+	msgs, err = ch.Consume(
+		cons.queueName, // queue
+		cons.ctag,      // consumer tag
+		false,          // auto-ack
+		false,          // exclusive
+		false,          // no-local
+		false,          // no-wait
+		nil,            // args
+	)
+	if err != nil {
+		return nil, nil, newError(ErrConsume, "Failed to register a RabbitMQ consumer", err)
+	}
+
+	cons.ch = ch
+	cons.active = true
+	return msgs, closes, nil
+}
+
+func (cons *consumer) isStopping() bool {
+	cons.mu.Lock()
+	defer cons.mu.Unlock()
+	return cons.stopping
+}
+
+// run handles deliveries until the consumer is cancelled. When the channel
+// dies, it consumes again on a new one, after the client reconnected if the
+// connection was lost.
+func (c *Client) run(cons *consumer, msgs <-chan amqp.Delivery, closes chan *amqp.Error) {
+	defer func() {
+		c.mu.Lock()
+		delete(c.consumers, cons.ctag)
+		c.mu.Unlock()
+
+		cons.mu.Lock()
+		cons.ch.Close()
+		cons.mu.Unlock()
+
+		cons.cancel()
+		close(cons.done)
+	}()
+
+	for {
+		c.dispatch(cons, msgs)
+
+		if cons.isStopping() {
+			cons.logger.Info("AMQP consumer was stopped")
+			return
+		}
+
+		// Close closes the connection without an error too, that is not a
+		// cancel.
+		if c.isClosed() {
+			cons.logger.Info("AMQP consumer was stopped, the client was closed")
+			return
+		}
+
+		// The channel reports an error before it closes the deliveries, so if
+		// there is none, the consumer was cancelled.
+		var err *amqp.Error
+		select {
+		case err = <-closes:
+		default:
+		}
+
+		if err == nil {
+			cons.logger.Info("AMQP consumer was cancelled")
+			c.recordCancel()
+			c.onCancel()
+			return
+		}
+
+		cons.logger.Warnf("AMQP consumer lost its channel: %s", err)
+		cons.mu.Lock()
+		cons.active = false
+		cons.mu.Unlock()
+		if msgs, closes = c.resume(cons); msgs == nil {
+			return
+		}
+		cons.logger.Info("AMQP consumer registered again")
+	}
+}
+
+// resume consumes on a new channel in the current session, or the next one
+// if the connection was lost. It returns nil if the client was closed or the
+// consumer was stopped in the meantime.
+func (c *Client) resume(cons *consumer) (<-chan amqp.Delivery, chan *amqp.Error) {
+	for {
+		sess, err := c.waitSession(false, nil, cons.stopped)
+		if err != nil {
+			return nil, nil
+		}
+
+		var msgs <-chan amqp.Delivery
+		var closes chan *amqp.Error
+		ch, err := c.consumerChannel(sess)
+		if err == nil {
+			msgs, closes, err = c.consume(ch, cons)
+		}
+		if err == nil {
+			return msgs, closes
+		}
+		if err == errConsumerStopped {
+			return nil, nil
+		}
+		cons.logger.Errorf("Could not register AMQP consumer again: %s", err)
+		c.recordError(err)
+
+		// Most errors close the channel, but don't spin if this one did not.
+		select {
+		case <-sess.closed:
+		case <-cons.stopped:
+		case <-time.After(c.opts.ReconnectDelay):
+		}
+	}
+}
+
+func (c *Client) deliver(cons *consumer, msg amqp.Delivery) {
+	if cons.relay {
+		c.relay(cons, msg)
+		return
+	}
+
+	start := time.Now()
+	if isDuplicate(cons, msg) {
+		cons.logger.WithField("messageId", msg.MessageId).Info("Skipping duplicate message")
+		c.settle(cons, msg, nil)
+		c.consumed(cons, msg, ResultDuplicate, nil, start)
+		return
+	}
+
+	handlerMsg, err := cons.decode(msg)
+
+	// An error when unmarshalling the JSON is not something we can
+	// retry. Move the message aside, so it can be replayed once the consumer
+	// understands it.
+	if err != nil {
+		err = c.invalid(cons, msg, err)
+		c.settle(cons, msg, err)
+		c.consumed(cons, msg, ResultInvalid, err, start)
+		return
+	}
+
+	// Run the handler
+	ctx, span := c.handlerContext(cons, msg)
+	err = cons.handle(ctx, handlerMsg, msg)
+	span.End(err)
+	if err != nil {
+		cons.logger.Errorf("Error while processing message: %s", err)
+		result, err := c.retryOrPark(cons, msg, err)
+		c.settle(cons, msg, err)
+		c.consumed(cons, msg, result, err, start)
+		return
+	}
+
+	handled(cons, msg)
+	c.settle(cons, msg, nil)
+	c.consumed(cons, msg, ResultHandled, nil, start)
+}
+
+// settle acks the message. If a failed message could not be handed over to
+// the retry or parking queue, it is requeued instead so it is not lost. So
+// are messages that the handler asked to requeue.
+func (c *Client) settle(cons *consumer, msg amqp.Delivery, err error) {
+	if err != nil {
+		if isRequeue(err) {
+			cons.logger.Infof("Requeueing message: %s", err)
+		} else {
+			cons.logger.Errorf("Could not hand over failed message, requeueing it: %s", err)
+		}
+		if err = msg.Nack(false, true); err != nil {
+			cons.logger.Errorf("Could not nack message: %s", err)
+		}
+		return
+	}
+
+	// Ack the message
+	if err = msg.Ack(false); err != nil {
+		cons.logger.Errorf("Could not ack message: %s", err)
+	}
+}
@@ -0,0 +1,87 @@
+package amqp_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/getconversio/go-utils/services/amqp"
+	streadway "github.com/streadway/amqp"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBrokerHandleFunc(t *testing.T) {
+	broker, c := newBroker(nil)
+	defer c.Close()
+
+	received := make(chan int)
+	c.HandleFunc("test.queue", "test", "test.#", new(testMsg), func(msg interface{}, headers streadway.Table) error {
+		received <- msg.(*testMsg).I
+		return nil
+	})
+
+	require.NoError(t, c.Publish("test", "test.routing", testMsg{1}))
+	assert.Equal(t, 1, receive(t, broker, received))
+
+	msg := broker.ExpectPublished(t, "test", "test.routing")
+	assert.Equal(t, "application/json", msg.ContentType)
+	assert.JSONEq(t, `{"i":1}`, string(msg.Body))
+}
+
+func TestBrokerErrors(t *testing.T) {
+	broker, c := newBroker(nil)
+	defer c.Close()
+
+	err := c.Publish("test", "test.routing", make(chan int))
+	assert.True(t, amqp.IsKind(err, amqp.ErrEncode))
+
+	require.NoError(t, c.EnsureExchange("test.errors"))
+
+	// The exchange already exists with another type.
+	ch, err := broker.Dial("")
+	require.NoError(t, err)
+	raw, err := ch.Channel()
+	require.NoError(t, err)
+	err = raw.ExchangeDeclare("test.fanout", "fanout", true, false, false, false, nil)
+	require.NoError(t, err)
+
+	_, _, err = c.HandleFunc("test.queue", "test.fanout", "test.routing", new(testMsg), nil)
+	assert.True(t, amqp.IsKind(err, amqp.ErrDeclare))
+}
+
+func TestBrokerConsumerChannels(t *testing.T) {
+	broker, c := newBroker(&amqp.Options{ReconnectDelay: 10 * time.Millisecond})
+	defer c.Close()
+
+	first := make(chan int)
+	c.HandleContext("test.first", "test", "test.first", new(testMsg), func(ctx context.Context, msg interface{}, d streadway.Delivery) error {
+		i := msg.(*testMsg).I
+		if i == 1 {
+			// The client acks it again, which closes the channel.
+			d.Ack(false)
+		}
+		first <- i
+		return nil
+	})
+
+	second := make(chan int)
+	_, ch, err := c.HandleFunc("test.second", "test", "test.second", new(testMsg), func(msg interface{}, headers streadway.Table) error {
+		second <- msg.(*testMsg).I
+		return nil
+	})
+	require.NoError(t, err)
+
+	require.NoError(t, c.Publish("test", "test.first", testMsg{1}))
+	assert.Equal(t, 1, receive(t, broker, first))
+
+	// The first consumer comes back on a new channel, the second one keeps
+	// its channel.
+	require.NoError(t, c.Publish("test", "test.first", testMsg{2}))
+	assert.Equal(t, 2, receive(t, broker, first))
+
+	_, err = ch.QueueInspect("test.second")
+	require.NoError(t, err)
+	require.NoError(t, c.Publish("test", "test.second", testMsg{3}))
+	assert.Equal(t, 3, receive(t, broker, second))
+}
@@ -0,0 +1,100 @@
+package amqp
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"time"
+
+	"github.com/streadway/amqp"
+)
+
+// DedupStore remembers which messages were handled, so that duplicates can be
+// skipped. See WithDeduplication.
+type DedupStore interface {
+	// Contains reports whether the ID was added and has not expired yet.
+	Contains(id string) (bool, error)
+
+	// Add remembers the ID for the given window.
+	Add(id string, window time.Duration) error
+}
+
+// WithDeduplication makes the consumer skip messages whose ID it handled
+// successfully within the window. The IDs are kept in the store, per queue.
+// Duplicates are acked without calling the handler, and messages without an
+// ID are always handled.
+//
+// Messages published by the client get an ID, and keep it when they are
+// retried. Duplicates that arrive while the first one is still being handled
+// are not caught, nor are duplicates when the store fails, which is logged.
+//
+// It does not apply to batch consumers.
+func WithDeduplication(store DedupStore, window time.Duration) ConsumerOption {
+	return func(cons *consumer) {
+		cons.dedup = store
+		cons.dedupWindow = window
+	}
+}
+
+type messageIDKey struct{}
+
+// WithMessageID returns a copy of ctx with the message ID, which
+// PublishContext gives the message instead of a new one. Use it to publish a
+// message again after an error, so that consumers can tell it is a duplicate.
+func WithMessageID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, messageIDKey{}, id)
+}
+
+func messageIDFrom(ctx context.Context) string {
+	id, _ := ctx.Value(messageIDKey{}).(string)
+	return id
+}
+
+// randRead fills message IDs, tests replace it to make it fail.
+var randRead = rand.Read
+
+// newMessageID returns a random ID for a published message.
+func newMessageID() (string, error) {
+	b := make([]byte, 16)
+	if _, err := randRead(b); err != nil {
+		return "", fmt.Errorf("amqp: could not generate a message ID: %s", err)
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// dedupKey returns the key of the message in the consumer's dedup store, or
+// an empty string if it can't be deduplicated.
+func dedupKey(cons *consumer, msg amqp.Delivery) string {
+	if cons.dedup == nil || msg.MessageId == "" {
+		return ""
+	}
+	return cons.queueName + "/" + msg.MessageId
+}
+
+// isDuplicate reports whether the consumer already handled the message.
+func isDuplicate(cons *consumer, msg amqp.Delivery) bool {
+	key := dedupKey(cons, msg)
+	if key == "" {
+		return false
+	}
+
+	seen, err := cons.dedup.Contains(key)
+	if err != nil {
+		cons.logger.Errorf("Could not look up message in the dedup store: %s", err)
+		return false
+	}
+	return seen
+}
+
+// handled remembers that the consumer handled the message.
+func handled(cons *consumer, msg amqp.Delivery) {
+	key := dedupKey(cons, msg)
+	if key == "" {
+		return
+	}
+
+	if err := cons.dedup.Add(key, cons.dedupWindow); err != nil {
+		cons.logger.Errorf("Could not add message to the dedup store: %s", err)
+	}
+}
@@ -0,0 +1,45 @@
+package amqp_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/getconversio/go-utils/services/amqp"
+	streadway "github.com/streadway/amqp"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBrokerDeduplication(t *testing.T) {
+	broker, c := newBroker(nil)
+	defer c.Close()
+	require.NoError(t, c.EnsureRetryConsumer())
+
+	store, err := amqp.NewLRUDedupStore(100)
+	require.NoError(t, err)
+
+	attempts := 0
+	received := make(chan int)
+	c.HandleFunc("test.queue", "test", "test.routing", new(testMsg), func(msg interface{}, headers streadway.Table) error {
+		attempts++
+		if attempts == 1 {
+			return errors.New("not yet")
+		}
+		received <- msg.(*testMsg).I
+		return nil
+	}, amqp.WithDeduplication(store, time.Hour))
+
+	// The first message is retried, which is not a duplicate.
+	ctx := amqp.WithMessageID(context.Background(), "1")
+	require.NoError(t, c.PublishContext(ctx, "test", "test.routing", testMsg{1}))
+	assert.Equal(t, 1, receive(t, broker, received))
+
+	// Publishing it again is.
+	require.NoError(t, c.PublishContext(ctx, "test", "test.routing", testMsg{1}))
+	require.NoError(t, c.Publish("test", "test.routing", testMsg{2}))
+	assert.Equal(t, 2, receive(t, broker, received))
+	assert.Equal(t, 3, attempts)
+	assert.Equal(t, 0, broker.QueueLength("test.queue"))
+}
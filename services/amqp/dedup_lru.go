@@ -0,0 +1,42 @@
+package amqp
+
+import (
+	"time"
+
+	"github.com/hashicorp/golang-lru"
+)
+
+// LRUDedupStore is an in-memory DedupStore. It only catches duplicates that
+// are delivered to the same process, and forgets the least recently used IDs
+// when it is full.
+type LRUDedupStore struct {
+	lru *lru.ARCCache
+}
+
+// NewLRUDedupStore creates an LRU dedup store that holds up to size IDs.
+func NewLRUDedupStore(size int) (*LRUDedupStore, error) {
+	cache, err := lru.NewARC(size)
+	if err != nil {
+		return nil, err
+	}
+	return &LRUDedupStore{lru: cache}, nil
+}
+
+// Contains implements DedupStore.
+func (store *LRUDedupStore) Contains(id string) (bool, error) {
+	expires, ok := store.lru.Get(id)
+	if !ok {
+		return false, nil
+	}
+	if time.Now().After(expires.(time.Time)) {
+		store.lru.Remove(id)
+		return false, nil
+	}
+	return true, nil
+}
+
+// Add implements DedupStore.
+func (store *LRUDedupStore) Add(id string, window time.Duration) error {
+	store.lru.Add(id, time.Now().Add(window))
+	return nil
+}
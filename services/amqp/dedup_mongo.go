@@ -0,0 +1,65 @@
+package amqp
+
+import (
+	"time"
+
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// MongoDedupStore is a DedupStore in MongoDB, shared by all processes that
+// consume the same queues. It uses an existing mgo session to connect to
+// MongoDB rather than setting up its own.
+type MongoDedupStore struct {
+	session *mgo.Session
+	db      string
+	coll    string
+}
+
+// NewMongoDedupStore creates a Mongo dedup store with the given target
+// database and collection, which defaults to amqp.dedup.
+func NewMongoDedupStore(session *mgo.Session, db string, collection string) *MongoDedupStore {
+	if collection == "" {
+		collection = "amqp.dedup"
+	}
+	return &MongoDedupStore{
+		session: session,
+		db:      db,
+		coll:    collection,
+	}
+}
+
+// EnsureIndex creates a TTL index that makes MongoDB delete expired IDs.
+// Without it, the collection keeps growing, though expired IDs are ignored.
+func (store *MongoDedupStore) EnsureIndex() error {
+	session := store.session.Copy()
+	defer session.Close()
+
+	return session.DB(store.db).C(store.coll).EnsureIndex(mgo.Index{
+		Key:         []string{"expiresAt"},
+		ExpireAfter: time.Second,
+	})
+}
+
+// Contains implements DedupStore.
+func (store *MongoDedupStore) Contains(id string) (bool, error) {
+	session := store.session.Copy()
+	defer session.Close()
+
+	n, err := session.DB(store.db).C(store.coll).Find(bson.M{
+		"_id":       id,
+		"expiresAt": bson.M{"$gt": time.Now()},
+	}).Count()
+	return n > 0, err
+}
+
+// Add implements DedupStore.
+func (store *MongoDedupStore) Add(id string, window time.Duration) error {
+	session := store.session.Copy()
+	defer session.Close()
+
+	_, err := session.DB(store.db).C(store.coll).UpsertId(id, bson.M{
+		"$set": bson.M{"expiresAt": time.Now().Add(window)},
+	})
+	return err
+}
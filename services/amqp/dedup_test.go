@@ -0,0 +1,97 @@
+package amqp
+
+import (
+	"errors"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/streadway/amqp"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gopkg.in/mgo.v2"
+)
+
+func TestLRUDedupStore(t *testing.T) {
+	store, err := NewLRUDedupStore(2)
+	require.NoError(t, err)
+
+	seen, err := store.Contains("a")
+	require.NoError(t, err)
+	assert.False(t, seen)
+
+	require.NoError(t, store.Add("a", time.Minute))
+	seen, _ = store.Contains("a")
+	assert.True(t, seen)
+
+	// Expired IDs are forgotten.
+	require.NoError(t, store.Add("b", -time.Second))
+	seen, _ = store.Contains("b")
+	assert.False(t, seen)
+}
+
+func TestMongoDedupStore(t *testing.T) {
+	session, err := mgo.Dial(os.Getenv("MONGODB_URL"))
+	require.NoError(t, err)
+	defer session.Close()
+	session.DB("").C("amqp.dedup").DropCollection()
+
+	store := NewMongoDedupStore(session, "", "")
+	require.NoError(t, store.EnsureIndex())
+
+	seen, err := store.Contains("a")
+	require.NoError(t, err)
+	assert.False(t, seen)
+
+	require.NoError(t, store.Add("a", time.Minute))
+	seen, err = store.Contains("a")
+	require.NoError(t, err)
+	assert.True(t, seen)
+
+	// Expired IDs are ignored, even before MongoDB deletes them.
+	require.NoError(t, store.Add("b", -time.Second))
+	seen, err = store.Contains("b")
+	require.NoError(t, err)
+	assert.False(t, seen)
+
+	// Adding an ID again extends its window.
+	require.NoError(t, store.Add("b", time.Minute))
+	seen, _ = store.Contains("b")
+	assert.True(t, seen)
+
+	cnt, err := session.DB("").C("amqp.dedup").Find(nil).Count()
+	require.NoError(t, err)
+	assert.Equal(t, 2, cnt)
+}
+
+func TestDedupKey(t *testing.T) {
+	store, _ := NewLRUDedupStore(10)
+	cons := &consumer{queueName: "test.queue"}
+	msg := amqp.Delivery{MessageId: "1"}
+
+	assert.Equal(t, "", dedupKey(cons, msg))
+	cons.dedup = store
+	assert.Equal(t, "test.queue/1", dedupKey(cons, msg))
+	assert.Equal(t, "", dedupKey(cons, amqp.Delivery{}))
+}
+
+func TestNewMessageID(t *testing.T) {
+	id, err := newMessageID()
+	require.NoError(t, err)
+	assert.Len(t, id, 32)
+
+	other, err := newMessageID()
+	require.NoError(t, err)
+	assert.NotEqual(t, id, other)
+
+	// Publishing fails instead of panicking when there is no randomness.
+	defer func(read func([]byte) (int, error)) { randRead = read }(randRead)
+	randRead = func([]byte) (int, error) { return 0, errors.New("no entropy") }
+
+	_, err = encodePublishing(JSON, msgType{1})
+	assert.Error(t, err)
+
+	c := NewClient(&Options{})
+	err = c.Publish("test", "test.routing", msgType{1})
+	assert.True(t, IsKind(err, ErrEncode))
+}
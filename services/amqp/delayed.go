@@ -0,0 +1,51 @@
+package amqp
+
+import (
+	"time"
+
+	"github.com/streadway/amqp"
+)
+
+// PublishDelayed publishes a message on the given exchange with the given
+// routing key after the delay. Use it to schedule work for later, e.g. a
+// reminder in ten minutes.
+//
+// A delay that is one of Options.RetryTTLs waits in that waiting queue. Other
+// delays are rounded like computed retry backoffs, up to whole seconds and
+// then to two significant digits, so a delay of 10 minutes and 20 seconds
+// stays 620 seconds, but one of 2 hours and 3 seconds becomes 7200 seconds.
+// The message waits in the waiting queue with exactly that TTL, e.g.
+// amqp.retry.waiting-7200, which is declared if it does not exist yet. So
+// every rounded delay gets a waiting queue of its own, next to the ones of
+// Options.RetryTTLs.
+//
+// When the delay has passed, the retry consumer publishes the message, so
+// some process must run EnsureRetryConsumer for the same broker.
+func (c *Client) PublishDelayed(exchangeName, routingKey string, msg interface{}, delay time.Duration) error {
+	if delay <= 0 {
+		return c.Publish(exchangeName, routingKey, msg)
+	}
+
+	publishing, err := encodePublishing(c.opts.Codec, msg)
+	if err != nil {
+		return newError(ErrEncode, "Failed to encode data for RabbitMQ message", err)
+	}
+
+	// The retry consumer publishes the message to where it came from.
+	publishing.Headers = amqp.Table{
+		"_exchangeName": exchangeName,
+		"_routingKey":   routingKey,
+	}
+
+	sess, err := c.session(c.opts.FailFast, c.opts.PublishTimeout)
+	if err != nil {
+		return err
+	}
+
+	waitingQueue, err := c.ensureWaitingQueue(sess, c.waitingTTL(delay, false))
+	if err != nil {
+		return err
+	}
+
+	return c.publish(c.opts.FailFast, c.opts.PublishTimeout, "", waitingQueue, publishing)
+}
@@ -0,0 +1,33 @@
+package amqp_test
+
+import (
+	"testing"
+	"time"
+
+	streadway "github.com/streadway/amqp"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBrokerPublishDelayed(t *testing.T) {
+	broker, c := newBroker(nil)
+	defer c.Close()
+
+	received := make(chan int)
+	c.HandleFunc("test.queue", "test", "test.routing", new(testMsg), func(msg interface{}, headers streadway.Table) error {
+		received <- msg.(*testMsg).I
+		return nil
+	})
+	require.NoError(t, c.EnsureRetryConsumer())
+
+	require.NoError(t, c.PublishDelayed("test", "test.routing", testMsg{1}, 10*time.Minute+20*time.Second))
+	assert.Equal(t, 1, broker.QueueLength("amqp.retry.waiting-0620"))
+	assert.Empty(t, broker.PublishedTo("test", "test.routing"))
+
+	assert.Equal(t, 1, receive(t, broker, received))
+	broker.ExpectPublished(t, "test", "test.routing")
+
+	// Without a delay, the message is published right away.
+	require.NoError(t, c.PublishDelayed("test", "test.routing", testMsg{2}, 0))
+	assert.Equal(t, 2, <-received)
+}
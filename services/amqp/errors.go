@@ -0,0 +1,70 @@
+package amqp
+
+import (
+	"errors"
+
+	"github.com/streadway/amqp"
+)
+
+// Kinds of errors returned by the client. Use IsKind, or errors.Is on Go 1.13
+// and later, to find out what went wrong:
+//
+//	if amqp.IsKind(err, amqp.ErrConnection) {
+//		// Try again later.
+//	}
+var (
+	// ErrConnection means that the client could not connect to the broker or
+	// open a channel.
+	ErrConnection = errors.New("amqp: connection failed")
+
+	// ErrDeclare means that an exchange or queue could not be declared,
+	// bound, purged or inspected.
+	ErrDeclare = errors.New("amqp: declare failed")
+
+	// ErrConsume means that a consumer could not be registered or cancelled.
+	ErrConsume = errors.New("amqp: consume failed")
+
+	// ErrEncode means that a message could not be encoded.
+	ErrEncode = errors.New("amqp: encode failed")
+)
+
+// Error is an error of one of the kinds above, along with what the client was
+// doing and the underlying error, e.g. an *amqp.Error from the broker.
+type Error struct {
+	Kind error
+	Msg  string
+	Err  error
+}
+
+func newError(kind error, msg string, err error) *Error {
+	return &Error{Kind: kind, Msg: msg, Err: err}
+}
+
+func (e *Error) Error() string {
+	return e.Msg + ": " + e.Err.Error()
+}
+
+// Unwrap returns the underlying error.
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+// Is reports whether the error is of the given kind.
+func (e *Error) Is(kind error) bool {
+	return e.Kind == kind
+}
+
+// IsNotFound reports whether err means that an exchange or queue does not
+// exist, e.g. the error of a QueueStat.
+func IsNotFound(err error) bool {
+	if e, ok := err.(*Error); ok {
+		err = e.Err
+	}
+	return isCode(err, amqp.NotFound)
+}
+
+// IsKind reports whether err is an *Error of the given kind.
+func IsKind(err error, kind error) bool {
+	e, ok := err.(*Error)
+	return ok && e.Kind == kind
+}
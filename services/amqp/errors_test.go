@@ -0,0 +1,41 @@
+package amqp
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestError(t *testing.T) {
+	cause := errors.New("boom")
+	err := newError(ErrDeclare, "Failed to declare RabbitMQ queue", cause)
+
+	assert.Equal(t, "Failed to declare RabbitMQ queue: boom", err.Error())
+	assert.Equal(t, cause, err.Unwrap())
+	assert.True(t, err.Is(ErrDeclare))
+	assert.False(t, err.Is(ErrConnection))
+
+	assert.True(t, IsKind(err, ErrDeclare))
+	assert.False(t, IsKind(err, ErrEncode))
+	assert.False(t, IsKind(cause, ErrDeclare))
+	assert.False(t, IsKind(nil, ErrDeclare))
+}
+
+func TestConnectionError(t *testing.T) {
+	c := NewClient(&Options{
+		Dial: func(url string) (Connection, error) {
+			return nil, errors.New("no broker")
+		},
+	})
+
+	err := c.EnsureQueue("test")
+	assert.True(t, IsKind(err, ErrConnection))
+	assert.Panics(t, func() { c.MustEnsureQueue("test") })
+
+	_, _, err = c.HandleFunc("test", "test", "test", new(msgType), nil)
+	assert.True(t, IsKind(err, ErrConnection))
+
+	err = c.Publish("test", "test", msgType{1})
+	assert.True(t, IsKind(err, ErrConnection))
+}
@@ -0,0 +1,195 @@
+package amqp
+
+import (
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/streadway/amqp"
+)
+
+// Health is the state of a client, see Client.Health.
+type Health struct {
+	// The client was closed and won't reconnect.
+	Closed bool `json:"closed"`
+
+	// The connection is open. The channels of the consumers are counted
+	// below.
+	Connected bool `json:"connected"`
+
+	// The broker blocked the connection because it is low on resources, see
+	// https://www.rabbitmq.com/connection-blocked.html. Publishing hangs
+	// until it is unblocked.
+	Blocked       bool   `json:"blocked"`
+	BlockedReason string `json:"blockedReason,omitempty"`
+
+	// Consumers that are consuming, consumers that lost their channel and
+	// wait to be registered again, and consumers that were cancelled by the
+	// broker, e.g. because their queue was deleted. Cancelled consumers
+	// don't come back.
+	Consumers          int `json:"consumers"`
+	WaitingConsumers   int `json:"waitingConsumers"`
+	CancelledConsumers int `json:"cancelledConsumers"`
+
+	// The last error of the connection, the consumers or a publish.
+	LastError   string    `json:"lastError,omitempty"`
+	LastErrorAt time.Time `json:"lastErrorAt"`
+
+	// When a message was last published successfully.
+	LastPublish time.Time `json:"lastPublish"`
+}
+
+// Live reports whether the client works or will once it has reconnected. It
+// is meant for liveness probes: restarting the process does not help while
+// the broker is away, but it does bring cancelled consumers back.
+func (h Health) Live() bool {
+	return !h.Closed && h.CancelledConsumers == 0
+}
+
+// Ready reports whether the client is connected and all its consumers are
+// consuming. It is meant for readiness probes.
+func (h Health) Ready() bool {
+	return h.Live() && h.Connected && !h.Blocked && h.WaitingConsumers == 0
+}
+
+// health is what the client records for Health, besides the state of its
+// session and consumers.
+type health struct {
+	mu            sync.Mutex
+	blocked       bool
+	blockedReason string
+	cancelled     int
+	lastErr       error
+	lastErrAt     time.Time
+	lastPublish   time.Time
+}
+
+// Health returns the current state of the client. It does not open the
+// connection, a client that was never used is not connected.
+func (c *Client) Health() Health {
+	c.mu.Lock()
+	h := Health{Closed: c.closed}
+	if c.sess != nil {
+		h.Connected = c.sess.isOpen()
+	}
+	consumers := make([]*consumer, 0, len(c.consumers))
+	for _, cons := range c.consumers {
+		consumers = append(consumers, cons)
+	}
+	c.mu.Unlock()
+
+	for _, cons := range consumers {
+		cons.mu.Lock()
+		if cons.active {
+			h.Consumers++
+		} else {
+			h.WaitingConsumers++
+		}
+		cons.mu.Unlock()
+	}
+
+	c.health.mu.Lock()
+	defer c.health.mu.Unlock()
+
+	h.Blocked = c.health.blocked
+	h.BlockedReason = c.health.blockedReason
+	h.CancelledConsumers = c.health.cancelled
+	if c.health.lastErr != nil {
+		h.LastError = c.health.lastErr.Error()
+		h.LastErrorAt = c.health.lastErrAt
+	}
+	h.LastPublish = c.health.lastPublish
+	return h
+}
+
+// LivenessHandler serves the client's Health as JSON, with status 200 if it
+// is live and 503 if it is not. See Health.Live.
+func (c *Client) LivenessHandler() http.Handler {
+	return healthHandler{c, Health.Live}
+}
+
+// ReadinessHandler serves the client's Health as JSON, with status 200 if it
+// is ready and 503 if it is not. See Health.Ready.
+func (c *Client) ReadinessHandler() http.Handler {
+	return healthHandler{c, Health.Ready}
+}
+
+type healthHandler struct {
+	client *Client
+	check  func(Health) bool
+}
+
+func (h healthHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	health := h.client.Health()
+
+	w.Header().Set("Content-Type", "application/json")
+	if !h.check(health) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	json.NewEncoder(w).Encode(health)
+}
+
+// recordError remembers the error for Health.
+func (c *Client) recordError(err error) {
+	c.health.mu.Lock()
+	defer c.health.mu.Unlock()
+	c.health.lastErr = err
+	c.health.lastErrAt = time.Now()
+}
+
+// recordPublish remembers the outcome of a publish for Health.
+func (c *Client) recordPublish(err error) {
+	if err != nil {
+		c.recordError(err)
+		return
+	}
+
+	c.health.mu.Lock()
+	defer c.health.mu.Unlock()
+	c.health.lastPublish = time.Now()
+}
+
+// recordCancel remembers that a consumer was cancelled for Health.
+func (c *Client) recordCancel() {
+	c.health.mu.Lock()
+	defer c.health.mu.Unlock()
+	c.health.cancelled++
+}
+
+// blocker is implemented by connections that report flow control, like
+// *amqp.Connection.
+type blocker interface {
+	NotifyBlocked(receiver chan amqp.Blocking) chan amqp.Blocking
+}
+
+// watchBlocked keeps track of whether the broker blocked the connection. A
+// new connection starts out unblocked.
+func (c *Client) watchBlocked(conn Connection) {
+	c.setBlocked(amqp.Blocking{})
+
+	b, ok := conn.(blocker)
+	if !ok {
+		return
+	}
+
+	blocks := b.NotifyBlocked(make(chan amqp.Blocking, 1))
+	go func() {
+		for block := range blocks {
+			if block.Active {
+				log.Warnf("AMQP connection blocked by the broker: %s", block.Reason)
+			} else {
+				log.Info("AMQP connection unblocked by the broker")
+			}
+			c.setBlocked(block)
+		}
+	}()
+}
+
+func (c *Client) setBlocked(block amqp.Blocking) {
+	c.health.mu.Lock()
+	defer c.health.mu.Unlock()
+	c.health.blocked = block.Active
+	c.health.blockedReason = block.Reason
+}
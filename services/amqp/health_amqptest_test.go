@@ -0,0 +1,95 @@
+package amqp_test
+
+import (
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/getconversio/go-utils/services/amqp"
+	"github.com/getconversio/go-utils/util"
+	streadway "github.com/streadway/amqp"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBrokerHealth(t *testing.T) {
+	broker, c := newBroker(&amqp.Options{ReconnectDelay: 10 * time.Millisecond})
+	defer c.Close()
+
+	// The client connects when it is first used.
+	assert.False(t, c.Health().Ready())
+	assert.True(t, c.Health().Live())
+
+	received := make(chan int)
+	c.HandleFunc("test.queue", "test", "test.routing", new(testMsg), func(msg interface{}, headers streadway.Table) error {
+		received <- msg.(*testMsg).I
+		return nil
+	})
+	require.NoError(t, c.Publish("test", "test.routing", testMsg{1}))
+	assert.Equal(t, 1, receive(t, broker, received))
+
+	h := c.Health()
+	assert.True(t, h.Ready())
+	assert.True(t, h.Connected)
+	assert.Equal(t, 1, h.Consumers)
+	assert.False(t, h.LastPublish.IsZero())
+	assert.Empty(t, h.LastError)
+
+	broker.Block("low on memory")
+	util.ValidateWithTimeout(t, func() bool {
+		return c.Health().Blocked
+	}, 1000)
+	assert.Equal(t, "low on memory", c.Health().BlockedReason)
+	assert.False(t, c.Health().Ready())
+	broker.Unblock()
+	util.ValidateWithTimeout(t, func() bool {
+		return c.Health().Ready()
+	}, 1000)
+
+	// After a reconnect, the client is ready again once the consumer is
+	// registered again.
+	broker.Disconnect()
+	util.ValidateWithTimeout(t, func() bool {
+		return c.Health().LastError != ""
+	}, 1000)
+	assert.False(t, c.Health().LastErrorAt.IsZero())
+	require.NoError(t, c.Publish("test", "test.routing", testMsg{2}))
+	assert.Equal(t, 2, receive(t, broker, received))
+	util.ValidateWithTimeout(t, func() bool {
+		return c.Health().Ready()
+	}, 1000)
+
+	// A consumer whose queue is deleted does not come back.
+	conn, err := broker.Dial("")
+	require.NoError(t, err)
+	ch, err := conn.Channel()
+	require.NoError(t, err)
+	_, err = ch.QueueDelete("test.queue", false, false, false)
+	require.NoError(t, err)
+	util.ValidateWithTimeout(t, func() bool {
+		return !c.Health().Live()
+	}, 1000)
+	assert.Equal(t, 1, c.Health().CancelledConsumers)
+	assert.Equal(t, 0, c.Health().Consumers)
+
+	rec := httptest.NewRecorder()
+	c.LivenessHandler().ServeHTTP(rec, httptest.NewRequest("GET", "/healthz", nil))
+	assert.Equal(t, 503, rec.Code)
+	assert.Contains(t, rec.Body.String(), `"cancelledConsumers":1`)
+}
+
+func TestBrokerHealthClose(t *testing.T) {
+	_, c := newBroker(nil)
+	handler := func(msg interface{}, headers streadway.Table) error {
+		return nil
+	}
+	_, _, err := c.HandleFunc("test.one", "test", "test.one", new(testMsg), handler)
+	require.NoError(t, err)
+	_, _, err = c.HandleFunc("test.two", "test", "test.two", new(testMsg), handler)
+	require.NoError(t, err)
+
+	// Closing the client stops the consumers, it doesn't cancel them.
+	require.NoError(t, c.Close())
+	time.Sleep(50 * time.Millisecond)
+	assert.Equal(t, 0, c.Health().CancelledConsumers)
+}
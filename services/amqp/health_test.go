@@ -0,0 +1,57 @@
+package amqp
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHealthChecks(t *testing.T) {
+	h := Health{Connected: true, Consumers: 2}
+	assert.True(t, h.Live())
+	assert.True(t, h.Ready())
+
+	for _, unready := range []Health{
+		{},
+		{Consumers: 2},
+		{Connected: true, Blocked: true},
+		{Connected: true, WaitingConsumers: 1},
+	} {
+		assert.True(t, unready.Live())
+		assert.False(t, unready.Ready())
+	}
+
+	for _, dead := range []Health{
+		{Connected: true, Closed: true},
+		{Connected: true, CancelledConsumers: 1},
+	} {
+		assert.False(t, dead.Live())
+		assert.False(t, dead.Ready())
+	}
+}
+
+func TestHealthHandlers(t *testing.T) {
+	c := NewClient(&Options{Dial: func(url string) (Connection, error) {
+		return nil, errors.New("no broker")
+	}})
+	defer c.Close()
+	assert.Error(t, c.EnsureExchange("test"))
+
+	rec := httptest.NewRecorder()
+	c.LivenessHandler().ServeHTTP(rec, httptest.NewRequest("GET", "/healthz", nil))
+	assert.Equal(t, 200, rec.Code)
+	assert.Equal(t, "application/json", rec.Header().Get("Content-Type"))
+
+	var h Health
+	require.NoError(t, json.NewDecoder(rec.Body).Decode(&h))
+	assert.False(t, h.Connected)
+	assert.Contains(t, h.LastError, "no broker")
+
+	rec = httptest.NewRecorder()
+	c.ReadinessHandler().ServeHTTP(rec, httptest.NewRequest("GET", "/readyz", nil))
+	assert.Equal(t, 503, rec.Code)
+}
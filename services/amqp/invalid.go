@@ -0,0 +1,98 @@
+package amqp
+
+import (
+	"fmt"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/streadway/amqp"
+)
+
+// WithInvalidQueue moves the messages that the consumer can't decode to the
+// given queue, instead of the queue's name with .invalid appended.
+func WithInvalidQueue(name string) ConsumerOption {
+	return func(cons *consumer) {
+		cons.invalidQueue = name
+	}
+}
+
+// invalidQueueName returns the queue that the consumer moves undecodable
+// messages to.
+func (cons *consumer) invalidQueueName() string {
+	if cons.invalidQueue != "" {
+		return cons.invalidQueue
+	}
+	return cons.queueName + ".invalid"
+}
+
+// ensureInvalidQueue declares the invalid queue, unless it was already
+// declared on this session.
+func (c *Client) ensureInvalidQueue(sess *session, name string) error {
+	c.setupMu.Lock()
+	defer c.setupMu.Unlock()
+
+	if sess.invalid[name] {
+		return nil
+	}
+
+	ch, err := sess.openChannel()
+	if err != nil {
+		return err
+	}
+	defer ch.Close()
+
+	_, err = ch.QueueDeclare(
+		name,  // name
+		true,  // durable
+		false, // delete when unused
+		false, // exclusive
+		false, // no-wait
+		nil,   // arguments
+	)
+	if err != nil {
+		return newError(ErrDeclare, "Failed to declare RabbitMQ queue", err)
+	}
+
+	sess.invalid[name] = true
+	return nil
+}
+
+// invalid moves a message that could not be decoded to the consumer's invalid
+// queue. Like a parked message, it keeps its original exchange and routing key
+// in the headers, and _lastError holds the decode error.
+func (c *Client) invalid(cons *consumer, msg amqp.Delivery, reason error) error {
+	cons.logger.WithField("body", fmt.Sprintf("%s", msg.Body)).Errorf("Could not unmarshal AMQP message: %s", reason)
+
+	if c.opts.OnInvalid != nil {
+		c.opts.OnInvalid(cons.queueName, msg, reason)
+	}
+
+	c.recordFailure(&msg, cons.queueName, reason)
+	msg.Headers["_invalidAt"] = time.Now().UTC().Format(time.RFC3339)
+
+	name := cons.invalidQueueName()
+	log.WithFields(log.Fields{
+		"exchange": msg.Headers["_exchangeName"],
+		"routing":  msg.Headers["_routingKey"],
+		"queue":    name,
+	}).Warn("Moving invalid AMQP message")
+
+	sess, err := c.session(false, 0)
+	if err != nil {
+		return err
+	}
+	if err = c.ensureInvalidQueue(sess, name); err != nil {
+		return err
+	}
+
+	return c.publish(false, 0, "", name, deliveryToPublishing(msg))
+}
+
+// ReplayInvalid publishes the messages in an invalid queue, e.g.
+// orders.invalid, on their original exchange and routing key again. Use it
+// once the consumer can decode them, e.g. after a rolling deploy.
+//
+// Returns the number of replayed messages.
+func (c *Client) ReplayInvalid(queueName string) (int, error) {
+	return c.replay(queueName, "")
+}
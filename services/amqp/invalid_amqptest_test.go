@@ -0,0 +1,57 @@
+package amqp_test
+
+import (
+	"testing"
+
+	"github.com/getconversio/go-utils/services/amqp"
+	"github.com/getconversio/go-utils/util"
+	streadway "github.com/streadway/amqp"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBrokerInvalid(t *testing.T) {
+	invalid := make(chan string, 10)
+	broker, c := newBroker(&amqp.Options{
+		OnInvalid: func(queueName string, d streadway.Delivery, err error) {
+			invalid <- queueName
+		},
+	})
+	defer c.Close()
+
+	c.HandleFunc("test.queue", "test", "test.routing", new(testMsg), func(msg interface{}, headers streadway.Table) error {
+		t.Error("the handler should not be called")
+		return nil
+	})
+	c.HandleFunc("test.other", "test", "test.other", new(testMsg), func(msg interface{}, headers streadway.Table) error {
+		return nil
+	}, amqp.WithInvalidQueue("test.broken"))
+
+	require.NoError(t, c.Publish("test", "test.routing", "not an object"))
+	assert.Equal(t, "test.queue", <-invalid)
+
+	msg := broker.ExpectPublished(t, "", "test.queue.invalid")
+	assert.JSONEq(t, `"not an object"`, string(msg.Body))
+	assert.Equal(t, "test.routing", msg.Headers["_routingKey"])
+	assert.Equal(t, "test.queue", msg.Headers["_queueName"])
+	assert.Contains(t, msg.Headers["_lastError"], "cannot unmarshal")
+	assert.NotEmpty(t, msg.Headers["_invalidAt"])
+	assert.Empty(t, broker.PublishedTo("", "amqp.parked"))
+
+	require.NoError(t, c.Publish("test", "test.other", "not an object"))
+	assert.Equal(t, "test.other", <-invalid)
+	broker.ExpectPublished(t, "", "test.broken")
+
+	// Replayed messages that still can't be decoded end up in the invalid
+	// queue again.
+	util.ValidateWithTimeout(t, func() bool {
+		return broker.QueueLength("test.queue.invalid") == 1
+	}, 1000)
+	replayed, err := c.ReplayInvalid("test.queue.invalid")
+	require.NoError(t, err)
+	assert.Equal(t, 1, replayed)
+	assert.Equal(t, "test.queue", <-invalid)
+	util.ValidateWithTimeout(t, func() bool {
+		return broker.QueueLength("test.queue.invalid") == 1
+	}, 1000)
+}
@@ -0,0 +1,196 @@
+package amqp
+
+import (
+	"regexp"
+	"sort"
+	"strconv"
+
+	"github.com/streadway/amqp"
+)
+
+// MessageFilter selects the messages that PeekMessages, MoveMessages,
+// RepublishMessages and PurgeMessages act on. A nil filter selects all of
+// them.
+type MessageFilter func(d amqp.Delivery) bool
+
+// RetryQueueNames returns the names of the queues of the retry ladder: the
+// ready queue, the waiting queues of Options.RetryTTLs from the shortest delay
+// to the longest and the parking queue. The waiting queues that retry policies
+// and PublishDelayed declare on demand, e.g. amqp.retry.waiting-3600, are
+// only known to the broker; FindRetryQueueNames includes them.
+func (c *Client) RetryQueueNames() []string {
+	queueNames := []string{c.opts.ReadyQueue}
+	for _, ttl := range c.opts.RetryTTLs {
+		queueNames = append(queueNames, c.waitingQueue(ttl))
+	}
+	return append(queueNames, c.opts.ParkingQueue)
+}
+
+// FindRetryQueueNames is like RetryQueueNames, but also asks the management
+// API for the waiting queues that exist on the broker, by their name prefix.
+func (c *Client) FindRetryQueueNames(management *ManagementClient) ([]string, error) {
+	prefix := c.opts.RetryQueuePrefix + "-"
+	queues, err := management.Queues("^" + regexp.QuoteMeta(prefix) + `\d+$`)
+	if err != nil {
+		return nil, err
+	}
+
+	waiting := make(map[int]string)
+	for _, ttl := range c.opts.RetryTTLs {
+		waiting[ttl] = c.waitingQueue(ttl)
+	}
+	for _, queue := range queues {
+		ttl, err := strconv.Atoi(queue.Name[len(prefix):])
+		if err != nil {
+			continue
+		}
+		// Keep the configured name if the broker has it under both.
+		if _, ok := waiting[ttl]; !ok {
+			waiting[ttl] = queue.Name
+		}
+	}
+
+	ttls := make([]int, 0, len(waiting))
+	for ttl := range waiting {
+		ttls = append(ttls, ttl)
+	}
+	sort.Ints(ttls)
+
+	queueNames := []string{c.opts.ReadyQueue}
+	for _, ttl := range ttls {
+		queueNames = append(queueNames, waiting[ttl])
+	}
+	return append(queueNames, c.opts.ParkingQueue), nil
+}
+
+// PeekMessages returns up to limit messages of the queue that pass the
+// filter, without removing them. A zero limit returns all of them. The
+// messages are put back, so their redelivered flag is set when they are
+// delivered again.
+func (c *Client) PeekMessages(queueName string, filter MessageFilter, limit int) ([]amqp.Delivery, error) {
+	var msgs []amqp.Delivery
+	_, err := c.drain(queueName, filter, limit, func(d amqp.Delivery) (bool, error) {
+		msgs = append(msgs, d)
+		return false, nil
+	})
+	return msgs, err
+}
+
+// MoveMessages moves up to limit messages that pass the filter from one queue
+// to another, with all their properties and headers. A zero limit moves all of
+// them. Returns the number of moved messages.
+//
+// The messages are published to the target queue through the default
+// exchange, which drops them if the queue doesn't exist, so it must exist
+// before anything is moved.
+func (c *Client) MoveMessages(from, to string, filter MessageFilter, limit int) (int, error) {
+	ch, err := c.openChannel()
+	if err != nil {
+		return 0, err
+	}
+	_, err = ch.QueueInspect(to)
+	ch.Close()
+	if err != nil {
+		return 0, newError(ErrDeclare, "Failed to inspect RabbitMQ queue", err)
+	}
+
+	return c.drain(from, filter, limit, func(d amqp.Delivery) (bool, error) {
+		return true, c.publish(false, 0, "", to, deliveryToPublishing(d))
+	})
+}
+
+// RepublishMessages publishes up to limit messages of a retry or parking queue
+// that pass the filter on their original exchange and routing key right away,
+// like the retry consumer does when their delay is over. A zero limit
+// republishes all of them. Messages that don't know where they came from stay
+// where they are.
+//
+// Unlike ReplayParked, it keeps the headers that count the retries. Returns
+// the number of republished messages.
+func (c *Client) RepublishMessages(queueName string, filter MessageFilter, limit int) (int, error) {
+	return c.drain(queueName, func(d amqp.Delivery) bool {
+		if _, ok := d.Headers["_exchangeName"]; !ok {
+			return false
+		}
+		return filter == nil || filter(d)
+	}, limit, func(d amqp.Delivery) (bool, error) {
+		exchangeName := headerString(d.Headers, "_exchangeName")
+		routingKey := headerString(d.Headers, "_routingKey")
+		return true, c.publish(false, 0, exchangeName, routingKey, deliveryToPublishing(d))
+	})
+}
+
+// PurgeMessages removes up to limit messages that pass the filter from the
+// queue. A zero limit removes all of them. Unlike PurgeQueue, the other
+// messages are kept. Returns the number of removed messages.
+func (c *Client) PurgeMessages(queueName string, filter MessageFilter, limit int) (int, error) {
+	return c.drain(queueName, filter, limit, func(d amqp.Delivery) (bool, error) {
+		return true, nil
+	})
+}
+
+// drain fetches the messages that are in the queue, and hands up to limit of
+// them that pass the filter to f. Messages that f takes are acked, the rest
+// are put back. Returns the number of messages that f took.
+func (c *Client) drain(queueName string, filter MessageFilter, limit int, f func(d amqp.Delivery) (bool, error)) (int, error) {
+	// Messages are fetched one by one and skipped messages are held until the
+	// end, so use a separate channel that can't disturb the consumers.
+	ch, err := c.openChannel()
+	if err != nil {
+		return 0, err
+	}
+	defer ch.Close()
+
+	queue, err := ch.QueueInspect(queueName)
+	if err != nil {
+		return 0, newError(ErrDeclare, "Failed to inspect RabbitMQ queue", err)
+	}
+
+	var skipped []amqp.Delivery
+	defer func() {
+		for _, msg := range skipped {
+			msg.Nack(false, true)
+		}
+	}()
+
+	// Only look at the messages that were there to begin with, in case the
+	// messages come back to the queue, e.g. when replayed messages fail and
+	// are parked again.
+	taken, seen := 0, 0
+	for i := 0; i < queue.Messages; i++ {
+		if limit > 0 && seen >= limit {
+			break
+		}
+
+		msg, ok, err := ch.Get(queueName, false)
+		if err != nil {
+			return taken, newError(ErrConsume, "Failed to get message from RabbitMQ queue", err)
+		}
+		if !ok {
+			break
+		}
+
+		if filter != nil && !filter(msg) {
+			skipped = append(skipped, msg)
+			continue
+		}
+		seen++
+
+		took, err := f(msg)
+		if err != nil {
+			msg.Nack(false, true)
+			return taken, err
+		}
+		if !took {
+			skipped = append(skipped, msg)
+			continue
+		}
+
+		if err = msg.Ack(false); err != nil {
+			return taken, err
+		}
+		taken++
+	}
+
+	return taken, nil
+}
@@ -0,0 +1,83 @@
+package amqp_test
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/getconversio/go-utils/services/amqp"
+	"github.com/getconversio/go-utils/util"
+	streadway "github.com/streadway/amqp"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBrokerMaintenance(t *testing.T) {
+	broker, c := newBroker(nil)
+	defer c.Close()
+
+	received := make(chan int, 10)
+	attempts := make(map[int]int)
+	c.HandleFunc("test.queue", "test", "test.#", new(testMsg), func(msg interface{}, headers streadway.Table) error {
+		i := msg.(*testMsg).I
+		attempts[i]++
+		if attempts[i] == 1 {
+			return errors.New("not yet")
+		}
+		received <- i
+		return nil
+	})
+
+	// Three failed messages wait for their first retry.
+	for i := 1; i <= 3; i++ {
+		require.NoError(t, c.Publish("test", "test.routing", testMsg{i}))
+	}
+	util.ValidateWithTimeout(t, func() bool {
+		return broker.QueueLength("amqp.retry.waiting-0001") == 3
+	}, 1000)
+
+	names := c.RetryQueueNames()
+	assert.Equal(t, "amqp.retry.ready", names[0])
+	assert.Equal(t, "amqp.retry.waiting-0001", names[1])
+	assert.Equal(t, "amqp.parked", names[len(names)-1])
+
+	msgs, err := c.PeekMessages("amqp.retry.waiting-0001", nil, 2)
+	require.NoError(t, err)
+	require.Len(t, msgs, 2)
+	assert.Equal(t, "1", msgs[0].Headers["_retryNumber"])
+	assert.Equal(t, "test.routing", msgs[0].Headers["_routingKey"])
+	assert.Equal(t, 3, broker.QueueLength("amqp.retry.waiting-0001"))
+
+	body := func(i int) amqp.MessageFilter {
+		return func(d streadway.Delivery) bool {
+			return strings.Contains(string(d.Body), fmt.Sprintf(`"i":%d`, i))
+		}
+	}
+
+	// Republishing skips the delay.
+	n, err := c.RepublishMessages("amqp.retry.waiting-0001", body(2), 0)
+	require.NoError(t, err)
+	assert.Equal(t, 1, n)
+	assert.Equal(t, 2, <-received)
+
+	n, err = c.MoveMessages("amqp.retry.waiting-0001", "amqp.parked", body(3), 0)
+	require.NoError(t, err)
+	assert.Equal(t, 1, n)
+	assert.Equal(t, 1, broker.QueueLength("amqp.parked"))
+
+	// Messages are not moved to a queue that doesn't exist, where they would
+	// be lost.
+	n, err = c.MoveMessages("amqp.retry.waiting-0001", "amqp.parkd", nil, 0)
+	assert.True(t, amqp.IsNotFound(err))
+	assert.Equal(t, 0, n)
+	assert.Equal(t, 1, broker.QueueLength("amqp.retry.waiting-0001"))
+
+	n, err = c.PurgeMessages("amqp.retry.waiting-0001", nil, 0)
+	require.NoError(t, err)
+	assert.Equal(t, 1, n)
+	assert.Equal(t, 0, broker.QueueLength("amqp.retry.waiting-0001"))
+
+	_, err = c.PeekMessages("test.missing", nil, 0)
+	assert.True(t, amqp.IsNotFound(err))
+}
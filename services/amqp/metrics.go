@@ -0,0 +1,140 @@
+package amqp
+
+import (
+	"sort"
+	"time"
+
+	"github.com/streadway/amqp"
+)
+
+// What a consumer did with a message, as reported to
+// MetricsRecorder.Consumed.
+const (
+	// The handler succeeded and the message was acked.
+	ResultHandled = "handled"
+
+	// The handler failed and the message went to the retry ladder.
+	ResultRetried = "retried"
+
+	// The message was parked, because the error was permanent or it had no
+	// retries left.
+	ResultParked = "parked"
+
+	// The message could not be decoded and was moved to the invalid queue.
+	ResultInvalid = "invalid"
+
+	// The message was nacked back to its queue, because the handler asked for
+	// it or because it could not be handed over to the retry ladder.
+	ResultRequeued = "requeued"
+
+	// The message was acked without calling the handler, because it was
+	// handled before. See WithDeduplication.
+	ResultDuplicate = "duplicate"
+)
+
+// MetricsRecorder records what a client does. Set Options.Metrics to an
+// implementation, e.g. a PrometheusMetrics. The methods are called from the
+// consumer and publisher goroutines, so they must be safe for concurrent use.
+//
+// Unlike the Metrics middleware, it sees every message, including the ones
+// that could not be decoded, and knows whether they were retried or parked.
+type MetricsRecorder interface {
+	// Consumed is called when a consumer is done with a message. took is the
+	// time it spent on it, including decoding and handing it over.
+	Consumed(queue, exchange, routingKey, result string, took time.Duration)
+
+	// Published is called when a message was published, or failed to, and
+	// confirmed if the client uses publisher confirms. Messages that the
+	// client publishes itself, like retries, are included.
+	Published(exchange, routingKey string, err error, took time.Duration)
+
+	// QueueDepth is called by ReportQueueDepths with the number of messages
+	// in a queue.
+	QueueDepth(queue string, messages int)
+}
+
+// consumed reports what the consumer did with a message. If the message could
+// not be settled as planned, it was requeued.
+func (c *Client) consumed(cons *consumer, msg amqp.Delivery, result string, err error, start time.Time) {
+	if c.opts.Metrics == nil {
+		return
+	}
+	if err != nil {
+		result = ResultRequeued
+	}
+	c.opts.Metrics.Consumed(cons.queueName, msg.Exchange, msg.RoutingKey, result, time.Since(start))
+}
+
+// observePublish reports the publish once the future is resolved.
+func (c *Client) observePublish(exchangeName, routingKey string, f *PublishFuture, start time.Time) {
+	select {
+	case <-f.Done():
+		c.published(exchangeName, routingKey, f.Err(), start)
+	default:
+		go func() {
+			<-f.Done()
+			c.published(exchangeName, routingKey, f.Err(), start)
+		}()
+	}
+}
+
+// published reports the outcome of a publish to the health and the metrics.
+func (c *Client) published(exchangeName, routingKey string, err error, start time.Time) {
+	c.recordPublish(err)
+	if c.opts.Metrics != nil {
+		c.opts.Metrics.Published(exchangeName, routingKey, err, time.Since(start))
+	}
+}
+
+// ReportQueueDepths inspects the ready queue, the parking queue, the waiting
+// queues of the retry ladder and the invalid queues and reports their depth to
+// Options.Metrics. Call it periodically, or on every scrape with
+// PrometheusMetrics.OnScrape.
+func (c *Client) ReportQueueDepths() error {
+	if c.opts.Metrics == nil {
+		return nil
+	}
+
+	sess, err := c.session(false, 0)
+	if err != nil {
+		return err
+	}
+
+	// Waiting queues for other delays may have been declared by retry
+	// policies and PublishDelayed.
+	c.setupMu.Lock()
+	ttls := make([]int, 0, len(sess.waiting))
+	for ttl := range sess.waiting {
+		ttls = append(ttls, ttl)
+	}
+	invalid := make([]string, 0, len(sess.invalid))
+	for name := range sess.invalid {
+		invalid = append(invalid, name)
+	}
+	c.setupMu.Unlock()
+	sort.Ints(ttls)
+	sort.Strings(invalid)
+
+	queueNames := []string{c.opts.ReadyQueue, c.opts.ParkingQueue}
+	for _, ttl := range ttls {
+		queueNames = append(queueNames, c.waitingQueue(ttl))
+	}
+	queueNames = append(queueNames, invalid...)
+
+	stats, err := c.QueueStats(queueNames...)
+	if err != nil {
+		return err
+	}
+
+	// Report the queues that could be inspected, and the first error.
+	for _, stat := range stats {
+		if stat.Err != nil {
+			if err == nil {
+				err = stat.Err
+			}
+			continue
+		}
+		c.opts.Metrics.QueueDepth(stat.Name, stat.Messages)
+	}
+	return err
+}
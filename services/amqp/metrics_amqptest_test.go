@@ -0,0 +1,49 @@
+package amqp_test
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/getconversio/go-utils/services/amqp"
+	"github.com/getconversio/go-utils/util"
+	streadway "github.com/streadway/amqp"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBrokerMetrics(t *testing.T) {
+	metrics := amqp.NewPrometheusMetrics()
+	_, c := newBroker(&amqp.Options{Confirm: true, Metrics: metrics})
+	defer c.Close()
+
+	received := make(chan int)
+	c.HandleFunc("test.queue", "test", "test.routing", new(testMsg), func(msg interface{}, headers streadway.Table) error {
+		received <- msg.(*testMsg).I
+		if msg.(*testMsg).I < 0 {
+			return errors.New("negative")
+		}
+		return nil
+	}, amqp.WithoutRetries())
+
+	require.NoError(t, c.Publish("test", "test.routing", testMsg{1}))
+	require.NoError(t, c.Publish("test", "test.routing", testMsg{-1}))
+	<-received
+	<-received
+
+	var out string
+	util.ValidateWithTimeout(t, func() bool {
+		require.NoError(t, c.ReportQueueDepths())
+		var b bytes.Buffer
+		metrics.WriteTo(&b)
+		out = b.String()
+		// The consumer reports the parked message once it is acked.
+		return strings.Contains(out, `amqp_queue_messages{queue="amqp.parked"} 1`) &&
+			strings.Contains(out, `amqp_consumed_total{queue="test.queue",exchange="test",routing_key="test.routing",result="parked"} 1`)
+	}, 1000)
+
+	assert.Contains(t, out, `amqp_consumed_total{queue="test.queue",exchange="test",routing_key="test.routing",result="handled"} 1`)
+	assert.Contains(t, out, `amqp_published_total{exchange="test",routing_key="test.routing",result="ok"} 2`)
+	assert.Contains(t, out, `amqp_queue_messages{queue="amqp.retry.waiting-0001"} 0`)
+}
@@ -0,0 +1,139 @@
+package amqp
+
+import (
+	"context"
+	"fmt"
+	"runtime/debug"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/streadway/amqp"
+)
+
+// Middleware wraps a handler, to do something before or after every message
+// it handles. Middlewares are given globally with Options.Middleware and
+// Client.Use, or per consumer with WithMiddleware. The first one given is the
+// outermost, and global middlewares wrap the consumer's own.
+//
+// Middlewares apply to the handlers of HandleFunc, HandleContext, Handle and
+// HandleRPC, not to batch handlers, see HandleBatch.
+type Middleware func(next Handler) Handler
+
+type queueNameKey struct{}
+
+// QueueName returns the name of the queue that the message being handled was
+// consumed from. It is meant for middlewares, which only get the handler's
+// context and the delivery.
+func QueueName(ctx context.Context) string {
+	name, _ := ctx.Value(queueNameKey{}).(string)
+	return name
+}
+
+// WithMiddleware wraps the consumer's handler in the given middlewares, inside
+// the global ones.
+func WithMiddleware(middleware ...Middleware) ConsumerOption {
+	return func(cons *consumer) {
+		cons.middleware = append(cons.middleware, middleware...)
+	}
+}
+
+// Use adds global middlewares to the client. They apply to consumers that are
+// started afterwards.
+func (c *Client) Use(middleware ...Middleware) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.middleware = append(c.middleware, middleware...)
+}
+
+// chain wraps the handler in the middlewares, the first one outermost.
+func chain(handler Handler, middleware []Middleware) Handler {
+	for i := len(middleware) - 1; i >= 0; i-- {
+		handler = middleware[i](handler)
+	}
+	return handler
+}
+
+// wrapHandler wraps the consumer's handler in the global middlewares and its
+// own.
+func (c *Client) wrapHandler(cons *consumer) {
+	if cons.handle == nil {
+		return
+	}
+
+	c.mu.Lock()
+	middleware := append([]Middleware{}, c.middleware...)
+	c.mu.Unlock()
+
+	cons.handle = chain(cons.handle, append(middleware, cons.middleware...))
+}
+
+// Recover turns a panic in the handler into an error, so the message goes to
+// the retry ladder like any other failure. Without it, a panicking handler
+// takes the whole process down.
+func Recover() Middleware {
+	return func(next Handler) Handler {
+		return func(ctx context.Context, msg interface{}, d amqp.Delivery) (err error) {
+			defer func() {
+				if r := recover(); r != nil {
+					log.WithFields(log.Fields{
+						"queue": QueueName(ctx),
+						"stack": string(debug.Stack()),
+					}).Errorf("AMQP handler panicked: %v", r)
+					err = fmt.Errorf("amqp: handler panicked: %v", r)
+				}
+			}()
+			return next(ctx, msg, d)
+		}
+	}
+}
+
+// Logging logs every message the handler is done with, along with how long it
+// took and the error if it failed.
+func Logging() Middleware {
+	return func(next Handler) Handler {
+		return func(ctx context.Context, msg interface{}, d amqp.Delivery) error {
+			start := time.Now()
+			err := next(ctx, msg, d)
+
+			logger := log.WithFields(log.Fields{
+				"queue":    QueueName(ctx),
+				"exchange": d.Exchange,
+				"routing":  d.RoutingKey,
+				"took":     time.Since(start),
+			})
+			if err != nil {
+				logger.WithError(err).Info("AMQP message failed")
+			} else {
+				logger.Info("AMQP message handled")
+			}
+			return err
+		}
+	}
+}
+
+// Timeout gives the handler a context that is cancelled after the timeout.
+// The handler has to give up when it is, the message is not retried before
+// the handler returns.
+func Timeout(timeout time.Duration) Middleware {
+	return func(next Handler) Handler {
+		return func(ctx context.Context, msg interface{}, d amqp.Delivery) error {
+			ctx, cancel := context.WithTimeout(ctx, timeout)
+			defer cancel()
+			return next(ctx, msg, d)
+		}
+	}
+}
+
+// Metrics calls observe after every message with how long the handler took
+// and its error, e.g. to update a histogram. Use QueueName to get the queue
+// from the context.
+func Metrics(observe func(ctx context.Context, d amqp.Delivery, took time.Duration, err error)) Middleware {
+	return func(next Handler) Handler {
+		return func(ctx context.Context, msg interface{}, d amqp.Delivery) error {
+			start := time.Now()
+			err := next(ctx, msg, d)
+			observe(ctx, d, time.Since(start), err)
+			return err
+		}
+	}
+}
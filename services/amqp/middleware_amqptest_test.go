@@ -0,0 +1,42 @@
+package amqp_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/getconversio/go-utils/services/amqp"
+	streadway "github.com/streadway/amqp"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBrokerMiddleware(t *testing.T) {
+	broker, c := newBroker(&amqp.Options{
+		Confirm:    true,
+		Middleware: []amqp.Middleware{amqp.Recover()},
+	})
+	defer c.Close()
+
+	queues := make(chan string, 10)
+	c.Use(amqp.Metrics(func(ctx context.Context, d streadway.Delivery, took time.Duration, err error) {
+		queues <- amqp.QueueName(ctx)
+	}))
+
+	// The panic is recovered and the message is retried.
+	received := make(chan int)
+	panicked := false
+	c.HandleFunc("test.queue", "test", "test.routing", new(testMsg), func(msg interface{}, headers streadway.Table) error {
+		if !panicked {
+			panicked = true
+			panic("oops")
+		}
+		received <- msg.(*testMsg).I
+		return nil
+	})
+	c.EnsureRetryConsumer()
+
+	require.NoError(t, c.Publish("test", "test.routing", testMsg{1}))
+	assert.Equal(t, 1, receive(t, broker, received))
+	assert.Equal(t, "test.queue", <-queues)
+}
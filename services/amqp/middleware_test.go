@@ -0,0 +1,67 @@
+package amqp
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/streadway/amqp"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestChain(t *testing.T) {
+	var calls []string
+	trace := func(name string) Middleware {
+		return func(next Handler) Handler {
+			return func(ctx context.Context, msg interface{}, d amqp.Delivery) error {
+				calls = append(calls, name)
+				return next(ctx, msg, d)
+			}
+		}
+	}
+
+	handler := chain(func(ctx context.Context, msg interface{}, d amqp.Delivery) error {
+		calls = append(calls, "handler")
+		return nil
+	}, []Middleware{trace("first"), trace("second")})
+
+	require.NoError(t, handler(context.Background(), nil, amqp.Delivery{}))
+	assert.Equal(t, []string{"first", "second", "handler"}, calls)
+}
+
+func TestRecover(t *testing.T) {
+	handler := Recover()(func(ctx context.Context, msg interface{}, d amqp.Delivery) error {
+		panic("oops")
+	})
+
+	err := handler(context.Background(), nil, amqp.Delivery{})
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "oops")
+}
+
+func TestTimeout(t *testing.T) {
+	handler := Timeout(10 * time.Millisecond)(func(ctx context.Context, msg interface{}, d amqp.Delivery) error {
+		<-ctx.Done()
+		return ctx.Err()
+	})
+
+	assert.Equal(t, context.DeadlineExceeded, handler(context.Background(), nil, amqp.Delivery{}))
+}
+
+func TestMetrics(t *testing.T) {
+	var observed error
+	var queue string
+	handler := Metrics(func(ctx context.Context, d amqp.Delivery, took time.Duration, err error) {
+		observed = err
+		queue = QueueName(ctx)
+	})(func(ctx context.Context, msg interface{}, d amqp.Delivery) error {
+		return errors.New("not good")
+	})
+
+	ctx := context.WithValue(context.Background(), queueNameKey{}, "test.queue")
+	assert.Error(t, handler(ctx, nil, amqp.Delivery{}))
+	assert.EqualError(t, observed, "not good")
+	assert.Equal(t, "test.queue", queue)
+}
@@ -0,0 +1,71 @@
+package amqp
+
+import (
+	"time"
+)
+
+// outcome is a handler error that says what should happen to the message,
+// see Permanent, RetryAfter and Requeue.
+type outcome struct {
+	err       error
+	permanent bool
+	delay     time.Duration
+	requeue   bool
+}
+
+func (o *outcome) Error() string {
+	if o.err == nil {
+		return "amqp: no reason given"
+	}
+	return o.err.Error()
+}
+
+// Unwrap returns the handler's error.
+func (o *outcome) Unwrap() error {
+	return o.err
+}
+
+// Permanent marks a handler error as one that retrying won't fix, e.g. a
+// message that fails validation. The message skips the retry ladder and is
+// parked right away.
+func Permanent(err error) error {
+	return &outcome{err: err, permanent: true}
+}
+
+// RetryAfter retries the message after the given delay instead of the one
+// the retry policy says. It still counts as an attempt, so the message is
+// parked when the policy has no attempts left.
+func RetryAfter(err error, delay time.Duration) error {
+	return &outcome{err: err, delay: delay}
+}
+
+// Requeue nacks the message back to its queue, so it is delivered again
+// right away, possibly to another consumer. It does not count as an attempt,
+// so a message that is requeued every time is never parked.
+func Requeue(err error) error {
+	return &outcome{err: err, requeue: true}
+}
+
+// outcomeOf finds the outcome in a chain of wrapped errors, e.g. when a
+// middleware wrapped the handler's error.
+func outcomeOf(err error) *outcome {
+	for err != nil {
+		if o, ok := err.(*outcome); ok {
+			return o
+		}
+
+		wrapper, ok := err.(interface {
+			Unwrap() error
+		})
+		if !ok {
+			return nil
+		}
+		err = wrapper.Unwrap()
+	}
+	return nil
+}
+
+func isRequeue(err error) bool {
+	o := outcomeOf(err)
+	return o != nil && o.requeue
+}
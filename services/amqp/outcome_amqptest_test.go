@@ -0,0 +1,54 @@
+package amqp_test
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/getconversio/go-utils/services/amqp"
+	"github.com/getconversio/go-utils/util"
+	streadway "github.com/streadway/amqp"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBrokerOutcomes(t *testing.T) {
+	broker, c := newBroker(nil)
+	defer c.Close()
+
+	received := make(chan int, 10)
+	requeued := false
+	c.HandleFunc("test.queue", "test", "test.routing", new(testMsg), func(msg interface{}, headers streadway.Table) error {
+		i := msg.(*testMsg).I
+		received <- i
+		switch {
+		case i == 1:
+			return amqp.Permanent(errors.New("invalid"))
+		case i == 2 && !requeued:
+			requeued = true
+			return amqp.Requeue(errors.New("busy"))
+		case i == 3 && headers["_retryNumber"] == nil:
+			return amqp.RetryAfter(errors.New("later"), 42*time.Second)
+		}
+		return nil
+	})
+
+	// Permanent errors are parked right away.
+	require.NoError(t, c.Publish("test", "test.routing", testMsg{1}))
+	assert.Equal(t, 1, <-received)
+	util.ValidateWithTimeout(t, func() bool {
+		return broker.QueueLength("amqp.parked") == 1
+	}, 1000)
+
+	// Requeued messages come back without a retry.
+	require.NoError(t, c.Publish("test", "test.routing", testMsg{2}))
+	assert.Equal(t, 2, <-received)
+	assert.Equal(t, 2, <-received)
+
+	// RetryAfter picks the waiting queue.
+	require.NoError(t, c.Publish("test", "test.routing", testMsg{3}))
+	assert.Equal(t, 3, <-received)
+	util.ValidateWithTimeout(t, func() bool {
+		return broker.QueueLength("amqp.retry.waiting-0042") == 1
+	}, 1000)
+}
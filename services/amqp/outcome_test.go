@@ -0,0 +1,25 @@
+package amqp
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestOutcomeOf(t *testing.T) {
+	err := errors.New("not good")
+	assert.Nil(t, outcomeOf(nil))
+	assert.Nil(t, outcomeOf(err))
+
+	assert.True(t, outcomeOf(Permanent(err)).permanent)
+	assert.Equal(t, time.Minute, outcomeOf(RetryAfter(err, time.Minute)).delay)
+	assert.True(t, isRequeue(Requeue(err)))
+	assert.Equal(t, "not good", Permanent(err).Error())
+
+	// The outcome is found when the error is wrapped.
+	wrapped := newError(ErrConsume, "Handler failed", Permanent(err))
+	assert.True(t, outcomeOf(wrapped).permanent)
+	assert.False(t, isRequeue(wrapped))
+}
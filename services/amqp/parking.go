@@ -0,0 +1,87 @@
+package amqp
+
+import (
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/streadway/amqp"
+)
+
+// Headers that describe why and where a message failed. They are removed again
+// when a parked message is replayed.
+var failureHeaders = []string{
+	"_exchangeName",
+	"_routingKey",
+	"_queueName",
+	"_retryNumber",
+	"_retryMax",
+	"_lastError",
+	"_firstFailedAt",
+	"_parkedAt",
+	"_invalidAt",
+}
+
+// recordFailure adds headers describing the failure to the message.
+func (c *Client) recordFailure(msg *amqp.Delivery, queueName string, reason error) {
+	if len(msg.Headers) == 0 {
+		msg.Headers = make(amqp.Table)
+	}
+
+	// Messages from the ready queue already carry their original exchange,
+	// routing key and queue.
+	if msg.Exchange != c.opts.RetryExchange {
+		msg.Headers["_exchangeName"] = msg.Exchange
+		msg.Headers["_routingKey"] = msg.RoutingKey
+	}
+	if queueName != "" {
+		msg.Headers["_queueName"] = queueName
+	}
+	if reason != nil {
+		msg.Headers["_lastError"] = reason.Error()
+	}
+	if _, ok := msg.Headers["_firstFailedAt"]; !ok {
+		msg.Headers["_firstFailedAt"] = time.Now().UTC().Format(time.RFC3339)
+	}
+}
+
+// park moves a message that can't be handled to the parking queue. The
+// message keeps its original exchange and routing key in the headers, so it
+// can be replayed later.
+func (c *Client) park(msg amqp.Delivery, queueName string, reason error) error {
+	c.recordFailure(&msg, queueName, reason)
+	msg.Headers["_parkedAt"] = time.Now().UTC().Format(time.RFC3339)
+
+	log.WithFields(log.Fields{
+		"exchange": msg.Headers["_exchangeName"],
+		"routing":  msg.Headers["_routingKey"],
+		"queue":    msg.Headers["_queueName"],
+	}).Warn("Parking AMQP message")
+
+	return c.publish(false, 0, "", c.opts.ParkingQueue, deliveryToPublishing(msg))
+}
+
+// ReplayParked publishes parked messages on their original exchange and
+// routing key again, as if they were new. If routingKey is not empty, only the
+// messages originally published with that routing key are replayed, the rest
+// stay in the parking queue.
+//
+// Returns the number of replayed messages.
+func (c *Client) ReplayParked(routingKey string) (int, error) {
+	return c.replay(c.opts.ParkingQueue, routingKey)
+}
+
+// replay publishes the failed messages in the queue on their original exchange
+// and routing key again, like ReplayParked.
+func (c *Client) replay(queueName, routingKey string) (int, error) {
+	return c.drain(queueName, func(d amqp.Delivery) bool {
+		return routingKey == "" || routingKey == headerString(d.Headers, "_routingKey")
+	}, 0, func(d amqp.Delivery) (bool, error) {
+		originalExchange := headerString(d.Headers, "_exchangeName")
+		originalRoutingKey := headerString(d.Headers, "_routingKey")
+
+		for _, header := range failureHeaders {
+			delete(d.Headers, header)
+		}
+		return true, c.publish(false, 0, originalExchange, originalRoutingKey, deliveryToPublishing(d))
+	})
+}
@@ -0,0 +1,38 @@
+package amqp_test
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/getconversio/go-utils/services/amqp"
+	streadway "github.com/streadway/amqp"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBrokerParkAndReplay(t *testing.T) {
+	broker, c := newBroker(nil)
+	defer c.Close()
+
+	fail := true
+	received := make(chan int)
+	c.HandleFunc("test.queue", "test", "test.routing", new(testMsg), func(msg interface{}, headers streadway.Table) error {
+		if fail {
+			fail = false
+			return errors.New("failed")
+		}
+		received <- msg.(*testMsg).I
+		return nil
+	}, amqp.WithoutRetries())
+
+	require.NoError(t, c.Publish("test", "test.routing", testMsg{3}))
+
+	parked := broker.ExpectPublished(t, "", "amqp.parked")
+	assert.Equal(t, "failed", parked.Headers["_lastError"])
+	assert.Equal(t, "test.queue", parked.Headers["_queueName"])
+
+	replayed, err := c.ReplayParked("")
+	require.NoError(t, err)
+	assert.Equal(t, 1, replayed)
+	assert.Equal(t, 3, receive(t, broker, received))
+}
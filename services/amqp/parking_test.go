@@ -0,0 +1,59 @@
+package amqp
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/getconversio/go-utils/util"
+	"github.com/streadway/amqp"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParkAndReplay(t *testing.T) {
+	setup()
+	defer teardown()
+	resetQueues(t)
+
+	fail := true
+	ctag, _ := testHandle(func(msg interface{}, headers amqp.Table) error {
+		if fail {
+			return errors.New("not good")
+		}
+		intChannel <- msg.(*msgType).I
+		return nil
+	}, WithoutRetries())
+
+	require.NoError(t, Publish("test", "test.routing", msgType{1}))
+
+	util.ValidateWithTimeout(t, func() bool {
+		queue, err := ch.QueueInspect("amqp.parked")
+		require.NoError(t, err)
+		return queue.Messages == 1
+	}, 2000)
+
+	msg, ok, err := ch.Get("amqp.parked", false)
+	require.NoError(t, err)
+	require.True(t, ok)
+	assert.Equal(t, "test", msg.Headers["_exchangeName"])
+	assert.Equal(t, "test.routing", msg.Headers["_routingKey"])
+	assert.Equal(t, "test.mctest", msg.Headers["_queueName"])
+	assert.Equal(t, "not good", msg.Headers["_lastError"])
+	assert.NotEmpty(t, msg.Headers["_parkedAt"])
+	msg.Nack(false, true)
+
+	// Nothing matches the filter
+	fail = false
+	n, err := ReplayParked("test.nothing")
+	require.NoError(t, err)
+	assert.Equal(t, 0, n)
+
+	n, err = ReplayParked("test.routing")
+	require.NoError(t, err)
+	assert.Equal(t, 1, n)
+
+	i := <-intChannel
+	assert.Equal(t, 1, i)
+
+	Stop(ctag)
+}
@@ -0,0 +1,190 @@
+package amqp
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Buckets of the latency histograms, in seconds. The same as the Prometheus
+// client's defaults.
+var prometheusBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+// PrometheusMetrics is a MetricsRecorder that serves the metrics in the
+// Prometheus text format:
+//
+//	metrics := amqp.NewPrometheusMetrics()
+//	client := amqp.NewClient(&amqp.Options{Metrics: metrics})
+//	metrics.OnScrape(func() { client.ReportQueueDepths() })
+//	http.Handle("/metrics", metrics)
+//
+// It has these metrics:
+//
+//	amqp_consumed_total{queue, exchange, routing_key, result}
+//	amqp_consume_duration_seconds{queue, exchange, routing_key}
+//	amqp_published_total{exchange, routing_key, result}
+//	amqp_publish_duration_seconds{exchange, routing_key}
+//	amqp_queue_messages{queue}
+type PrometheusMetrics struct {
+	mu        sync.Mutex
+	consumed  map[string]float64
+	consume   map[string]*histogram
+	published map[string]float64
+	publish   map[string]*histogram
+	depths    map[string]float64
+	onScrape  []func()
+}
+
+// NewPrometheusMetrics creates an empty PrometheusMetrics.
+func NewPrometheusMetrics() *PrometheusMetrics {
+	return &PrometheusMetrics{
+		consumed:  make(map[string]float64),
+		consume:   make(map[string]*histogram),
+		published: make(map[string]float64),
+		publish:   make(map[string]*histogram),
+		depths:    make(map[string]float64),
+	}
+}
+
+// OnScrape calls f before the metrics are served, e.g. to update the queue
+// depths with Client.ReportQueueDepths.
+func (m *PrometheusMetrics) OnScrape(f func()) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.onScrape = append(m.onScrape, f)
+}
+
+// Consumed implements MetricsRecorder.
+func (m *PrometheusMetrics) Consumed(queue, exchange, routingKey, result string, took time.Duration) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.consumed[labels("queue", queue, "exchange", exchange, "routing_key", routingKey, "result", result)]++
+	observe(m.consume, labels("queue", queue, "exchange", exchange, "routing_key", routingKey), took)
+}
+
+// Published implements MetricsRecorder.
+func (m *PrometheusMetrics) Published(exchange, routingKey string, err error, took time.Duration) {
+	result := "ok"
+	if err != nil {
+		result = "error"
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.published[labels("exchange", exchange, "routing_key", routingKey, "result", result)]++
+	observe(m.publish, labels("exchange", exchange, "routing_key", routingKey), took)
+}
+
+// QueueDepth implements MetricsRecorder.
+func (m *PrometheusMetrics) QueueDepth(queue string, messages int) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.depths[labels("queue", queue)] = float64(messages)
+}
+
+// ServeHTTP serves the metrics in the Prometheus text format.
+func (m *PrometheusMetrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	m.mu.Lock()
+	onScrape := m.onScrape
+	m.mu.Unlock()
+
+	for _, f := range onScrape {
+		f()
+	}
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	m.WriteTo(w)
+}
+
+// WriteTo writes the metrics in the Prometheus text format.
+func (m *PrometheusMetrics) WriteTo(w io.Writer) (int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var b bytes.Buffer
+	writeValues(&b, "amqp_consumed_total", "counter", "Messages that consumers are done with, by result.", m.consumed)
+	writeHistograms(&b, "amqp_consume_duration_seconds", "Time consumers spent on a message.", m.consume)
+	writeValues(&b, "amqp_published_total", "counter", "Published messages, by result.", m.published)
+	writeHistograms(&b, "amqp_publish_duration_seconds", "Time it took to publish a message, including the confirmation.", m.publish)
+	writeValues(&b, "amqp_queue_messages", "gauge", "Messages in the retry, waiting, parking and invalid queues.", m.depths)
+
+	return b.WriteTo(w)
+}
+
+type histogram struct {
+	counts []uint64
+	sum    float64
+	count  uint64
+}
+
+func observe(histograms map[string]*histogram, key string, took time.Duration) {
+	h := histograms[key]
+	if h == nil {
+		h = &histogram{counts: make([]uint64, len(prometheusBuckets))}
+		histograms[key] = h
+	}
+
+	seconds := took.Seconds()
+	for i, bound := range prometheusBuckets {
+		if seconds <= bound {
+			h.counts[i]++
+		}
+	}
+	h.sum += seconds
+	h.count++
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// labels renders label names and values, e.g. queue="orders".
+func labels(namesAndValues ...string) string {
+	pairs := make([]string, 0, len(namesAndValues)/2)
+	for i := 0; i+1 < len(namesAndValues); i += 2 {
+		pairs = append(pairs, namesAndValues[i]+`="`+labelEscaper.Replace(namesAndValues[i+1])+`"`)
+	}
+	return strings.Join(pairs, ",")
+}
+
+func writeValues(b *bytes.Buffer, name, kind, help string, values map[string]float64) {
+	keys := make([]string, 0, len(values))
+	for key := range values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	fmt.Fprintf(b, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+	for _, key := range keys {
+		fmt.Fprintf(b, "%s{%s} %s\n", name, key, formatFloat(values[key]))
+	}
+}
+
+func writeHistograms(b *bytes.Buffer, name, help string, histograms map[string]*histogram) {
+	keys := make([]string, 0, len(histograms))
+	for key := range histograms {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	fmt.Fprintf(b, "# HELP %s %s\n# TYPE %s histogram\n", name, help, name)
+	for _, key := range keys {
+		h := histograms[key]
+		for i, bound := range prometheusBuckets {
+			fmt.Fprintf(b, "%s_bucket{%s,le=\"%s\"} %d\n", name, key, formatFloat(bound), h.counts[i])
+		}
+		fmt.Fprintf(b, "%s_bucket{%s,le=\"+Inf\"} %d\n", name, key, h.count)
+		fmt.Fprintf(b, "%s_sum{%s} %s\n", name, key, formatFloat(h.sum))
+		fmt.Fprintf(b, "%s_count{%s} %d\n", name, key, h.count)
+	}
+}
+
+func formatFloat(f float64) string {
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
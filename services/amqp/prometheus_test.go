@@ -0,0 +1,45 @@
+package amqp
+
+import (
+	"bytes"
+	"errors"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPrometheusMetrics(t *testing.T) {
+	m := NewPrometheusMetrics()
+	m.Consumed("orders", "shop", "order.created", ResultHandled, 20*time.Millisecond)
+	m.Consumed("orders", "shop", "order.created", ResultHandled, 2*time.Second)
+	m.Consumed("orders", "shop", "order.created", ResultParked, time.Millisecond)
+	m.Published("shop", "order.created", nil, time.Millisecond)
+	m.Published("shop", "order.created", errors.New("nack"), time.Millisecond)
+	m.QueueDepth("amqp.parked", 3)
+	m.QueueDepth(`quote"d`, 1)
+
+	var b bytes.Buffer
+	_, err := m.WriteTo(&b)
+	require.NoError(t, err)
+	out := b.String()
+
+	assert.Contains(t, out, "# TYPE amqp_consumed_total counter\n")
+	assert.Contains(t, out, `amqp_consumed_total{queue="orders",exchange="shop",routing_key="order.created",result="handled"} 2`+"\n")
+	assert.Contains(t, out, `amqp_consumed_total{queue="orders",exchange="shop",routing_key="order.created",result="parked"} 1`+"\n")
+	assert.Contains(t, out, `amqp_consume_duration_seconds_bucket{queue="orders",exchange="shop",routing_key="order.created",le="0.025"} 2`+"\n")
+	assert.Contains(t, out, `amqp_consume_duration_seconds_bucket{queue="orders",exchange="shop",routing_key="order.created",le="+Inf"} 3`+"\n")
+	assert.Contains(t, out, `amqp_consume_duration_seconds_count{queue="orders",exchange="shop",routing_key="order.created"} 3`+"\n")
+	assert.Contains(t, out, `amqp_published_total{exchange="shop",routing_key="order.created",result="error"} 1`+"\n")
+	assert.Contains(t, out, `amqp_queue_messages{queue="amqp.parked"} 3`+"\n")
+	assert.Contains(t, out, `amqp_queue_messages{queue="quote\"d"} 1`+"\n")
+
+	scraped := false
+	m.OnScrape(func() { scraped = true })
+	w := httptest.NewRecorder()
+	m.ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+	assert.True(t, scraped)
+	assert.Equal(t, out, w.Body.String())
+}
@@ -0,0 +1,124 @@
+package amqp
+
+import (
+	log "github.com/sirupsen/logrus"
+	"github.com/streadway/amqp"
+)
+
+// A publisher is one of the channels in the pool that messages are published
+// on. Channels are not meant to be published on from many goroutines at once,
+// so a publisher is taken out of the pool while it is used. An error, like
+// publishing to an exchange that does not exist, closes only that channel; it
+// is replaced the next time it is taken out of the pool.
+type publisher struct {
+	ch Channel
+
+	// Set if the client uses publisher confirms.
+	confirms *confirmer
+
+	// Closed when the channel is closed.
+	closed chan struct{}
+}
+
+// newPublisherPool returns a pool with size publishers. They are opened when
+// they are first used, so clients that only consume don't open any.
+func newPublisherPool(size int) chan *publisher {
+	pool := make(chan *publisher, size)
+	for i := 0; i < size; i++ {
+		pool <- nil
+	}
+	return pool
+}
+
+// openPublisher opens a publishing channel on the connection of the session.
+// It returns amqp.ErrClosed if the connection is closed.
+func (c *Client) openPublisher(sess *session) (*publisher, error) {
+	ch, err := sess.conn.Channel()
+	if err == amqp.ErrClosed {
+		return nil, err
+	}
+	if err != nil {
+		return nil, newError(ErrConnection, "Failed to open RabbitMQ channel", err)
+	}
+
+	p := &publisher{ch: ch, closed: make(chan struct{})}
+	if c.opts.Confirm {
+		if p.confirms, err = newConfirmer(ch); err != nil {
+			ch.Close()
+			return nil, newError(ErrConnection, "Failed to put RabbitMQ channel in confirm mode", err)
+		}
+	}
+
+	closes := ch.NotifyClose(make(chan *amqp.Error, 1))
+	go func() {
+		err := <-closes
+
+		// When the connection is lost, all its channels report the error, the
+		// supervisor already takes care of it.
+		select {
+		case <-sess.closed:
+		default:
+			if err != nil {
+				log.Warnf("AMQP publishing channel closed: %s", err)
+				c.recordError(err)
+			}
+		}
+		close(p.closed)
+	}()
+	return p, nil
+}
+
+// publisher takes a publisher out of the pool of the session, opening a new
+// channel if it was not opened yet or was closed. It must be put back into
+// the pool afterwards. It returns amqp.ErrClosed if the connection is closed.
+func (c *Client) publisher(sess *session) (*publisher, error) {
+	var p *publisher
+	select {
+	case p = <-sess.publishers:
+	case <-sess.closed:
+		return nil, amqp.ErrClosed
+	}
+
+	if p != nil && p.isOpen() {
+		return p, nil
+	}
+
+	fresh, err := c.openPublisher(sess)
+	if err != nil {
+		// Keep the size of the pool.
+		sess.publishers <- p
+		return nil, err
+	}
+	return fresh, nil
+}
+
+func (p *publisher) isOpen() bool {
+	select {
+	case <-p.closed:
+		return false
+	default:
+		return true
+	}
+}
+
+// publish publishes the message on the channel. The future is resolved right
+// away, unless the client uses publisher confirms.
+func (p *publisher) publish(exchangeName, routingKey string, msg amqp.Publishing) (*PublishFuture, error) {
+	if p.confirms != nil {
+		return p.confirms.publish(exchangeName, routingKey, msg)
+	}
+
+	err := p.ch.Publish(
+		exchangeName,
+		routingKey,
+		false, // Mandatory
+		false, // Immediate
+		msg)
+	if err != nil {
+		return nil, err
+	}
+
+	f := newPublishFuture()
+	f.resolve(nil)
+	return f, nil
+}
@@ -0,0 +1,45 @@
+package amqp_test
+
+import (
+	"sync"
+	"testing"
+
+	"github.com/getconversio/go-utils/services/amqp"
+	streadway "github.com/streadway/amqp"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBrokerPublisherChannels(t *testing.T) {
+	broker, c := newBroker(&amqp.Options{Confirm: true, PublisherChannels: 4})
+	defer c.Close()
+
+	received := make(chan int, 200)
+	_, ch, err := c.HandleFunc("test.queue", "test", "test.#", new(testMsg), func(msg interface{}, headers streadway.Table) error {
+		received <- msg.(*testMsg).I
+		return nil
+	})
+	require.NoError(t, err)
+
+	// Publishing to an exchange that does not exist only closes the
+	// publishing channel, the consumer's channel survives.
+	assert.Equal(t, amqp.ErrUnconfirmed, c.Publish("test.missing", "test.routing", testMsg{0}))
+	_, err = ch.QueueInspect("test.queue")
+	require.NoError(t, err)
+
+	var wg sync.WaitGroup
+	for i := 1; i <= 200; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			assert.NoError(t, c.Publish("test", "test.routing", testMsg{i}))
+		}(i)
+	}
+	wg.Wait()
+
+	seen := make(map[int]bool)
+	for len(seen) < 200 {
+		seen[receive(t, broker, received)] = true
+	}
+	assert.Len(t, broker.PublishedTo("test", "test.routing"), 200)
+}
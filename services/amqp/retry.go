@@ -0,0 +1,342 @@
+package amqp
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"math/rand"
+	"strconv"
+	"time"
+
+	"github.com/getconversio/go-utils/util"
+	"github.com/streadway/amqp"
+)
+
+// RetryPolicy decides how many times a message is retried when its handler
+// fails, and how long it waits before each attempt.
+//
+// The delays are either given explicitly or calculated as an exponential
+// backoff. If neither is set, the client's retry ladder (Options.RetryTTLs)
+// is used.
+type RetryPolicy struct {
+	// Never retry. Failed messages are parked right away.
+	Disabled bool
+
+	// Maximum number of retries. Defaults to the number of Delays, or the
+	// length of the client's retry ladder.
+	MaxAttempts int
+
+	// Delay before each retry. If MaxAttempts is larger, the last delay is
+	// used for the remaining attempts. Each delay, in whole seconds, waits in
+	// the waiting queue with exactly that TTL.
+	Delays []time.Duration
+
+	// Exponential backoff, used when Delays is empty. The n'th retry waits
+	// InitialDelay * Multiplier^n, at most MaxDelay if that is set. Jitter is
+	// the fraction of the delay, between 0 and 1, that is randomized.
+	// Multiplier defaults to 2. The delays are rounded to two significant
+	// digits, so jittered delays share a few waiting queues.
+	InitialDelay time.Duration
+	MaxDelay     time.Duration
+	Multiplier   float64
+	Jitter       float64
+}
+
+// withDefaults fills in the client's retry ladder if the policy has no delays
+// of its own.
+func (p RetryPolicy) withDefaults(ttls []int) RetryPolicy {
+	if len(p.Delays) == 0 && p.InitialDelay == 0 {
+		for _, ttl := range ttls {
+			p.Delays = append(p.Delays, time.Duration(ttl)*time.Second)
+		}
+	}
+	if p.MaxAttempts == 0 {
+		if len(p.Delays) > 0 {
+			p.MaxAttempts = len(p.Delays)
+		} else {
+			p.MaxAttempts = len(ttls)
+		}
+	}
+	if p.Multiplier == 0 {
+		p.Multiplier = 2
+	}
+	return p
+}
+
+// delay returns how long the message waits before the given retry, counting
+// from zero. It returns false if there are no more retries.
+func (p RetryPolicy) delay(retryNumber int) (time.Duration, bool) {
+	if p.Disabled || retryNumber >= p.MaxAttempts {
+		return 0, false
+	}
+
+	if len(p.Delays) > 0 {
+		if retryNumber >= len(p.Delays) {
+			retryNumber = len(p.Delays) - 1
+		}
+		return p.Delays[retryNumber], true
+	}
+
+	d := float64(p.InitialDelay) * math.Pow(p.Multiplier, float64(retryNumber))
+	if p.MaxDelay > 0 && d > float64(p.MaxDelay) {
+		d = float64(p.MaxDelay)
+	}
+	if p.Jitter > 0 {
+		d -= d * p.Jitter * rand.Float64()
+	}
+	return time.Duration(d), true
+}
+
+// waitingSeconds rounds a delay to the TTL of the waiting queue it goes in.
+// Delays are rounded to whole seconds with two significant digits, so a
+// jittered backoff does not create an unbounded number of waiting queues.
+func waitingSeconds(d time.Duration) int {
+	s := int(math.Ceil(d.Seconds()))
+	if s < 1 {
+		return 1
+	}
+
+	unit := 1
+	for s/unit >= 100 {
+		unit *= 10
+	}
+	return (s + unit/2) / unit * unit
+}
+
+// waitingTTL returns the TTL of the waiting queue that a message waits in for
+// the delay. A delay that is one of Options.RetryTTLs, or an exact one that
+// a retry policy lists in Delays, gets the queue with that TTL. Other delays,
+// like computed backoffs, are rounded with waitingSeconds.
+func (c *Client) waitingTTL(d time.Duration, exact bool) int {
+	for _, ttl := range c.opts.RetryTTLs {
+		if time.Duration(ttl)*time.Second == d {
+			return ttl
+		}
+	}
+	if !exact {
+		return waitingSeconds(d)
+	}
+
+	if s := int(math.Ceil(d.Seconds())); s > 1 {
+		return s
+	}
+	return 1
+}
+
+// WithRetryPolicy sets the retry policy of a consumer.
+func WithRetryPolicy(policy RetryPolicy) ConsumerOption {
+	return func(cons *consumer) {
+		cons.retryPolicy = &policy
+	}
+}
+
+// WithoutRetries disables retries for a consumer.
+func WithoutRetries() ConsumerOption {
+	return WithRetryPolicy(RetryPolicy{Disabled: true})
+}
+
+// headerInt reads an integer header. The retry headers are stored as strings.
+func headerInt(headers amqp.Table, key string) (int, bool) {
+	switch v := headers[key].(type) {
+	case string:
+		i, err := strconv.Atoi(v)
+		return i, err == nil
+	case int32:
+		return int(v), true
+	case int64:
+		return int(v), true
+	}
+	return 0, false
+}
+
+func headerString(headers amqp.Table, key string) string {
+	s, _ := headers[key].(string)
+	return s
+}
+
+// waitingQueue returns the name of the waiting queue for the given TTL.
+func (c *Client) waitingQueue(ttl int) string {
+	return fmt.Sprintf(c.retryTemplate, ttl)
+}
+
+// ensureWaitingQueue declares the waiting queue for the given TTL, unless it
+// was already declared on this session.
+func (c *Client) ensureWaitingQueue(sess *session, ttl int) (string, error) {
+	name := c.waitingQueue(ttl)
+
+	c.setupMu.Lock()
+	defer c.setupMu.Unlock()
+
+	if sess.waiting[ttl] {
+		return name, nil
+	}
+
+	ch, err := sess.openChannel()
+	if err != nil {
+		return "", err
+	}
+	defer ch.Close()
+
+	if err = c.declareWaitingQueue(ch, sess, ttl); err != nil {
+		return "", err
+	}
+	return name, nil
+}
+
+// declareWaitingQueue declares the waiting queue for the given TTL on the
+// channel and remembers it on the session. The caller holds setupMu.
+func (c *Client) declareWaitingQueue(ch Channel, sess *session, ttl int) error {
+	args := make(amqp.Table)
+	args["x-dead-letter-exchange"] = c.opts.RetryExchange
+	args["x-dead-letter-routing-key"] = c.opts.RetryRoutingKey
+	args["x-message-ttl"] = int32(ttl * 1000)
+
+	_, err := ch.QueueDeclare(
+		c.waitingQueue(ttl), // name
+		true,                // durable
+		false,               // delete when unused
+		false,               // exclusive
+		false,               // no-wait
+		args,                // arguments
+	)
+	if err != nil {
+		return newError(ErrDeclare, "Failed to declare RabbitMQ queue", err)
+	}
+
+	sess.waiting[ttl] = true
+	return nil
+}
+
+// EnsureRetryConsumer starts the consumer that moves messages from the ready
+// queue back to the exchange they were originally published on. It only
+// starts one consumer per client, no matter how many times it is called.
+func (c *Client) EnsureRetryConsumer() error {
+	c.retryMu.Lock()
+	defer c.retryMu.Unlock()
+
+	if c.retryStarted {
+		return nil
+	}
+
+	cons := c.newConsumer(c.opts.ReadyQueue, c.opts.RetryExchange, c.opts.RetryRoutingKey, nil)
+	cons.relay = true
+	if _, _, err := c.startConsumer(cons); err != nil {
+		return err
+	}
+
+	c.retryStarted = true
+	return nil
+}
+
+// MustEnsureRetryConsumer is like EnsureRetryConsumer, but panics on errors.
+func (c *Client) MustEnsureRetryConsumer() {
+	util.PanicOnError("Failed to register a RabbitMQ consumer", c.EnsureRetryConsumer())
+}
+
+// errNoOrigin is the reason a message is parked with when it reaches the ready
+// queue without the exchange it was published on.
+var errNoOrigin = errors.New("amqp: message has no _exchangeName header")
+
+// relay moves a message from the ready queue back to its original exchange,
+// or parks it if it has used up its retries. A message that doesn't know its
+// exchange is parked too, publishing it on the default exchange would lose it.
+func (c *Client) relay(cons *consumer, msg amqp.Delivery) {
+	start := time.Now()
+	retryNumber, _ := headerInt(msg.Headers, "_retryNumber")
+	retryMax, ok := headerInt(msg.Headers, "_retryMax")
+	if !ok {
+		retryMax = len(c.opts.RetryTTLs)
+	}
+
+	exchangeName, hasOrigin := msg.Headers["_exchangeName"].(string)
+	routingKey := headerString(msg.Headers, "_routingKey")
+
+	var err error
+	result := ResultHandled
+	switch {
+	case !hasOrigin:
+		cons.logger.Error("Ready message without its original exchange")
+		err = c.park(msg, headerString(msg.Headers, "_queueName"), errNoOrigin)
+		result = ResultParked
+	case retryNumber > retryMax:
+		cons.logger.Error("Permanent task failure")
+		err = c.park(msg, headerString(msg.Headers, "_queueName"), nil)
+		result = ResultParked
+	default:
+		err = c.publish(false, 0, exchangeName, routingKey, deliveryToPublishing(msg))
+	}
+
+	c.settle(cons, msg, err)
+	c.consumed(cons, msg, result, err, start)
+}
+
+// deliveryToPublishing copies a delivered message, so it can be published
+// again without losing any of its properties.
+func deliveryToPublishing(msg amqp.Delivery) amqp.Publishing {
+	return amqp.Publishing{
+		Headers:         msg.Headers,
+		ContentType:     msg.ContentType,
+		ContentEncoding: msg.ContentEncoding,
+		DeliveryMode:    msg.DeliveryMode,
+		Priority:        msg.Priority,
+		CorrelationId:   msg.CorrelationId,
+		ReplyTo:         msg.ReplyTo,
+		Expiration:      msg.Expiration,
+		MessageId:       msg.MessageId,
+		Timestamp:       msg.Timestamp,
+		Type:            msg.Type,
+		UserId:          msg.UserId,
+		AppId:           msg.AppId,
+		Body:            msg.Body,
+	}
+}
+
+// retryOrPark hands a failed message over to the retry ladder, or to the
+// parking queue when the retry policy has no attempts left or the error is
+// permanent. Messages that the handler wants requeued are left to settle,
+// the error is returned as is. The result says which it was.
+func (c *Client) retryOrPark(cons *consumer, msg amqp.Delivery, reason error) (string, error) {
+	o := outcomeOf(reason)
+	if o != nil && o.requeue {
+		return ResultRequeued, reason
+	}
+	if o != nil && o.permanent {
+		return ResultParked, c.park(msg, cons.queueName, reason)
+	}
+
+	retryNumber, _ := headerInt(msg.Headers, "_retryNumber")
+
+	delay, ok := cons.retryPolicy.delay(retryNumber)
+	if !ok {
+		return ResultParked, c.park(msg, cons.queueName, reason)
+	}
+	// The delays of the policy include those of the ladder, unless it
+	// computes a backoff.
+	exact := len(cons.retryPolicy.Delays) > 0
+	if o != nil && o.delay > 0 {
+		delay, exact = o.delay, false
+	}
+
+	return ResultRetried, c.publishRetry(msg, cons.queueName, retryNumber, c.waitingTTL(delay, exact), cons.retryPolicy.MaxAttempts, reason)
+}
+
+// publishRetry puts the message in the waiting queue with the given TTL. The
+// policy is recorded on the message so the retry consumer knows when to give
+// up.
+func (c *Client) publishRetry(message amqp.Delivery, queueName string, retryNumber int, ttl int, retryMax int, reason error) error {
+	c.recordFailure(&message, queueName, reason)
+	message.Headers["_retryNumber"] = strconv.Itoa(retryNumber + 1)
+	message.Headers["_retryMax"] = strconv.Itoa(retryMax)
+
+	sess, err := c.session(false, 0)
+	if err != nil {
+		return err
+	}
+
+	waitingQueue, err := c.ensureWaitingQueue(sess, ttl)
+	if err != nil {
+		return err
+	}
+
+	return c.publish(false, 0, "", waitingQueue, deliveryToPublishing(message))
+}
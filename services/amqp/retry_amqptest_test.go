@@ -0,0 +1,76 @@
+package amqp_test
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/getconversio/go-utils/services/amqp"
+	"github.com/getconversio/go-utils/util"
+	streadway "github.com/streadway/amqp"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBrokerRetry(t *testing.T) {
+	broker, c := newBroker(nil)
+	defer c.Close()
+	require.NoError(t, c.EnsureRetryConsumer())
+
+	attempts := 0
+	received := make(chan int)
+	c.HandleFunc("test.queue", "test", "test.routing", new(testMsg), func(msg interface{}, headers streadway.Table) error {
+		attempts++
+		if attempts < 3 {
+			return errors.New("not yet")
+		}
+		received <- msg.(*testMsg).I
+		return nil
+	})
+
+	require.NoError(t, c.Publish("test", "test.routing", testMsg{2}))
+	assert.Equal(t, 2, receive(t, broker, received))
+	assert.Equal(t, 3, attempts)
+	assert.Len(t, broker.PublishedTo("", "amqp.retry.waiting-0001"), 1)
+	assert.Len(t, broker.PublishedTo("", "amqp.retry.waiting-0005"), 1)
+}
+
+func TestBrokerRetryTTLs(t *testing.T) {
+	broker, c := newBroker(&amqp.Options{Confirm: true, RetryTTLs: []int{125}})
+	defer c.Close()
+
+	fail := func(msg interface{}, headers streadway.Table) error {
+		return errors.New("not good")
+	}
+	c.HandleFunc("test.ladder", "test", "test.ladder", new(testMsg), fail)
+	c.HandleFunc("test.delays", "test", "test.delays", new(testMsg), fail,
+		amqp.WithRetryPolicy(amqp.RetryPolicy{Delays: []time.Duration{127 * time.Second}}))
+
+	// The TTLs are not rounded to 130 seconds like a computed backoff.
+	require.NoError(t, c.Publish("test", "test.ladder", testMsg{1}))
+	require.NoError(t, c.Publish("test", "test.delays", testMsg{2}))
+	util.ValidateWithTimeout(t, func() bool {
+		return broker.QueueLength("amqp.retry.waiting-0125") == 1 &&
+			broker.QueueLength("amqp.retry.waiting-0127") == 1
+	}, 1000)
+	assert.Empty(t, broker.PublishedTo("", "amqp.retry.waiting-0130"))
+
+	require.NoError(t, c.PublishDelayed("test", "test.none", testMsg{3}, 125*time.Second))
+	assert.Equal(t, 2, broker.QueueLength("amqp.retry.waiting-0125"))
+}
+
+func TestBrokerRetryWithoutOrigin(t *testing.T) {
+	broker, c := newBroker(nil)
+	defer c.Close()
+	require.NoError(t, c.EnsureRetryConsumer())
+
+	// Without its original exchange, the message would be lost on the default
+	// exchange.
+	require.NoError(t, c.Publish("", "amqp.retry.ready", testMsg{1}))
+	parked := broker.ExpectPublished(t, "", "amqp.parked")
+	assert.Equal(t, "amqp: message has no _exchangeName header", parked.Headers["_lastError"])
+	assert.Empty(t, broker.PublishedTo("", ""))
+	util.ValidateWithTimeout(t, func() bool {
+		return broker.QueueLength("amqp.parked") == 1
+	}, 1000)
+}
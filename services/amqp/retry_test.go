@@ -0,0 +1,135 @@
+package amqp
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/getconversio/go-utils/util"
+	"github.com/streadway/amqp"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRetryPolicyDelay(t *testing.T) {
+	ladder := []int{1, 5, 10, 30, 60, 300, 600}
+
+	// The client's ladder by default
+	p := RetryPolicy{}.withDefaults(ladder)
+	assert.Equal(t, 7, p.MaxAttempts)
+	d, ok := p.delay(0)
+	assert.True(t, ok)
+	assert.Equal(t, time.Second, d)
+	d, ok = p.delay(6)
+	assert.True(t, ok)
+	assert.Equal(t, 10*time.Minute, d)
+	_, ok = p.delay(7)
+	assert.False(t, ok)
+
+	// Explicit delays, reusing the last one.
+	p = RetryPolicy{MaxAttempts: 3, Delays: []time.Duration{time.Minute, time.Hour}}.withDefaults(ladder)
+	d, _ = p.delay(2)
+	assert.Equal(t, time.Hour, d)
+	_, ok = p.delay(3)
+	assert.False(t, ok)
+
+	// Exponential backoff
+	p = RetryPolicy{InitialDelay: time.Second, MaxDelay: time.Minute}.withDefaults(ladder)
+	assert.Equal(t, 7, p.MaxAttempts)
+	d, _ = p.delay(3)
+	assert.Equal(t, 8*time.Second, d)
+	d, _ = p.delay(6)
+	assert.Equal(t, time.Minute, d)
+
+	// Jitter only ever shortens the delay.
+	p = RetryPolicy{InitialDelay: time.Minute, Jitter: 0.5}.withDefaults(ladder)
+	for i := 0; i < 100; i++ {
+		d, _ = p.delay(0)
+		assert.True(t, d <= time.Minute && d >= 30*time.Second, "unexpected delay %s", d)
+	}
+
+	// Disabled
+	p = RetryPolicy{Disabled: true}.withDefaults(ladder)
+	_, ok = p.delay(0)
+	assert.False(t, ok)
+}
+
+func TestWaitingSeconds(t *testing.T) {
+	assert.Equal(t, 1, waitingSeconds(0))
+	assert.Equal(t, 1, waitingSeconds(200*time.Millisecond))
+	assert.Equal(t, 2, waitingSeconds(1500*time.Millisecond))
+	assert.Equal(t, 99, waitingSeconds(99*time.Second))
+	assert.Equal(t, 300, waitingSeconds(300*time.Second))
+	assert.Equal(t, 130, waitingSeconds(127*time.Second))
+	assert.Equal(t, 3600, waitingSeconds(time.Hour))
+	assert.Equal(t, 3700, waitingSeconds(3681*time.Second))
+}
+
+func TestWaitingTTL(t *testing.T) {
+	c := NewClient(&Options{RetryTTLs: []int{1, 125}})
+
+	// The ladder's TTLs and exact delays are not rounded.
+	assert.Equal(t, 125, c.waitingTTL(125*time.Second, false))
+	assert.Equal(t, 127, c.waitingTTL(127*time.Second, true))
+	assert.Equal(t, 2, c.waitingTTL(1500*time.Millisecond, true))
+	assert.Equal(t, 1, c.waitingTTL(0, true))
+
+	assert.Equal(t, 130, c.waitingTTL(127*time.Second, false))
+	assert.Equal(t, 3700, c.waitingTTL(3681*time.Second, false))
+}
+
+func TestHandleFuncRetryPolicy(t *testing.T) {
+	setup()
+	defer teardown()
+	resetQueues(t)
+
+	ctag, _ := testHandle(func(msg interface{}, headers amqp.Table) error {
+		return errors.New("not good")
+	}, WithRetryPolicy(RetryPolicy{Delays: []time.Duration{time.Hour}}))
+
+	err := Publish("test", "test.routing", msgType{1})
+	require.NoError(t, err)
+
+	util.ValidateWithTimeout(t, func() bool {
+		queue, err := ch.QueueInspect("amqp.retry.waiting-3600")
+		require.NoError(t, err)
+		return queue.Messages == 1
+	}, 2000)
+
+	msg, ok, err := ch.Get("amqp.retry.waiting-3600", true)
+	require.NoError(t, err)
+	require.True(t, ok)
+	assert.Equal(t, "1", msg.Headers["_retryNumber"])
+	assert.Equal(t, "1", msg.Headers["_retryMax"])
+
+	Stop(ctag)
+	ch.QueueDelete("amqp.retry.waiting-3600", false, false, false)
+}
+
+func TestHandleFuncWithoutRetries(t *testing.T) {
+	setup()
+	defer teardown()
+	resetQueues(t)
+
+	ctag, _ := testHandle(func(msg interface{}, headers amqp.Table) error {
+		intChannel <- 1
+		return errors.New("not good")
+	}, WithoutRetries())
+
+	err := Publish("test", "test.routing", msgType{1})
+	require.NoError(t, err)
+	<-intChannel
+
+	// Wait for the ack
+	util.ValidateWithTimeout(t, func() bool {
+		queue, err := ch.QueueInspect("test.mctest")
+		require.NoError(t, err)
+		return queue.Messages == 0
+	}, 2000)
+
+	queue, err := ch.QueueInspect("amqp.retry.waiting-0001")
+	require.NoError(t, err)
+	assert.Equal(t, 0, queue.Messages)
+
+	Stop(ctag)
+}
@@ -0,0 +1,277 @@
+package amqp
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/getconversio/go-utils/util"
+	"github.com/streadway/amqp"
+)
+
+// ErrNoReply is returned by Call when the reply queue went away, e.g. because
+// the connection was lost, before the reply arrived.
+var ErrNoReply = errors.New("amqp: reply queue closed before the reply arrived")
+
+// Header that HandleRPC sets on the reply when the handler failed.
+const rpcErrorHeader = "_rpcError"
+
+// RPCHandler handles a request and returns the reply. If it returns an error,
+// the caller gets a RemoteError with its message instead.
+type RPCHandler func(ctx context.Context, msg interface{}, d amqp.Delivery) (interface{}, error)
+
+// RemoteError is returned by Call when the handler on the other side failed.
+type RemoteError struct {
+	Message string
+}
+
+func (e *RemoteError) Error() string {
+	return "amqp: remote handler failed: " + e.Message
+}
+
+// Call publishes a request on the given exchange with the given routing key and
+// waits for the reply, which is decoded into resp. resp may be nil if the reply
+// is not needed.
+//
+// The reply comes back on an exclusive queue that the client declares on the
+// first call and shares between calls. Replies are matched to calls by their
+// correlation ID.
+//
+// Call waits until the context is done, or Options.CallTimeout if the context
+// has no deadline. The request expires in the broker at the same time, so a
+// server that is behind does not handle requests that nobody waits for.
+//
+// Like with PublishContext, the values in ctx are passed on to the handler and
+// the call is traced with Options.Tracer.
+func (c *Client) Call(ctx context.Context, exchangeName, routingKey string, req, resp interface{}) (err error) {
+	if _, ok := ctx.Deadline(); !ok {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, c.opts.CallTimeout)
+		defer cancel()
+	}
+	deadline, _ := ctx.Deadline()
+
+	publishing, err := encodePublishing(c.opts.Codec, req)
+	if err != nil {
+		return newError(ErrEncode, "Failed to encode data for RabbitMQ message", err)
+	}
+
+	id := strconv.FormatUint(atomic.AddUint64(&c.callSeq, 1), 10)
+	replyQueue, replies, err := c.registerCall(id)
+	if err != nil {
+		return err
+	}
+	defer c.unregisterCall(id)
+
+	ttl := time.Until(deadline)
+	if ttl < time.Millisecond {
+		return context.DeadlineExceeded
+	}
+
+	// The span lasts until the reply arrived.
+	ctx, span := c.startPublishSpan(ctx, exchangeName, routingKey, publishing)
+	defer func() { span.End(err) }()
+
+	c.inject(ctx, &publishing)
+	publishing.ReplyTo = replyQueue
+	publishing.CorrelationId = id
+	publishing.Expiration = strconv.FormatInt(int64(ttl/time.Millisecond), 10)
+
+	f := c.publishAsync(c.opts.FailFast, ttl, exchangeName, routingKey, publishing)
+	select {
+	case <-f.Done():
+		if err = f.Err(); err != nil {
+			return err
+		}
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+
+	select {
+	case reply, ok := <-replies:
+		if !ok {
+			return ErrNoReply
+		}
+		if msg, failed := reply.Headers[rpcErrorHeader]; failed {
+			return &RemoteError{Message: fmt.Sprint(msg)}
+		}
+		if resp == nil {
+			return nil
+		}
+		return decodeDelivery(reply, resp)
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// registerCall makes sure there is a reply queue and registers a call on it.
+// The returned channel receives the reply, or is closed if the reply queue
+// goes away.
+func (c *Client) registerCall(id string) (string, chan amqp.Delivery, error) {
+	c.callMu.Lock()
+	defer c.callMu.Unlock()
+
+	if c.replyQueue == "" {
+		if err := c.declareReplyQueue(); err != nil {
+			return "", nil, err
+		}
+	}
+
+	replies := make(chan amqp.Delivery, 1)
+	c.calls[id] = replies
+	return c.replyQueue, replies, nil
+}
+
+func (c *Client) unregisterCall(id string) {
+	c.callMu.Lock()
+	delete(c.calls, id)
+	c.callMu.Unlock()
+}
+
+// declareReplyQueue declares a server-named exclusive queue for replies on its
+// own channel and starts consuming from it. It must be called with callMu
+// held.
+func (c *Client) declareReplyQueue() error {
+	ch, err := c.openChannel()
+	if err != nil {
+		return err
+	}
+
+	queue, err := ch.QueueDeclare(
+		"",    // name
+		false, // durable
+		true,  // delete when unused
+		true,  // exclusive
+		false, // no-wait
+		nil,   // arguments
+	)
+	if err != nil {
+		ch.Close()
+		return newError(ErrDeclare, "Failed to declare RabbitMQ reply queue", err)
+	}
+
+	msgs, err := ch.Consume(
+		queue.Name, // queue
+		"",         // consumer tag
+		true,       // auto-ack
+		true,       // exclusive
+		false,      // no-local
+		false,      // no-wait
+		nil,        // args
+	)
+	if err != nil {
+		ch.Close()
+		return newError(ErrConsume, "Failed to consume RabbitMQ reply queue", err)
+	}
+
+	c.replyQueue = queue.Name
+	go c.receiveReplies(queue.Name, msgs)
+	return nil
+}
+
+// receiveReplies hands the replies to the calls waiting for them. When the
+// channel dies, the waiting calls fail and the next call declares a new
+// queue.
+func (c *Client) receiveReplies(queueName string, msgs <-chan amqp.Delivery) {
+	for msg := range msgs {
+		c.callMu.Lock()
+		if replies, ok := c.calls[msg.CorrelationId]; ok {
+			// Buffered, and a duplicate reply is dropped.
+			select {
+			case replies <- msg:
+			default:
+			}
+		}
+		c.callMu.Unlock()
+	}
+
+	c.callMu.Lock()
+	defer c.callMu.Unlock()
+
+	if c.replyQueue == queueName {
+		c.replyQueue = ""
+	}
+	for id, replies := range c.calls {
+		close(replies)
+		delete(c.calls, id)
+	}
+}
+
+// HandleRPC is like HandleContext, but the handler returns a reply that is
+// published to the queue that the request names in ReplyTo, with the same
+// correlation ID. Use it to serve Call.
+//
+// If the handler fails or panics, or the request can't be decoded, the caller
+// gets a RemoteError. Requests are not retried, since the caller is waiting.
+// Only requests whose reply could not be published are parked, and those
+// whose handler panicked if the Recover middleware turns the panic into an
+// error.
+func (c *Client) HandleRPC(queueName, exchangeName, routingKey string, msgCreator EmptyCreator, handler RPCHandler, options ...ConsumerOption) (string, Channel, error) {
+	options = append([]ConsumerOption{WithoutRetries()}, options...)
+	cons := c.newConsumer(queueName, exchangeName, routingKey, options)
+
+	// Decode errors are replied to as well, so the request is decoded by the
+	// handler.
+	cons.decode = func(d amqp.Delivery) (interface{}, error) {
+		return nil, nil
+	}
+	cons.handle = func(ctx context.Context, _ interface{}, d amqp.Delivery) error {
+		msg := msgCreator.NewEmpty()
+		if err := decodeDelivery(d, msg); err != nil {
+			cons.logger.WithField("body", fmt.Sprintf("%s", d.Body)).Errorf("Could not unmarshal AMQP request: %s", err)
+			return c.reply(d, nil, err)
+		}
+
+		// The panic goes on to the Recover middleware, if any, but the caller
+		// doesn't have to wait for its timeout.
+		defer func() {
+			if r := recover(); r != nil {
+				if err := c.reply(d, nil, fmt.Errorf("amqp: handler panicked: %v", r)); err != nil {
+					cons.logger.Errorf("Could not reply to AMQP request: %s", err)
+				}
+				panic(r)
+			}
+		}()
+
+		resp, err := handler(ctx, msg, d)
+		if err != nil {
+			cons.logger.Errorf("Error while processing request: %s", err)
+		}
+		return c.reply(d, resp, err)
+	}
+	return c.startConsumer(cons)
+}
+
+// MustHandleRPC is like HandleRPC, but panics on errors.
+func (c *Client) MustHandleRPC(queueName, exchangeName, routingKey string, msgCreator EmptyCreator, handler RPCHandler, options ...ConsumerOption) (string, Channel) {
+	ctag, ch, err := c.HandleRPC(queueName, exchangeName, routingKey, msgCreator, handler, options...)
+	util.PanicOnError("Failed to register a RabbitMQ consumer", err)
+	return ctag, ch
+}
+
+// reply publishes the reply to a request, encoded like the request. Requests
+// without ReplyTo don't get one.
+func (c *Client) reply(d amqp.Delivery, resp interface{}, handlerErr error) error {
+	if d.ReplyTo == "" {
+		return nil
+	}
+
+	var publishing amqp.Publishing
+	if handlerErr != nil {
+		publishing.Headers = amqp.Table{rpcErrorHeader: handlerErr.Error()}
+	} else {
+		codec, err := codecFor(d.ContentType, d.ContentEncoding)
+		if err != nil {
+			codec = c.opts.Codec
+		}
+		if publishing, err = encodePublishing(codec, resp); err != nil {
+			publishing = amqp.Publishing{Headers: amqp.Table{rpcErrorHeader: "could not encode reply: " + err.Error()}}
+		}
+	}
+	publishing.CorrelationId = d.CorrelationId
+
+	return c.publish(c.opts.FailFast, c.opts.PublishTimeout, "", d.ReplyTo, publishing)
+}
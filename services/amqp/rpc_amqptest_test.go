@@ -0,0 +1,85 @@
+package amqp_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/getconversio/go-utils/services/amqp"
+	"github.com/getconversio/go-utils/services/amqp/amqptest"
+	streadway "github.com/streadway/amqp"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBrokerRPC(t *testing.T) {
+	broker := amqptest.NewBroker()
+	server := broker.NewClient(nil)
+	defer server.Close()
+	client := broker.NewClient(nil)
+	defer client.Close()
+
+	_, _, err := server.HandleRPC("test.rpc", "test", "test.double", new(testMsg), func(ctx context.Context, msg interface{}, d streadway.Delivery) (interface{}, error) {
+		i := msg.(*testMsg).I
+		if i < 0 {
+			return nil, errors.New("negative")
+		}
+		return testMsg{2 * i}, nil
+	})
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	var resp testMsg
+	require.NoError(t, client.Call(ctx, "test", "test.double", testMsg{21}, &resp))
+	assert.Equal(t, 42, resp.I)
+
+	// Calls share the reply queue.
+	require.NoError(t, client.Call(ctx, "test", "test.double", testMsg{2}, &resp))
+	assert.Equal(t, 4, resp.I)
+
+	err = client.Call(ctx, "test", "test.double", testMsg{-1}, &resp)
+	require.IsType(t, &amqp.RemoteError{}, err)
+	assert.Equal(t, "negative", err.(*amqp.RemoteError).Message)
+
+	// Nobody handles this one.
+	short, cancelShort := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancelShort()
+	assert.Equal(t, context.DeadlineExceeded, client.Call(short, "test", "test.missing", testMsg{1}, &resp))
+
+	// The reply queue is declared again after a reconnect. A call made before
+	// the client notices fails.
+	broker.Disconnect()
+	err = client.Call(ctx, "test", "test.double", testMsg{5}, &resp)
+	if err == amqp.ErrNoReply {
+		err = client.Call(ctx, "test", "test.double", testMsg{5}, &resp)
+	}
+	require.NoError(t, err)
+	assert.Equal(t, 10, resp.I)
+}
+
+func TestBrokerRPCRecover(t *testing.T) {
+	broker := amqptest.NewBroker()
+	server := broker.NewClient(&amqp.Options{Confirm: true, Middleware: []amqp.Middleware{amqp.Recover()}})
+	defer server.Close()
+	client := broker.NewClient(nil)
+	defer client.Close()
+
+	_, _, err := server.HandleRPC("test.rpc", "test", "test.panic", new(testMsg), func(ctx context.Context, msg interface{}, d streadway.Delivery) (interface{}, error) {
+		panic("oops")
+	})
+	require.NoError(t, err)
+
+	// The caller gets the error right away instead of waiting for its
+	// timeout.
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	var resp testMsg
+	err = client.Call(ctx, "test", "test.panic", testMsg{1}, &resp)
+	require.IsType(t, &amqp.RemoteError{}, err)
+	assert.Equal(t, "amqp: handler panicked: oops", err.(*amqp.RemoteError).Message)
+	broker.ExpectPublished(t, "", "amqp.parked")
+}
@@ -0,0 +1,104 @@
+package amqp
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/getconversio/go-utils/util"
+	log "github.com/sirupsen/logrus"
+	"github.com/streadway/amqp"
+)
+
+// stop cancels the consumer on the broker. Messages that were already
+// delivered to it are still handled.
+func (c *Client) stop(cons *consumer) error {
+	cons.mu.Lock()
+	if cons.stopping {
+		cons.mu.Unlock()
+		return nil
+	}
+	cons.stopping = true
+	close(cons.stopped)
+	ch := cons.ch
+	cons.mu.Unlock()
+
+	c.setupMu.Lock()
+	defer c.setupMu.Unlock()
+
+	// If the channel is gone, the consumer is waiting for a reconnect and
+	// gives up when it sees that it was stopped.
+	if err := ch.Cancel(cons.ctag, false); err != nil && err != amqp.ErrClosed {
+		return newError(ErrConsume, "Failed to cancel RabbitMQ consumer", err)
+	}
+	return nil
+}
+
+// Stop cancels the consumer with the given ctag and waits for it to finish
+// handling and acking the messages that were already delivered to it.
+func (c *Client) Stop(ctag string) error {
+	c.mu.Lock()
+	cons := c.consumers[ctag]
+	c.mu.Unlock()
+
+	if cons == nil {
+		return fmt.Errorf("amqp: no consumer with ctag %s", ctag)
+	}
+
+	err := c.stop(cons)
+	<-cons.done
+	return err
+}
+
+// Shutdown stops all consumers, waits for their handlers to finish and closes
+// the connection. If ctx is done before the handlers finish, their contexts
+// are cancelled and the connection is closed anyway. The broker delivers the
+// unacked messages again.
+func (c *Client) Shutdown(ctx context.Context) error {
+	c.mu.Lock()
+	consumers := make([]*consumer, 0, len(c.consumers))
+	for _, cons := range c.consumers {
+		consumers = append(consumers, cons)
+	}
+	c.mu.Unlock()
+
+	var err error
+	for _, cons := range consumers {
+		if stopErr := c.stop(cons); stopErr != nil && err == nil {
+			err = stopErr
+		}
+	}
+
+	done := make(chan struct{})
+	go func() {
+		for _, cons := range consumers {
+			<-cons.done
+		}
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+
+	c.cancel()
+	if closeErr := c.Close(); closeErr != nil && err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// GracefulShutdown shuts the client down when the process is told to stop.
+// Handlers get up to timeout to finish. See util.GracefulShutdown.
+func (c *Client) GracefulShutdown(timeout time.Duration) chan bool {
+	return util.GracefulShutdown(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		defer cancel()
+
+		if err := c.Shutdown(ctx); err != nil {
+			log.Errorf("AMQP shutdown was not graceful: %s", err)
+		}
+	})
+}
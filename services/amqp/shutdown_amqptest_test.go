@@ -0,0 +1,89 @@
+package amqp_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/getconversio/go-utils/services/amqp"
+	streadway "github.com/streadway/amqp"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBrokerStop(t *testing.T) {
+	broker, c := newBroker(nil)
+	defer c.Close()
+
+	received := make(chan int)
+	ctag, _, err := c.HandleFunc("test.stop", "test", "test.stop", new(testMsg), func(msg interface{}, headers streadway.Table) error {
+		received <- msg.(*testMsg).I
+		return nil
+	})
+	require.NoError(t, err)
+
+	require.NoError(t, c.Stop(ctag))
+	assert.Error(t, c.Stop(ctag))
+
+	// The message stays in the queue.
+	require.NoError(t, c.Publish("test", "test.stop", testMsg{1}))
+	select {
+	case <-received:
+		t.Fatal("stopped consumer received a message")
+	case <-time.After(200 * time.Millisecond):
+	}
+	assert.Equal(t, 1, broker.QueueLength("test.stop"))
+}
+
+func TestBrokerShutdown(t *testing.T) {
+	broker, c := newBroker(nil)
+
+	started := make(chan bool)
+	finished := make(chan bool, 1)
+	c.HandleContext("test.queue", "test", "test.routing", new(testMsg), func(ctx context.Context, msg interface{}, d streadway.Delivery) error {
+		started <- true
+		time.Sleep(50 * time.Millisecond)
+		finished <- true
+		return ctx.Err()
+	})
+
+	require.NoError(t, c.Publish("test", "test.routing", testMsg{4}))
+	<-started
+
+	// Shutdown waits for the handler to finish.
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	require.NoError(t, c.Shutdown(ctx))
+
+	assert.Len(t, finished, 1)
+	assert.Equal(t, 0, broker.QueueLength("test.queue"))
+	assert.Equal(t, amqp.ErrClosed, c.Publish("test", "test.routing", testMsg{5}))
+}
+
+func TestBrokerShutdownTimeout(t *testing.T) {
+	_, c := newBroker(nil)
+
+	started := make(chan bool)
+	cancelled := make(chan error, 1)
+	c.HandleContext("test.queue", "test", "test.routing", new(testMsg), func(ctx context.Context, msg interface{}, d streadway.Delivery) error {
+		started <- true
+		<-ctx.Done()
+		cancelled <- ctx.Err()
+		return ctx.Err()
+	})
+
+	require.NoError(t, c.Publish("test", "test.routing", testMsg{3}))
+	<-started
+
+	// The handler never finishes on its own, so its context is cancelled.
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	assert.Equal(t, context.DeadlineExceeded, c.Shutdown(ctx))
+
+	select {
+	case err := <-cancelled:
+		assert.Equal(t, context.Canceled, err)
+	case <-time.After(time.Second):
+		t.Fatal("handler context was not cancelled")
+	}
+}
@@ -0,0 +1,53 @@
+package amqp
+
+// QueueStat is the state of a queue, see Client.QueueStats.
+type QueueStat struct {
+	Name string
+
+	// Messages that are ready to be delivered, not counting the ones that
+	// were delivered and not acked yet, and consumers of the queue.
+	Messages  int
+	Consumers int
+
+	// Why the queue could not be inspected, e.g. because it does not exist,
+	// see IsNotFound. Messages and Consumers are zero then.
+	Err error
+}
+
+// QueueStats inspects the given queues. A queue that can't be inspected gets
+// an error of its own, so a missing queue is never mistaken for an empty one.
+// The returned error is only set if the client could not talk to the broker at
+// all.
+func (c *Client) QueueStats(queueNames ...string) ([]QueueStat, error) {
+	// A missing queue closes the channel, so open another one after every
+	// failure.
+	var ch Channel
+	defer func() {
+		if ch != nil {
+			ch.Close()
+		}
+	}()
+
+	stats := make([]QueueStat, len(queueNames))
+	for i, queueName := range queueNames {
+		stats[i].Name = queueName
+
+		if ch == nil {
+			var err error
+			if ch, err = c.openChannel(); err != nil {
+				return stats, err
+			}
+		}
+
+		queue, err := ch.QueueInspect(queueName)
+		if err != nil {
+			stats[i].Err = newError(ErrDeclare, "Failed to inspect RabbitMQ queue", err)
+			ch.Close()
+			ch = nil
+			continue
+		}
+		stats[i].Messages = queue.Messages
+		stats[i].Consumers = queue.Consumers
+	}
+	return stats, nil
+}
@@ -0,0 +1,42 @@
+package amqp_test
+
+import (
+	"testing"
+
+	"github.com/getconversio/go-utils/services/amqp"
+	streadway "github.com/streadway/amqp"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBrokerQueueStats(t *testing.T) {
+	_, c := newBroker(nil)
+	defer c.Close()
+
+	c.HandleFunc("test.consumed", "test", "test.consumed", new(testMsg), func(msg interface{}, headers streadway.Table) error {
+		return nil
+	})
+	require.NoError(t, c.EnsureQueue("test.queue"))
+	require.NoError(t, c.Publish("", "test.queue", testMsg{1}))
+	require.NoError(t, c.Publish("", "test.queue", testMsg{2}))
+
+	stats, err := c.QueueStats("test.queue", "test.missing", "test.consumed")
+	require.NoError(t, err)
+	require.Len(t, stats, 3)
+
+	assert.Equal(t, amqp.QueueStat{Name: "test.queue", Messages: 2}, stats[0])
+	assert.Equal(t, "test.missing", stats[1].Name)
+	assert.True(t, amqp.IsNotFound(stats[1].Err))
+	assert.True(t, amqp.IsKind(stats[1].Err, amqp.ErrDeclare))
+	assert.Equal(t, amqp.QueueStat{Name: "test.consumed", Consumers: 1}, stats[2])
+
+	// A missing queue does not count as empty.
+	_, err = c.QueueTotalMessages([]string{"test.queue", "test.missing"})
+	assert.True(t, amqp.IsNotFound(err))
+	total, err := c.QueueTotalMessages([]string{"test.queue", "test.consumed"})
+	require.NoError(t, err)
+	assert.Equal(t, 2, total)
+
+	// The client is still connected.
+	require.NoError(t, c.Publish("", "test.queue", testMsg{3}))
+}
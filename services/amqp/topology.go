@@ -0,0 +1,420 @@
+package amqp
+
+import (
+	"fmt"
+	"io/ioutil"
+	"time"
+
+	"github.com/getconversio/go-utils/util"
+	"github.com/streadway/amqp"
+	"gopkg.in/yaml.v2"
+)
+
+// Topology describes exchanges, queues, the bindings between them and how
+// their consumers behave. It is usually loaded from a YAML or JSON file with
+// LoadTopology:
+//
+//	exchanges:
+//	  - name: orders
+//	    type: topic
+//	queues:
+//	  - name: orders.created
+//	    type: quorum
+//	    max_length: 100000
+//	    dead_letter_exchange: orders.dead
+//	bindings:
+//	  - exchange: orders
+//	    queue: orders.created
+//	    routing_key: order.created
+//	consumers:
+//	  - queue: orders.created
+//	    concurrency: 8
+//	    max_attempts: 3
+type Topology struct {
+	Exchanges []ExchangeSpec `yaml:"exchanges" json:"exchanges"`
+	Queues    []QueueSpec    `yaml:"queues" json:"queues"`
+	Bindings  []BindingSpec  `yaml:"bindings" json:"bindings"`
+	Consumers []ConsumerSpec `yaml:"consumers" json:"consumers"`
+}
+
+// ExchangeSpec describes an exchange. Exchanges are durable topic exchanges
+// unless the spec says otherwise.
+type ExchangeSpec struct {
+	Name       string                 `yaml:"name" json:"name"`
+	Type       string                 `yaml:"type" json:"type"`
+	Durable    *bool                  `yaml:"durable" json:"durable"`
+	AutoDelete bool                   `yaml:"auto_delete" json:"auto_delete"`
+	Internal   bool                   `yaml:"internal" json:"internal"`
+	Arguments  map[string]interface{} `yaml:"arguments" json:"arguments"`
+}
+
+// QueueSpec describes a queue. Queues are durable unless the spec says
+// otherwise. The most common arguments have their own fields, the rest can be
+// given in Arguments.
+type QueueSpec struct {
+	Name       string `yaml:"name" json:"name"`
+	Durable    *bool  `yaml:"durable" json:"durable"`
+	AutoDelete bool   `yaml:"auto_delete" json:"auto_delete"`
+
+	// x-queue-type, e.g. quorum.
+	Type string `yaml:"type" json:"type"`
+
+	// x-queue-mode: lazy.
+	Lazy bool `yaml:"lazy" json:"lazy"`
+
+	// x-max-length.
+	MaxLength int `yaml:"max_length" json:"max_length"`
+
+	// x-message-ttl, in milliseconds.
+	MessageTTL int `yaml:"message_ttl" json:"message_ttl"`
+
+	// x-dead-letter-exchange and x-dead-letter-routing-key.
+	DeadLetterExchange   string `yaml:"dead_letter_exchange" json:"dead_letter_exchange"`
+	DeadLetterRoutingKey string `yaml:"dead_letter_routing_key" json:"dead_letter_routing_key"`
+
+	Arguments map[string]interface{} `yaml:"arguments" json:"arguments"`
+}
+
+// BindingSpec binds a queue to an exchange.
+type BindingSpec struct {
+	Exchange   string                 `yaml:"exchange" json:"exchange"`
+	Queue      string                 `yaml:"queue" json:"queue"`
+	RoutingKey string                 `yaml:"routing_key" json:"routing_key"`
+	Arguments  map[string]interface{} `yaml:"arguments" json:"arguments"`
+}
+
+// ConsumerSpec holds the settings for the consumers of a queue. See
+// Topology.ConsumerOptions.
+type ConsumerSpec struct {
+	Queue       string `yaml:"queue" json:"queue"`
+	Concurrency int    `yaml:"concurrency" json:"concurrency"`
+	Prefetch    int    `yaml:"prefetch" json:"prefetch"`
+
+	// Retry policy. RetryDelays are in seconds, like Options.RetryTTLs.
+	DisableRetries bool  `yaml:"disable_retries" json:"disable_retries"`
+	MaxAttempts    int   `yaml:"max_attempts" json:"max_attempts"`
+	RetryDelays    []int `yaml:"retry_delays" json:"retry_delays"`
+}
+
+// TopologyDifference is an exchange or queue in a topology that is missing on
+// the broker, or that the broker has declared differently.
+type TopologyDifference struct {
+	// exchange or queue.
+	Kind string
+	Name string
+
+	// Missing is true if it is not declared. Otherwise Err is the broker's
+	// reason for not accepting the declaration.
+	Missing bool
+	Err     error
+}
+
+func (d TopologyDifference) String() string {
+	if d.Missing {
+		return fmt.Sprintf("%s %s is missing", d.Kind, d.Name)
+	}
+	return fmt.Sprintf("%s %s is declared differently: %s", d.Kind, d.Name, d.Err)
+}
+
+// LoadTopology reads a topology from a YAML or JSON file. Environment
+// variables in the file are replaced, see util.Envsubst.
+func LoadTopology(path string) (*Topology, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return ParseTopology([]byte(util.Envsubst(string(data))))
+}
+
+// ParseTopology parses a topology in YAML or JSON.
+func ParseTopology(data []byte) (*Topology, error) {
+	t := new(Topology)
+	if err := yaml.Unmarshal(data, t); err != nil {
+		return nil, fmt.Errorf("amqp: invalid topology: %s", err)
+	}
+
+	for _, ex := range t.Exchanges {
+		if ex.Name == "" {
+			return nil, fmt.Errorf("amqp: invalid topology: exchange without a name")
+		}
+	}
+	for _, q := range t.Queues {
+		if q.Name == "" {
+			return nil, fmt.Errorf("amqp: invalid topology: queue without a name")
+		}
+	}
+	for _, b := range t.Bindings {
+		if b.Exchange == "" || b.Queue == "" {
+			return nil, fmt.Errorf("amqp: invalid topology: binding needs an exchange and a queue")
+		}
+	}
+	return t, nil
+}
+
+func (ex ExchangeSpec) kind() string {
+	if ex.Type == "" {
+		return "topic"
+	}
+	return ex.Type
+}
+
+func (ex ExchangeSpec) durable() bool {
+	return ex.Durable == nil || *ex.Durable
+}
+
+func (q QueueSpec) durable() bool {
+	return q.Durable == nil || *q.Durable
+}
+
+func (q QueueSpec) arguments() amqp.Table {
+	args := configTable(q.Arguments)
+	if q.Type != "" {
+		args["x-queue-type"] = q.Type
+	}
+	if q.Lazy {
+		args["x-queue-mode"] = "lazy"
+	}
+	if q.MaxLength > 0 {
+		args["x-max-length"] = int32(q.MaxLength)
+	}
+	if q.MessageTTL > 0 {
+		args["x-message-ttl"] = int32(q.MessageTTL)
+	}
+	if q.DeadLetterExchange != "" {
+		args["x-dead-letter-exchange"] = q.DeadLetterExchange
+	}
+	if q.DeadLetterRoutingKey != "" {
+		args["x-dead-letter-routing-key"] = q.DeadLetterRoutingKey
+	}
+	if len(args) == 0 {
+		return nil
+	}
+	return args
+}
+
+// configTable turns arguments decoded from a file into a table that amqp can
+// encode.
+func configTable(m map[string]interface{}) amqp.Table {
+	table := make(amqp.Table, len(m))
+	for k, v := range m {
+		table[k] = configValue(v)
+	}
+	return table
+}
+
+func configValue(v interface{}) interface{} {
+	switch v := v.(type) {
+	case int:
+		if int64(int32(v)) == int64(v) {
+			return int32(v)
+		}
+		return int64(v)
+	case uint64:
+		return int64(v)
+	case map[interface{}]interface{}:
+		table := make(amqp.Table, len(v))
+		for k, x := range v {
+			table[fmt.Sprint(k)] = configValue(x)
+		}
+		return table
+	case map[string]interface{}:
+		return configTable(v)
+	case []interface{}:
+		values := make([]interface{}, len(v))
+		for i, x := range v {
+			values[i] = configValue(x)
+		}
+		return values
+	}
+	return v
+}
+
+// ConsumerOptions returns the options for consumers of the given queue, to be
+// passed to HandleFunc. Consumers with these options don't declare the
+// exchanges, queues and bindings that are in the topology again, since they
+// may be of another type or have arguments. Apply the topology first, or the
+// consumer fails because they don't exist.
+func (t *Topology) ConsumerOptions(queueName string) []ConsumerOption {
+	options := []ConsumerOption{func(cons *consumer) {
+		cons.topology = t
+	}}
+	for _, spec := range t.Consumers {
+		if spec.Queue != queueName {
+			continue
+		}
+
+		if spec.Concurrency > 0 {
+			options = append(options, WithConcurrency(spec.Concurrency))
+		}
+		if spec.Prefetch > 0 {
+			options = append(options, WithPrefetch(spec.Prefetch))
+		}
+
+		if spec.DisableRetries {
+			options = append(options, WithoutRetries())
+		} else if spec.MaxAttempts > 0 || len(spec.RetryDelays) > 0 {
+			policy := RetryPolicy{MaxAttempts: spec.MaxAttempts}
+			for _, delay := range spec.RetryDelays {
+				policy.Delays = append(policy.Delays, time.Duration(delay)*time.Second)
+			}
+			options = append(options, WithRetryPolicy(policy))
+		}
+	}
+	return options
+}
+
+func (t *Topology) hasExchange(name string) bool {
+	if t == nil {
+		return false
+	}
+	for _, spec := range t.Exchanges {
+		if spec.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+func (t *Topology) hasQueue(name string) bool {
+	if t == nil {
+		return false
+	}
+	for _, spec := range t.Queues {
+		if spec.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+func (t *Topology) hasBinding(exchangeName, queueName, routingKey string) bool {
+	if t == nil {
+		return false
+	}
+	for _, spec := range t.Bindings {
+		if spec.Exchange == exchangeName && spec.Queue == queueName && spec.RoutingKey == routingKey {
+			return true
+		}
+	}
+	return false
+}
+
+// ApplyTopology declares the exchanges and queues of the topology and binds
+// them. Declarations that already exist are left alone, so it is safe to
+// apply the same topology at every start. If an exchange or queue exists with
+// other settings, the broker refuses the declaration and an ErrDeclare error
+// is returned.
+func (c *Client) ApplyTopology(t *Topology) error {
+	ch, err := c.openChannel()
+	if err != nil {
+		return err
+	}
+	defer ch.Close()
+
+	for _, ex := range t.Exchanges {
+		err = ch.ExchangeDeclare(ex.Name, ex.kind(), ex.durable(), ex.AutoDelete, ex.Internal, false, configTable(ex.Arguments))
+		if err != nil {
+			return newError(ErrDeclare, fmt.Sprintf("Failed to declare RabbitMQ exchange %s", ex.Name), err)
+		}
+	}
+
+	for _, q := range t.Queues {
+		_, err = ch.QueueDeclare(q.Name, q.durable(), q.AutoDelete, false, false, q.arguments())
+		if err != nil {
+			return newError(ErrDeclare, fmt.Sprintf("Failed to declare RabbitMQ queue %s", q.Name), err)
+		}
+	}
+
+	for _, b := range t.Bindings {
+		err = ch.QueueBind(b.Queue, b.RoutingKey, b.Exchange, false, configTable(b.Arguments))
+		if err != nil {
+			return newError(ErrDeclare, fmt.Sprintf("Failed to bind RabbitMQ queue %s to %s", b.Queue, b.Exchange), err)
+		}
+	}
+
+	return nil
+}
+
+// DiffTopology compares the exchanges and queues of the topology with what is
+// declared on the broker. It does not change anything. Bindings are not
+// compared, since the broker can't be asked for them over AMQP.
+func (c *Client) DiffTopology(t *Topology) ([]TopologyDifference, error) {
+	var diffs []TopologyDifference
+
+	for _, ex := range t.Exchanges {
+		ex := ex
+		diff, err := c.diff("exchange", ex.Name, func(ch Channel) error {
+			return ch.ExchangeDeclarePassive(ex.Name, ex.kind(), ex.durable(), ex.AutoDelete, ex.Internal, false, nil)
+		}, func(ch Channel) error {
+			return ch.ExchangeDeclare(ex.Name, ex.kind(), ex.durable(), ex.AutoDelete, ex.Internal, false, configTable(ex.Arguments))
+		})
+		if err != nil {
+			return nil, err
+		}
+		if diff != nil {
+			diffs = append(diffs, *diff)
+		}
+	}
+
+	for _, q := range t.Queues {
+		q := q
+		diff, err := c.diff("queue", q.Name, func(ch Channel) error {
+			_, err := ch.QueueDeclarePassive(q.Name, q.durable(), q.AutoDelete, false, false, nil)
+			return err
+		}, func(ch Channel) error {
+			_, err := ch.QueueDeclare(q.Name, q.durable(), q.AutoDelete, false, false, q.arguments())
+			return err
+		})
+		if err != nil {
+			return nil, err
+		}
+		if diff != nil {
+			diffs = append(diffs, *diff)
+		}
+	}
+
+	return diffs, nil
+}
+
+// diff checks that something exists with a passive declaration, then declares
+// it again to see whether the broker agrees with the settings. Both close the
+// channel if they fail, so each gets its own.
+func (c *Client) diff(kind, name string, passive, declare func(ch Channel) error) (*TopologyDifference, error) {
+	check := func(f func(ch Channel) error) (declareErr, err error) {
+		ch, err := c.openChannel()
+		if err != nil {
+			return nil, err
+		}
+		defer ch.Close()
+		return f(ch), nil
+	}
+
+	err, openErr := check(passive)
+	if openErr != nil {
+		return nil, openErr
+	}
+	if isCode(err, amqp.NotFound) {
+		return &TopologyDifference{Kind: kind, Name: name, Missing: true}, nil
+	}
+	if err != nil {
+		return nil, newError(ErrDeclare, fmt.Sprintf("Failed to inspect RabbitMQ %s %s", kind, name), err)
+	}
+
+	err, openErr = check(declare)
+	if openErr != nil {
+		return nil, openErr
+	}
+	if isCode(err, amqp.PreconditionFailed) {
+		return &TopologyDifference{Kind: kind, Name: name, Err: err}, nil
+	}
+	if err != nil {
+		return nil, newError(ErrDeclare, fmt.Sprintf("Failed to inspect RabbitMQ %s %s", kind, name), err)
+	}
+	return nil, nil
+}
+
+// isCode reports whether err is an error from the broker with the given code.
+func isCode(err error, code int) bool {
+	amqpErr, ok := err.(*amqp.Error)
+	return ok && amqpErr.Code == code
+}
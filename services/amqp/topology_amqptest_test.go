@@ -0,0 +1,105 @@
+package amqp_test
+
+import (
+	"testing"
+
+	"github.com/getconversio/go-utils/services/amqp"
+	streadway "github.com/streadway/amqp"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBrokerTopology(t *testing.T) {
+	_, c := newBroker(nil)
+	defer c.Close()
+
+	topology, err := amqp.ParseTopology([]byte(`
+exchanges:
+  - name: orders
+    type: headers
+queues:
+  - name: orders.created
+    max_length: 10
+bindings:
+  - exchange: orders
+    queue: orders.created
+    arguments:
+      x-match: any
+      type: created
+`))
+	require.NoError(t, err)
+
+	diffs, err := c.DiffTopology(topology)
+	require.NoError(t, err)
+	require.Len(t, diffs, 2)
+	assert.Equal(t, "exchange orders is missing", diffs[0].String())
+	assert.Equal(t, "queue orders.created is missing", diffs[1].String())
+
+	// Applying is idempotent.
+	require.NoError(t, c.ApplyTopology(topology))
+	require.NoError(t, c.ApplyTopology(topology))
+
+	diffs, err = c.DiffTopology(topology)
+	require.NoError(t, err)
+	assert.Empty(t, diffs)
+
+	// The queue exists with another max length.
+	topology.Queues[0].MaxLength = 20
+	diffs, err = c.DiffTopology(topology)
+	require.NoError(t, err)
+	require.Len(t, diffs, 1)
+	assert.Equal(t, "queue", diffs[0].Kind)
+	assert.False(t, diffs[0].Missing)
+	assert.Error(t, diffs[0].Err)
+
+	err = c.ApplyTopology(topology)
+	assert.True(t, amqp.IsKind(err, amqp.ErrDeclare))
+}
+
+func TestBrokerTopologyConsumer(t *testing.T) {
+	broker, c := newBroker(nil)
+	defer c.Close()
+
+	topology, err := amqp.ParseTopology([]byte(`
+exchanges:
+  - name: orders
+    type: direct
+queues:
+  - name: orders.created
+    max_length: 10
+bindings:
+  - exchange: orders
+    queue: orders.created
+    routing_key: order.created
+consumers:
+  - queue: orders.created
+    concurrency: 2
+`))
+	require.NoError(t, err)
+
+	handle := func(msg interface{}, headers streadway.Table) error {
+		return nil
+	}
+
+	// The consumer does not declare what is in the topology, so it has to be
+	// applied first.
+	_, _, err = c.HandleFunc("orders.created", "orders", "order.created", new(testMsg), handle,
+		topology.ConsumerOptions("orders.created")...)
+	assert.True(t, amqp.IsKind(err, amqp.ErrDeclare))
+
+	require.NoError(t, c.ApplyTopology(topology))
+
+	received := make(chan int)
+	_, _, err = c.HandleFunc("orders.created", "orders", "order.created", new(testMsg), func(msg interface{}, headers streadway.Table) error {
+		received <- msg.(*testMsg).I
+		return nil
+	}, topology.ConsumerOptions("orders.created")...)
+	require.NoError(t, err)
+
+	require.NoError(t, c.Publish("orders", "order.created", testMsg{1}))
+	assert.Equal(t, 1, receive(t, broker, received))
+
+	diffs, err := c.DiffTopology(topology)
+	require.NoError(t, err)
+	assert.Empty(t, diffs)
+}
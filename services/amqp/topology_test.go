@@ -0,0 +1,134 @@
+package amqp
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/streadway/amqp"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const testTopology = `
+exchanges:
+  - name: orders
+  - name: orders.dead
+    type: fanout
+    durable: false
+queues:
+  - name: orders.created
+    type: quorum
+    max_length: 100000
+    message_ttl: 60000
+    dead_letter_exchange: orders.dead
+    arguments:
+      x-overflow: reject-publish
+bindings:
+  - exchange: orders
+    queue: orders.created
+    routing_key: order.created
+consumers:
+  - queue: orders.created
+    concurrency: 8
+    prefetch: 16
+    max_attempts: 3
+    retry_delays: [1, 10]
+`
+
+func TestParseTopology(t *testing.T) {
+	topology, err := ParseTopology([]byte(testTopology))
+	require.NoError(t, err)
+
+	require.Len(t, topology.Exchanges, 2)
+	assert.Equal(t, "topic", topology.Exchanges[0].kind())
+	assert.True(t, topology.Exchanges[0].durable())
+	assert.Equal(t, "fanout", topology.Exchanges[1].kind())
+	assert.False(t, topology.Exchanges[1].durable())
+
+	require.Len(t, topology.Queues, 1)
+	assert.Equal(t, amqp.Table{
+		"x-queue-type":           "quorum",
+		"x-max-length":           int32(100000),
+		"x-message-ttl":          int32(60000),
+		"x-dead-letter-exchange": "orders.dead",
+		"x-overflow":             "reject-publish",
+	}, topology.Queues[0].arguments())
+
+	require.Len(t, topology.Bindings, 1)
+	assert.Equal(t, "order.created", topology.Bindings[0].RoutingKey)
+
+	// JSON is YAML too.
+	topology, err = ParseTopology([]byte(`{"queues": [{"name": "orders.created", "lazy": true}]}`))
+	require.NoError(t, err)
+	assert.Equal(t, amqp.Table{"x-queue-mode": "lazy"}, topology.Queues[0].arguments())
+
+	_, err = ParseTopology([]byte(`{"queues": [{"type": "quorum"}]}`))
+	assert.Error(t, err)
+	_, err = ParseTopology([]byte(`bindings: [{queue: orders.created}]`))
+	assert.Error(t, err)
+	_, err = ParseTopology([]byte(`queues: {`))
+	assert.Error(t, err)
+}
+
+func TestLoadTopology(t *testing.T) {
+	f, err := ioutil.TempFile("", "topology")
+	require.NoError(t, err)
+	defer os.Remove(f.Name())
+
+	_, err = f.WriteString("queues:\n  - name: $TOPOLOGY_QUEUE\n")
+	require.NoError(t, err)
+	f.Close()
+
+	os.Setenv("TOPOLOGY_QUEUE", "orders.created")
+	defer os.Unsetenv("TOPOLOGY_QUEUE")
+
+	topology, err := LoadTopology(f.Name())
+	require.NoError(t, err)
+	assert.Equal(t, "orders.created", topology.Queues[0].Name)
+
+	_, err = LoadTopology(f.Name() + ".missing")
+	assert.Error(t, err)
+
+	// A file that can't be read is an error too, not a panic.
+	_, err = LoadTopology(os.TempDir())
+	assert.Error(t, err)
+}
+
+func TestConfigValue(t *testing.T) {
+	assert.Equal(t, int32(1), configValue(1))
+	assert.Equal(t, int64(1<<40), configValue(1<<40))
+	assert.Equal(t, "a", configValue("a"))
+	assert.Equal(t, amqp.Table{"a": int32(1)}, configValue(map[interface{}]interface{}{"a": 1}))
+	assert.Equal(t, []interface{}{int32(1), "b"}, configValue([]interface{}{1, "b"}))
+}
+
+func TestConsumerOptions(t *testing.T) {
+	topology, err := ParseTopology([]byte(testTopology))
+	require.NoError(t, err)
+
+	cons := new(consumer)
+	for _, option := range topology.ConsumerOptions("orders.created") {
+		option(cons)
+	}
+	assert.Equal(t, 8, cons.concurrency)
+	assert.Equal(t, 16, cons.prefetch)
+	require.NotNil(t, cons.retryPolicy)
+	assert.Equal(t, 3, cons.retryPolicy.MaxAttempts)
+	assert.Equal(t, []time.Duration{time.Second, 10 * time.Second}, cons.retryPolicy.Delays)
+	assert.Equal(t, topology, cons.topology)
+
+	// Consumers of other queues only learn what the topology declares.
+	cons = new(consumer)
+	for _, option := range topology.ConsumerOptions("orders.other") {
+		option(cons)
+	}
+	assert.Equal(t, 0, cons.concurrency)
+	assert.Nil(t, cons.retryPolicy)
+	assert.Equal(t, topology, cons.topology)
+
+	assert.True(t, cons.topology.hasQueue("orders.created"))
+	assert.False(t, cons.topology.hasQueue("orders.other"))
+	assert.False(t, (*Topology)(nil).hasExchange("orders"))
+}
@@ -0,0 +1,300 @@
+package amqp
+
+import (
+	"context"
+	"regexp"
+	"sort"
+
+	"github.com/streadway/amqp"
+)
+
+// TextMapCarrier holds the fields that a Propagator reads and writes. It has
+// the same methods as the OpenTelemetry carrier.
+type TextMapCarrier interface {
+	Get(key string) string
+	Set(key, value string)
+	Keys() []string
+}
+
+// Propagator passes values like the trace context from the context of a
+// publisher to the context of the handler, in the headers of the message. It
+// has the same methods as the OpenTelemetry TextMapPropagator, so one can be
+// used with a small adapter that wraps the carrier:
+//
+//	type otelPropagator struct{ propagation.TextMapPropagator }
+//
+//	func (p otelPropagator) Inject(ctx context.Context, carrier amqp.TextMapCarrier) {
+//		p.TextMapPropagator.Inject(ctx, carrier)
+//	}
+//
+//	func (p otelPropagator) Extract(ctx context.Context, carrier amqp.TextMapCarrier) context.Context {
+//		return p.TextMapPropagator.Extract(ctx, carrier)
+//	}
+type Propagator interface {
+	// Inject writes the values in ctx to the carrier.
+	Inject(ctx context.Context, carrier TextMapCarrier)
+
+	// Extract returns a copy of ctx with the values in the carrier.
+	Extract(ctx context.Context, carrier TextMapCarrier) context.Context
+
+	// Fields returns the keys that Inject writes.
+	Fields() []string
+}
+
+// HeaderCarrier is the TextMapCarrier for the headers of a message. Only
+// string headers are read.
+type HeaderCarrier amqp.Table
+
+// Get returns the header with the given key.
+func (h HeaderCarrier) Get(key string) string {
+	return headerString(amqp.Table(h), key)
+}
+
+// Set sets the header with the given key.
+func (h HeaderCarrier) Set(key, value string) {
+	h[key] = value
+}
+
+// Keys returns the keys of all headers.
+func (h HeaderCarrier) Keys() []string {
+	keys := make([]string, 0, len(h))
+	for key := range h {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// Propagators combines propagators into one that runs them in order.
+func Propagators(propagators ...Propagator) Propagator {
+	return compositePropagator(propagators)
+}
+
+type compositePropagator []Propagator
+
+func (p compositePropagator) Inject(ctx context.Context, carrier TextMapCarrier) {
+	for _, propagator := range p {
+		propagator.Inject(ctx, carrier)
+	}
+}
+
+func (p compositePropagator) Extract(ctx context.Context, carrier TextMapCarrier) context.Context {
+	for _, propagator := range p {
+		ctx = propagator.Extract(ctx, carrier)
+	}
+	return ctx
+}
+
+func (p compositePropagator) Fields() []string {
+	var fields []string
+	for _, propagator := range p {
+		fields = append(fields, propagator.Fields()...)
+	}
+	return fields
+}
+
+// TraceContext is a W3C trace context, see https://www.w3.org/TR/trace-context/.
+type TraceContext struct {
+	// E.g. 00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01.
+	TraceParent string
+
+	// Vendor specific values, e.g. congo=t61rcWkgMzE.
+	TraceState string
+}
+
+type traceContextKey struct{}
+
+// WithTraceContext returns a copy of ctx with the trace context, which
+// TraceContextPropagator passes on to the handlers of published messages.
+func WithTraceContext(ctx context.Context, tc TraceContext) context.Context {
+	return context.WithValue(ctx, traceContextKey{}, tc)
+}
+
+// TraceContextFrom returns the trace context in ctx, e.g. the one of the
+// message being handled.
+func TraceContextFrom(ctx context.Context) (TraceContext, bool) {
+	tc, ok := ctx.Value(traceContextKey{}).(TraceContext)
+	return tc, ok
+}
+
+var traceParentPattern = regexp.MustCompile(`^[0-9a-f]{2}-[0-9a-f]{32}-[0-9a-f]{16}-[0-9a-f]{2}$`)
+
+// TraceContextPropagator passes on the W3C trace context in the traceparent
+// and tracestate headers. It is meant for services that don't use
+// OpenTelemetry themselves but should not break the trace.
+type TraceContextPropagator struct{}
+
+// Inject implements Propagator.
+func (TraceContextPropagator) Inject(ctx context.Context, carrier TextMapCarrier) {
+	tc, ok := TraceContextFrom(ctx)
+	if !ok || tc.TraceParent == "" {
+		return
+	}
+
+	carrier.Set("traceparent", tc.TraceParent)
+	if tc.TraceState != "" {
+		carrier.Set("tracestate", tc.TraceState)
+	}
+}
+
+// Extract implements Propagator. A malformed traceparent is ignored.
+func (TraceContextPropagator) Extract(ctx context.Context, carrier TextMapCarrier) context.Context {
+	traceParent := carrier.Get("traceparent")
+	if !traceParentPattern.MatchString(traceParent) {
+		return ctx
+	}
+	return WithTraceContext(ctx, TraceContext{
+		TraceParent: traceParent,
+		TraceState:  carrier.Get("tracestate"),
+	})
+}
+
+// Fields implements Propagator.
+func (TraceContextPropagator) Fields() []string {
+	return []string{"traceparent", "tracestate"}
+}
+
+type requestIDKey struct{}
+
+// WithRequestID returns a copy of ctx with the request ID, which
+// RequestIDPropagator passes on to the handlers of published messages.
+func WithRequestID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, requestIDKey{}, id)
+}
+
+// RequestID returns the request ID in ctx, e.g. the one of the message being
+// handled, or an empty string.
+func RequestID(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey{}).(string)
+	return id
+}
+
+// RequestIDPropagator passes on the request ID in the x-request-id header.
+type RequestIDPropagator struct{}
+
+// Inject implements Propagator.
+func (RequestIDPropagator) Inject(ctx context.Context, carrier TextMapCarrier) {
+	if id := RequestID(ctx); id != "" {
+		carrier.Set("x-request-id", id)
+	}
+}
+
+// Extract implements Propagator.
+func (RequestIDPropagator) Extract(ctx context.Context, carrier TextMapCarrier) context.Context {
+	if id := carrier.Get("x-request-id"); id != "" {
+		return WithRequestID(ctx, id)
+	}
+	return ctx
+}
+
+// Fields implements Propagator.
+func (RequestIDPropagator) Fields() []string {
+	return []string{"x-request-id"}
+}
+
+// SpanKind tells whether a span is around publishing or handling a message.
+type SpanKind int
+
+const (
+	// SpanKindProducer is the kind of the spans around PublishContext and
+	// Call.
+	SpanKindProducer SpanKind = iota + 1
+
+	// SpanKindConsumer is the kind of the spans around the handlers.
+	SpanKindConsumer
+)
+
+// Tracer starts spans around publishing and handling messages, see
+// Options.Tracer. It has the shape of the OpenTelemetry tracer, so an adapter
+// only has to map the kind and the attributes, and record the error in End.
+// The amqptest package has one that records the spans in memory.
+type Tracer interface {
+	// Start starts a span as a child of the span in ctx, if any, and returns
+	// a copy of ctx with the new span. The attributes follow the OpenTelemetry
+	// conventions for messaging, e.g. messaging.destination.name.
+	//
+	// The propagators pass the span of a publish on in the headers, so it
+	// becomes the parent of the span of the handler.
+	Start(ctx context.Context, name string, kind SpanKind, attributes map[string]string) (context.Context, Span)
+}
+
+// Span is a span started by a Tracer.
+type Span interface {
+	// End ends the span. The error is nil, unless publishing or handling the
+	// message failed.
+	End(err error)
+}
+
+type noopTracer struct{}
+
+func (noopTracer) Start(ctx context.Context, name string, kind SpanKind, attributes map[string]string) (context.Context, Span) {
+	return ctx, noopSpan{}
+}
+
+type noopSpan struct{}
+
+func (noopSpan) End(err error) {}
+
+// startPublishSpan starts the span around publishing the message.
+func (c *Client) startPublishSpan(ctx context.Context, exchangeName, routingKey string, msg amqp.Publishing) (context.Context, Span) {
+	return c.opts.Tracer.Start(ctx, exchangeName+" publish", SpanKindProducer, map[string]string{
+		"messaging.system":                           "rabbitmq",
+		"messaging.operation":                        "publish",
+		"messaging.destination.name":                 exchangeName,
+		"messaging.rabbitmq.destination.routing_key": routingKey,
+		"messaging.message.id":                       msg.MessageId,
+	})
+}
+
+// handlerContext returns the context for handling the message, with the values
+// that its publisher passed on, and starts the span around handling it.
+func (c *Client) handlerContext(cons *consumer, msg amqp.Delivery) (context.Context, Span) {
+	return c.opts.Tracer.Start(c.extract(cons.ctx, msg), cons.queueName+" process", SpanKindConsumer, map[string]string{
+		"messaging.system":                           "rabbitmq",
+		"messaging.operation":                        "process",
+		"messaging.source.name":                      cons.queueName,
+		"messaging.destination.name":                 msg.Exchange,
+		"messaging.rabbitmq.destination.routing_key": msg.RoutingKey,
+		"messaging.message.id":                       msg.MessageId,
+	})
+}
+
+// inject adds the values in ctx to the headers of the message.
+func (c *Client) inject(ctx context.Context, msg *amqp.Publishing) {
+	if msg.Headers == nil {
+		msg.Headers = make(amqp.Table)
+	}
+	c.opts.Propagator.Inject(ctx, HeaderCarrier(msg.Headers))
+	if len(msg.Headers) == 0 {
+		msg.Headers = nil
+	}
+}
+
+// extract returns the handler context for the message.
+func (c *Client) extract(ctx context.Context, msg amqp.Delivery) context.Context {
+	if len(msg.Headers) == 0 {
+		return ctx
+	}
+	return c.opts.Propagator.Extract(ctx, HeaderCarrier(msg.Headers))
+}
+
+// PublishContext is like Publish, but the values in ctx, like the trace
+// context and request ID, are passed on in the headers of the message. See
+// Options.Propagator. The message gets the ID given with WithMessageID, if
+// any. Publishing is traced with Options.Tracer.
+func (c *Client) PublishContext(ctx context.Context, exchangeName, routingKey string, msg interface{}) error {
+	publishing, err := encodePublishing(c.opts.Codec, msg)
+	if err != nil {
+		return newError(ErrEncode, "Failed to encode data for RabbitMQ message", err)
+	}
+
+	if id := messageIDFrom(ctx); id != "" {
+		publishing.MessageId = id
+	}
+
+	ctx, span := c.startPublishSpan(ctx, exchangeName, routingKey, publishing)
+	c.inject(ctx, &publishing)
+	err = c.publish(c.opts.FailFast, c.opts.PublishTimeout, exchangeName, routingKey, publishing)
+	span.End(err)
+	return err
+}
@@ -0,0 +1,148 @@
+package amqp_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/getconversio/go-utils/services/amqp"
+	"github.com/getconversio/go-utils/services/amqp/amqptest"
+	"github.com/getconversio/go-utils/util"
+	streadway "github.com/streadway/amqp"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBrokerTracing(t *testing.T) {
+	broker, c := newBroker(nil)
+	defer c.Close()
+	require.NoError(t, c.EnsureRetryConsumer())
+
+	type seen struct {
+		tc        amqp.TraceContext
+		requestID string
+	}
+
+	attempts := 0
+	received := make(chan seen, 2)
+	c.HandleContext("test.queue", "test", "test.routing", new(testMsg), func(ctx context.Context, msg interface{}, d streadway.Delivery) error {
+		tc, _ := amqp.TraceContextFrom(ctx)
+		received <- seen{tc, amqp.RequestID(ctx)}
+		attempts++
+		if attempts < 2 {
+			return errors.New("not yet")
+		}
+		return nil
+	})
+
+	tc := amqp.TraceContext{
+		TraceParent: "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01",
+		TraceState:  "congo=t61rcWkgMzE",
+	}
+	ctx := amqp.WithRequestID(amqp.WithTraceContext(context.Background(), tc), "req-1")
+	require.NoError(t, c.PublishContext(ctx, "test", "test.routing", testMsg{1}))
+
+	msg := broker.ExpectPublished(t, "test", "test.routing")
+	assert.Equal(t, tc.TraceParent, msg.Headers["traceparent"])
+	assert.Equal(t, "req-1", msg.Headers["x-request-id"])
+
+	// The retried message carries the same trace context.
+	timeout := time.After(2 * time.Second)
+	for i := 0; i < 2; {
+		select {
+		case s := <-received:
+			assert.Equal(t, seen{tc, "req-1"}, s)
+			i++
+		case <-time.After(10 * time.Millisecond):
+			broker.Expire()
+		case <-timeout:
+			t.Fatal("waited too long for the handler")
+		}
+	}
+}
+
+func TestBrokerSpans(t *testing.T) {
+	spans := amqptest.NewSpanRecorder()
+	_, c := newBroker(&amqp.Options{Tracer: spans})
+	defer c.Close()
+
+	received := make(chan amqp.TraceContext, 1)
+	c.HandleContext("test.queue", "test", "test.routing", new(testMsg), func(ctx context.Context, msg interface{}, d streadway.Delivery) error {
+		tc, _ := amqp.TraceContextFrom(ctx)
+		received <- tc
+		return errors.New("failed")
+	}, amqp.WithoutRetries())
+
+	parent := amqp.TraceContext{TraceParent: "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"}
+	ctx := amqp.WithTraceContext(context.Background(), parent)
+	require.NoError(t, c.PublishContext(ctx, "test", "test.routing", testMsg{1}))
+
+	var tc amqp.TraceContext
+	select {
+	case tc = <-received:
+	case <-time.After(2 * time.Second):
+		t.Fatal("waited too long for the handler")
+	}
+	util.ValidateWithTimeout(t, func() bool {
+		return len(spans.Spans()) == 2
+	}, 1000)
+
+	// The handler may finish before Publish returns, so don't rely on the
+	// order of the spans.
+	byKind := func() (publish, process amqptest.RecordedSpan) {
+		for _, span := range spans.Spans() {
+			if span.Kind == amqp.SpanKindProducer {
+				publish = span
+			} else {
+				process = span
+			}
+		}
+		return publish, process
+	}
+
+	// The span of the handler is a child of the span of the publish, which is
+	// a child of the span in the publisher's context.
+	publish, process := byKind()
+	assert.Equal(t, "test publish", publish.Name)
+	assert.Equal(t, amqp.SpanKindProducer, publish.Kind)
+	assert.Equal(t, "4bf92f3577b34da6a3ce929d0e0e4736", publish.TraceID)
+	assert.Equal(t, "00f067aa0ba902b7", publish.ParentID)
+	assert.Equal(t, "test.routing", publish.Attributes["messaging.rabbitmq.destination.routing_key"])
+	assert.NoError(t, publish.Err)
+
+	assert.Equal(t, "test.queue process", process.Name)
+	assert.Equal(t, amqp.SpanKindConsumer, process.Kind)
+	assert.Equal(t, publish.TraceID, process.TraceID)
+	assert.Equal(t, publish.SpanID, process.ParentID)
+	assert.EqualError(t, process.Err, "failed")
+
+	// The handler runs in the span of its own.
+	assert.Equal(t, "00-"+process.TraceID+"-"+process.SpanID+"-01", tc.TraceParent)
+
+	// So does every message of a batch.
+	spans.Reset()
+	batched := make(chan amqp.TraceContext, 1)
+	_, _, err := c.HandleBatch("test.batch", "test", "test.batch", new(testMsg), 1, time.Second, func(ctx context.Context, msgs []interface{}, ds []streadway.Delivery) error {
+		tc, _ := amqp.TraceContextFrom(amqp.BatchMessageContext(ctx, 0))
+		batched <- tc
+		return nil
+	})
+	require.NoError(t, err)
+	require.NoError(t, c.PublishContext(ctx, "test", "test.batch", testMsg{2}))
+
+	select {
+	case tc = <-batched:
+	case <-time.After(2 * time.Second):
+		t.Fatal("waited too long for the batch handler")
+	}
+	util.ValidateWithTimeout(t, func() bool {
+		return len(spans.Spans()) == 2
+	}, 1000)
+
+	publish, process = byKind()
+	assert.Equal(t, "test.batch process", process.Name)
+	assert.Equal(t, publish.SpanID, process.ParentID)
+	assert.NoError(t, process.Err)
+	assert.Equal(t, "00-"+process.TraceID+"-"+process.SpanID+"-01", tc.TraceParent)
+}
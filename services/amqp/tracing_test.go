@@ -0,0 +1,75 @@
+package amqp
+
+import (
+	"context"
+	"testing"
+
+	"github.com/streadway/amqp"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHeaderCarrier(t *testing.T) {
+	headers := amqp.Table{"b": "2", "n": int32(1)}
+	carrier := HeaderCarrier(headers)
+	carrier.Set("a", "1")
+
+	assert.Equal(t, "1", carrier.Get("a"))
+	assert.Equal(t, "", carrier.Get("n"))
+	assert.Equal(t, "", carrier.Get("missing"))
+	assert.Equal(t, []string{"a", "b", "n"}, carrier.Keys())
+	assert.Equal(t, "1", headers["a"])
+}
+
+func TestTraceContextPropagator(t *testing.T) {
+	p := TraceContextPropagator{}
+	tc := TraceContext{
+		TraceParent: "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01",
+		TraceState:  "congo=t61rcWkgMzE",
+	}
+
+	carrier := HeaderCarrier{}
+	p.Inject(WithTraceContext(context.Background(), tc), carrier)
+	assert.Equal(t, tc.TraceParent, carrier.Get("traceparent"))
+	assert.Equal(t, tc.TraceState, carrier.Get("tracestate"))
+
+	extracted, ok := TraceContextFrom(p.Extract(context.Background(), carrier))
+	assert.True(t, ok)
+	assert.Equal(t, tc, extracted)
+
+	// Nothing is injected without a trace context.
+	carrier = HeaderCarrier{}
+	p.Inject(context.Background(), carrier)
+	assert.Empty(t, carrier)
+
+	// A malformed traceparent is ignored.
+	carrier = HeaderCarrier{"traceparent": "00-nope-01"}
+	_, ok = TraceContextFrom(p.Extract(context.Background(), carrier))
+	assert.False(t, ok)
+}
+
+func TestRequestIDPropagator(t *testing.T) {
+	p := RequestIDPropagator{}
+
+	carrier := HeaderCarrier{}
+	p.Inject(WithRequestID(context.Background(), "req-1"), carrier)
+	assert.Equal(t, "req-1", carrier.Get("x-request-id"))
+	assert.Equal(t, "req-1", RequestID(p.Extract(context.Background(), carrier)))
+	assert.Equal(t, "", RequestID(context.Background()))
+}
+
+func TestPropagators(t *testing.T) {
+	p := Propagators(TraceContextPropagator{}, RequestIDPropagator{})
+	assert.Equal(t, []string{"traceparent", "tracestate", "x-request-id"}, p.Fields())
+
+	ctx := WithTraceContext(context.Background(), TraceContext{TraceParent: "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"})
+	ctx = WithRequestID(ctx, "req-1")
+
+	carrier := HeaderCarrier{}
+	p.Inject(ctx, carrier)
+	assert.Equal(t, []string{"traceparent", "x-request-id"}, carrier.Keys())
+
+	extracted := p.Extract(context.Background(), carrier)
+	assert.Equal(t, "req-1", RequestID(extracted))
+	_, ok := TraceContextFrom(extracted)
+	assert.True(t, ok)
+}
@@ -0,0 +1,72 @@
+//go:build go1.18
+// +build go1.18
+
+package amqp
+
+import (
+	"context"
+	"reflect"
+
+	"github.com/getconversio/go-utils/util"
+	"github.com/streadway/amqp"
+)
+
+// Delivery is a message delivered to a handler, along with its properties.
+type Delivery = amqp.Delivery
+
+// Handle sets up a handler for messages of type T on the default client. See
+// HandleWith.
+func Handle[T any](queueName, exchangeName, routingKey string, fn func(ctx context.Context, msg T, d Delivery) error, options ...ConsumerOption) (string, Channel, error) {
+	return HandleWith(std(), queueName, exchangeName, routingKey, fn, options...)
+}
+
+// MustHandle is like Handle, but panics on errors.
+func MustHandle[T any](queueName, exchangeName, routingKey string, fn func(ctx context.Context, msg T, d Delivery) error, options ...ConsumerOption) (string, Channel) {
+	return MustHandleWith(std(), queueName, exchangeName, routingKey, fn, options...)
+}
+
+// HandleWith is like Client.HandleFunc, but every message is decoded into a
+// new value of type T, which is passed to the handler as is. There is no need
+// for an EmptyCreator or for type assertions in the handler.
+func HandleWith[T any](c *Client, queueName, exchangeName, routingKey string, fn func(ctx context.Context, msg T, d Delivery) error, options ...ConsumerOption) (string, Channel, error) {
+	cons := c.newConsumer(queueName, exchangeName, routingKey, options)
+	cons.decode = decodeTyped[T]
+	cons.handle = func(ctx context.Context, msg interface{}, d amqp.Delivery) error {
+		return fn(ctx, msg.(T), d)
+	}
+	return c.startConsumer(cons)
+}
+
+// MustHandleWith is like HandleWith, but panics on errors.
+func MustHandleWith[T any](c *Client, queueName, exchangeName, routingKey string, fn func(ctx context.Context, msg T, d Delivery) error, options ...ConsumerOption) (string, Channel) {
+	ctag, ch, err := HandleWith(c, queueName, exchangeName, routingKey, fn, options...)
+	util.PanicOnError("Failed to register a RabbitMQ consumer", err)
+	return ctag, ch
+}
+
+func decodeTyped[T any](d amqp.Delivery) (interface{}, error) {
+	var msg T
+
+	// If T is a pointer, decode into a new value it points to. Codecs like
+	// protobuf need the pointer itself, not a pointer to it.
+	if t := reflect.TypeOf(msg); t != nil && t.Kind() == reflect.Ptr {
+		v := reflect.New(t.Elem())
+		err := decodeDelivery(d, v.Interface())
+		return v.Interface().(T), err
+	}
+
+	err := decodeDelivery(d, &msg)
+	return msg, err
+}
+
+// PublishTyped publishes a message of type T on the default client. See
+// PublishTypedWith.
+func PublishTyped[T any](exchangeName, routingKey string, msg T) error {
+	return PublishTypedWith(std(), exchangeName, routingKey, msg)
+}
+
+// PublishTypedWith is Client.Publish for a message of type T. It makes sure
+// that producers and consumers created with HandleWith agree on the type.
+func PublishTypedWith[T any](c *Client, exchangeName, routingKey string, msg T) error {
+	return c.Publish(exchangeName, routingKey, msg)
+}
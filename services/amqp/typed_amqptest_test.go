@@ -0,0 +1,39 @@
+//go:build go1.18
+// +build go1.18
+
+package amqp_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/getconversio/go-utils/services/amqp"
+	"github.com/golang/protobuf/ptypes/wrappers"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBrokerHandleProtobuf(t *testing.T) {
+	broker, c := newBroker(&amqp.Options{Codec: amqp.Protobuf})
+	defer c.Close()
+
+	amqp.SetDefault(c)
+	defer amqp.SetDefault(nil)
+
+	received := make(chan string, 1)
+	_, _, err := amqp.Handle("test.queue", "test", "test.routing", func(ctx context.Context, msg *wrappers.StringValue, d amqp.Delivery) error {
+		received <- msg.Value
+		return nil
+	})
+	require.NoError(t, err)
+
+	require.NoError(t, amqp.PublishTyped("test", "test.routing", &wrappers.StringValue{Value: "hello"}))
+	select {
+	case value := <-received:
+		assert.Equal(t, "hello", value)
+	case <-time.After(2 * time.Second):
+		t.Fatal("waited too long for the handler")
+	}
+	assert.Equal(t, 0, broker.QueueLength("test.queue.invalid"))
+}
@@ -0,0 +1,57 @@
+//go:build go1.18
+// +build go1.18
+
+package amqp
+
+import (
+	"context"
+	"testing"
+
+	"github.com/golang/protobuf/ptypes/wrappers"
+	"github.com/streadway/amqp"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDecodeTyped(t *testing.T) {
+	msg, err := decodeTyped[msgType](amqp.Delivery{Body: []byte(`{"i":3}`)})
+	require.NoError(t, err)
+	assert.Equal(t, msgType{3}, msg)
+
+	ptr, err := decodeTyped[*msgType](amqp.Delivery{Body: []byte(`{"i":4}`)})
+	require.NoError(t, err)
+	assert.Equal(t, &msgType{4}, ptr)
+
+	_, err = decodeTyped[msgType](amqp.Delivery{Body: []byte(`not JSON`)})
+	assert.Error(t, err)
+
+	body, err := MsgPack.Marshal(msgType{5})
+	require.NoError(t, err)
+	msg, err = decodeTyped[msgType](amqp.Delivery{ContentType: "application/msgpack", Body: body})
+	require.NoError(t, err)
+	assert.Equal(t, msgType{5}, msg)
+
+	body, err = Protobuf.Marshal(&wrappers.StringValue{Value: "six"})
+	require.NoError(t, err)
+	pb, err := decodeTyped[*wrappers.StringValue](amqp.Delivery{ContentType: "application/x-protobuf", Body: body})
+	require.NoError(t, err)
+	assert.Equal(t, "six", pb.(*wrappers.StringValue).Value)
+}
+
+func TestHandle(t *testing.T) {
+	setup()
+	defer teardown()
+
+	ctag, _ := MustHandle("test.mctest", "test", "test.routing", func(ctx context.Context, msg msgType, d Delivery) error {
+		assert.Equal(t, "test.routing", d.RoutingKey)
+		intChannel <- msg.I
+		return nil
+	})
+	defer Stop(ctag)
+
+	err := PublishTyped("test", "test.routing", msgType{45})
+	require.NoError(t, err)
+
+	i := <-intChannel
+	assert.Equal(t, 45, i)
+}
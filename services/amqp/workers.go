@@ -0,0 +1,104 @@
+package amqp
+
+import (
+	"hash/fnv"
+	"sync"
+
+	"github.com/streadway/amqp"
+)
+
+// WithConcurrency handles up to n deliveries of the consumer at the same time,
+// each in its own goroutine. Every delivery is still acked on its own once its
+// handler returns.
+//
+// Unless WithOrderingKey or WithOrderingHeader is used, the messages are
+// handled in no particular order.
+func WithConcurrency(n int) ConsumerOption {
+	return func(cons *consumer) {
+		cons.concurrency = n
+	}
+}
+
+// WithPrefetch sets the number of unacked deliveries the broker sends to the
+// consumer. Defaults to the client's Prefetch, or the concurrency if that is
+// higher.
+func WithPrefetch(n int) ConsumerOption {
+	return func(cons *consumer) {
+		cons.prefetch = n
+	}
+}
+
+// WithOrderingKey handles deliveries with the same key one at a time, in the
+// order they arrive. Deliveries with different keys may still be handled
+// concurrently.
+func WithOrderingKey(key func(d amqp.Delivery) string) ConsumerOption {
+	return func(cons *consumer) {
+		cons.orderingKey = key
+	}
+}
+
+// WithOrderingHeader is like WithOrderingKey, using the value of the given
+// header as the key.
+func WithOrderingHeader(header string) ConsumerOption {
+	return WithOrderingKey(func(d amqp.Delivery) string {
+		return headerString(d.Headers, header)
+	})
+}
+
+// worker returns the index of the worker that handles the given key.
+func worker(key string, workers int) int {
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	return int(h.Sum32() % uint32(workers))
+}
+
+// dispatch hands the deliveries to the consumer's workers until the
+// deliveries are closed, and waits for the workers to finish.
+func (c *Client) dispatch(cons *consumer, msgs <-chan amqp.Delivery) {
+	if cons.batchSize > 0 {
+		c.dispatchBatches(cons, msgs)
+		return
+	}
+
+	if cons.concurrency == 1 {
+		for msg := range msgs {
+			c.deliver(cons, msg)
+		}
+		return
+	}
+
+	// Without an ordering key, all workers take from the same queue.
+	queues := make([]chan amqp.Delivery, cons.concurrency)
+	var wg sync.WaitGroup
+	for i := range queues {
+		if i == 0 || cons.orderingKey != nil {
+			queues[i] = make(chan amqp.Delivery)
+		} else {
+			queues[i] = queues[0]
+		}
+
+		wg.Add(1)
+		go func(queue chan amqp.Delivery) {
+			defer wg.Done()
+			for msg := range queue {
+				c.deliver(cons, msg)
+			}
+		}(queues[i])
+	}
+
+	for msg := range msgs {
+		i := 0
+		if cons.orderingKey != nil {
+			i = worker(cons.orderingKey(msg), len(queues))
+		}
+		queues[i] <- msg
+	}
+
+	close(queues[0])
+	if cons.orderingKey != nil {
+		for _, queue := range queues[1:] {
+			close(queue)
+		}
+	}
+	wg.Wait()
+}
@@ -0,0 +1,86 @@
+package amqp_test
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/getconversio/go-utils/services/amqp"
+	streadway "github.com/streadway/amqp"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBrokerHandleFuncConcurrency(t *testing.T) {
+	broker, c := newBroker(nil)
+	defer c.Close()
+
+	var mu sync.Mutex
+	running, maxRunning := 0, 0
+	received := make(chan int)
+	c.HandleFunc("test.concurrency", "test", "test.concurrency", new(testMsg), func(msg interface{}, headers streadway.Table) error {
+		mu.Lock()
+		running++
+		if running > maxRunning {
+			maxRunning = running
+		}
+		mu.Unlock()
+
+		time.Sleep(100 * time.Millisecond)
+
+		mu.Lock()
+		running--
+		mu.Unlock()
+
+		received <- msg.(*testMsg).I
+		return nil
+	}, amqp.WithConcurrency(4))
+
+	for i := 0; i < 8; i++ {
+		require.NoError(t, c.Publish("test", "test.concurrency", testMsg{i}))
+	}
+	for i := 0; i < 8; i++ {
+		select {
+		case <-received:
+		case <-time.After(2 * time.Second):
+			t.Fatal("waited too long for the consumer")
+		}
+	}
+
+	mu.Lock()
+	assert.Equal(t, 4, maxRunning)
+	mu.Unlock()
+	assert.Equal(t, 0, broker.QueueLength("test.concurrency"))
+}
+
+func TestBrokerHandleFuncOrderingKey(t *testing.T) {
+	broker, c := newBroker(nil)
+	defer c.Close()
+
+	received := make(chan int)
+	c.HandleFunc("test.ordering", "test", "test.ordering", new(testMsg), func(msg interface{}, headers streadway.Table) error {
+		i := msg.(*testMsg).I
+		// Make the first message slow, so it would be overtaken if the
+		// messages were handled concurrently.
+		if i == 0 {
+			time.Sleep(100 * time.Millisecond)
+		}
+		received <- i
+		return nil
+	}, amqp.WithConcurrency(4), amqp.WithOrderingKey(func(d streadway.Delivery) string {
+		return "same"
+	}))
+
+	for i := 0; i < 4; i++ {
+		require.NoError(t, c.Publish("test", "test.ordering", testMsg{i}))
+	}
+	for i := 0; i < 4; i++ {
+		select {
+		case j := <-received:
+			assert.Equal(t, i, j)
+		case <-time.After(2 * time.Second):
+			t.Fatal("waited too long for the consumer")
+		}
+	}
+	assert.Equal(t, 0, broker.QueueLength("test.ordering"))
+}
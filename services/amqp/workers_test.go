@@ -0,0 +1,16 @@
+package amqp
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWorker(t *testing.T) {
+	for _, key := range []string{"", "a", "b", "customer-1234"} {
+		i := worker(key, 4)
+		assert.True(t, i >= 0 && i < 4)
+		assert.Equal(t, i, worker(key, 4), "the same key goes to the same worker")
+	}
+	assert.Equal(t, 0, worker("a", 1))
+}
@@ -5,7 +5,7 @@ set -e
 ci() {
     echo "" > coverage.txt
 
-    for d in $(go list ./... | grep -v -e cmd -e vendor); do
+    for d in $(go list ./... | grep -v -e vendor); do
         go test -coverprofile=profile.out $d
         if [ -f profile.out ]; then
             cat profile.out >> coverage.txt
@@ -16,13 +16,13 @@ ci() {
 
 test() {
     echo "Running tests"
-    go test -cover $(go list ./... | grep -v -e cmd -e vendor)
+    go test -cover $(go list ./... | grep -v -e vendor)
     exit $?
 }
 
 race() {
     echo "Running tests with race check"
-    go test -race $(go list ./... | grep -v -e cmd -e vendor)
+    go test -race $(go list ./... | grep -v -e vendor)
 }
 
 cover() {
@@ -31,7 +31,7 @@ cover() {
     rm -f coverage.html
     touch coverage.tmp
     echo 'mode: atomic' > coverage.txt
-    go list ./... | grep -v -e cmd -e vendor | xargs -n1 -I{} sh -c 'go test -covermode=count -coverprofile=coverage.tmp {} && tail -n +2 coverage.tmp >> coverage.txt'
+    go list ./... | grep -v -e vendor | xargs -n1 -I{} sh -c 'go test -covermode=count -coverprofile=coverage.tmp {} && tail -n +2 coverage.tmp >> coverage.txt'
     rm coverage.tmp
     go tool cover -html coverage.txt -o coverage.html
 }
@@ -70,7 +70,13 @@ var envPattern = regexp.MustCompile(`\$[A-Z_]+`)
 func ReadFileEnvsubst(path string) string {
 	data, err := ioutil.ReadFile(path)
 	PanicOnError("Could not read config file", err)
-	result := envPattern.ReplaceAllStringFunc(string(data), func(match string) string {
+	return Envsubst(string(data))
+}
+
+// Envsubst replaces the environment variable placeholders in s like
+// ReadFileEnvsubst does for a file.
+func Envsubst(s string) string {
+	return envPattern.ReplaceAllStringFunc(s, func(match string) string {
 		// A match here is e.g. $MYVAR
 		// Go does not support positive lookbehind and lookahead so the $ will
 		// have to be removed manually here before looking up the environment
@@ -78,5 +84,4 @@ func ReadFileEnvsubst(path string) string {
 		match = strings.Replace(match, "$", "", -1)
 		return fmt.Sprintf("%s", os.Getenv(match))
 	})
-	return result
 }
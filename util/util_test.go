@@ -111,3 +111,10 @@ func TestReadFileEnvsubst(t *testing.T) {
 	s := ReadFileEnvsubst(tmpfile.Name())
 	assert.Equal(t, `{"mykey":"hej", "mykey2":"hej2.hej3"}`, s)
 }
+
+func TestEnvsubst(t *testing.T) {
+	os.Setenv("MYVAR", "hej")
+	defer os.Unsetenv("MYVAR")
+
+	assert.Equal(t, "hej.$myvar.", Envsubst("$MYVAR.$myvar.$NOT_SET"))
+}